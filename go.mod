@@ -11,6 +11,7 @@ require (
 	blitter.com/go/newhope v0.0.0-20200130200750-192fc08a8aae
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
 	github.com/creack/pty v1.1.11
+	github.com/gorilla/websocket v1.2.0
 	github.com/jameskeane/bcrypt v0.0.0-20120420032655-c3cd44c1e20f
 	github.com/klauspost/reedsolomon v1.9.9 // indirect
 	github.com/kuking/go-frodokem v1.0.1
@@ -21,7 +22,7 @@ require (
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.3.1 // indirect
 	github.com/xtaci/kcp-go v5.4.20+incompatible
-	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37 // indirect
+	github.com/xtaci/lossyconn v0.0.0-20200209145036-adba10fffc37
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 	golang.org/x/sys v0.0.0-20200523222454-059865788121
 	gopkg.in/hlandau/easymetric.v1 v1.0.0 // indirect
@@ -0,0 +1,213 @@
+package main
+
+// Local SOCKS server (xs -D) whose CONNECTs are dialled by the server,
+// over dynamic tunnels (see xsnet/dyntun.go).
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitter.com/go/xs/logger"
+	"blitter.com/go/xs/xsnet"
+)
+
+// SOCKS protocol values (SOCKS4/4a, and RFC 1928 for SOCKS5)
+const (
+	socks4Version   = 4
+	socks4Granted   = 0x5a
+	socks4Rejected  = 0x5b
+	socks5Version   = 5
+	socks5NoAuth    = 0
+	socks5NoMethods = 0xff
+	socksConnect    = 1
+	socks5IPv4      = 1
+	socks5Domain    = 3
+	socks5IPv6      = 4
+
+	socks5Succeeded       = 0
+	socks5HostUnreach     = 4
+	socks5CmdUnsupported  = 7
+	socks5AddrUnsupported = 8
+)
+
+// launchDynTun starts a SOCKS server on [bind:]port (bind defaulting
+// to localhost) for the life of conn.
+func launchDynTun(conn *xsnet.Conn, spec string) {
+	if spec == "" {
+		return
+	}
+	addr := spec
+	if !strings.Contains(spec, ":") {
+		addr = "localhost:" + spec
+	} else if strings.HasPrefix(spec, ":") {
+		addr = "localhost" + spec
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dynamic tunnel:", err) // nolint: errcheck
+		return
+	}
+	logger.LogDebug(fmt.Sprintf("[SOCKS server listening on %s]", l.Addr())) // nolint: gosec,errcheck
+	go func() {
+		defer l.Close() // nolint: errcheck
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(conn, c)
+		}
+	}()
+}
+
+// serveSocks handles a SOCKS4/4a or SOCKS5 client on c, relaying its
+// CONNECT over conn.
+func serveSocks(conn *xsnet.Conn, c net.Conn) {
+	defer c.Close() // nolint: errcheck
+	// (the deadline is for the SOCKS handshake)
+	_ = c.SetDeadline(time.Now().Add(30 * time.Second))
+	r := bufio.NewReader(c)
+	ver, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	var (
+		target string
+		reply  func(ok bool, code byte)
+	)
+	switch ver {
+	case socks4Version:
+		target, reply, err = socks4Request(r, c)
+	case socks5Version:
+		target, reply, err = socks5Request(r, c)
+	default:
+		err = fmt.Errorf("bad SOCKS version %d", ver)
+	}
+	if err != nil {
+		logger.LogDebug(fmt.Sprintf("[SOCKS client %s: %s]", c.RemoteAddr(), err)) // nolint: gosec,errcheck
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	s, err := conn.DialTunnel(ctx, target)
+	cancel()
+	if err != nil {
+		logger.LogDebug(fmt.Sprintf("[SOCKS CONNECT %s: %s]", target, err)) // nolint: gosec,errcheck
+		reply(false, socks5HostUnreach)
+		return
+	}
+	defer s.Close() // nolint: errcheck
+	reply(true, socks5Succeeded)
+	_ = c.SetDeadline(time.Time{})
+
+	go func() {
+		_, _ = io.Copy(s, r)
+		_ = s.Close()
+	}()
+	_, _ = io.Copy(c, s)
+}
+
+// socks4Request reads the rest of a SOCKS4 or 4a CONNECT request:
+//
+//	VN(4) CD(1) DSTPORT DSTIP USERID 0 [HOST 0 (4a, if DSTIP is 0.0.0.x)]
+func socks4Request(r *bufio.Reader, c net.Conn) (target string, reply func(bool, byte), err error) {
+	reply = func(ok bool, _ byte) {
+		code := byte(socks4Rejected)
+		if ok {
+			code = socks4Granted
+		}
+		_, _ = c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	}
+	b := make([]byte, 7)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	if _, err = r.ReadString(0); err != nil { // user id, ignored
+		return
+	}
+	if b[0] != socksConnect {
+		reply(false, 0)
+		return "", nil, fmt.Errorf("unsupported SOCKS4 command %d", b[0])
+	}
+	port := binary.BigEndian.Uint16(b[1:3])
+	host := net.IP(b[3:7]).String()
+	if b[3] == 0 && b[4] == 0 && b[5] == 0 && b[6] != 0 {
+		if host, err = r.ReadString(0); err != nil {
+			return
+		}
+		host = host[:len(host)-1]
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), reply, nil
+}
+
+// socks5Request negotiates (no) authentication with a SOCKS5 client
+// and reads its CONNECT request.
+func socks5Request(r *bufio.Reader, c net.Conn) (target string, reply func(bool, byte), err error) {
+	reply = func(ok bool, code byte) {
+		_, _ = c.Write([]byte{socks5Version, code, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	methods := make([]byte, n)
+	if _, err = io.ReadFull(r, methods); err != nil {
+		return
+	}
+	if bytes.IndexByte(methods, socks5NoAuth) < 0 {
+		_, _ = c.Write([]byte{socks5Version, socks5NoMethods})
+		return "", nil, fmt.Errorf("no acceptable SOCKS5 auth method")
+	}
+	if _, err = c.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	if b[1] != socksConnect {
+		reply(false, socks5CmdUnsupported)
+		return "", nil, fmt.Errorf("unsupported SOCKS5 command %d", b[1])
+	}
+	var host string
+	switch b[3] {
+	case socks5IPv4, socks5IPv6:
+		a := make([]byte, net.IPv4len)
+		if b[3] == socks5IPv6 {
+			a = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, a); err != nil {
+			return
+		}
+		host = net.IP(a).String()
+	case socks5Domain:
+		var l byte
+		if l, err = r.ReadByte(); err != nil {
+			return
+		}
+		a := make([]byte, l)
+		if _, err = io.ReadFull(r, a); err != nil {
+			return
+		}
+		host = string(a)
+	default:
+		reply(false, socks5AddrUnsupported)
+		return "", nil, fmt.Errorf("unsupported SOCKS5 address type %d", b[3])
+	}
+	p := make([]byte, 2)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p)))), reply, nil
+}
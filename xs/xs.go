@@ -10,6 +10,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"flag"
@@ -18,7 +19,6 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"os/exec"
 	"os/user"
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -48,7 +49,11 @@ var (
 	// wg controls when the goroutines handling client I/O complete
 	wg sync.WaitGroup
 
-	kcpMode string // set to a valid KCP BlockCrypt alg tag to use rather than TCP
+	kcpMode   string // set to a valid KCP BlockCrypt alg tag to use rather than TCP
+	kcpKey    string // KCP pre-shared key file
+	transport string // xsnet transport name (see xsnet.Transports())
+	wsPath    string // HTTP path of the ws/wss transports
+	proxy     string // HTTP CONNECT or SOCKS5 proxy URL
 
 	// Log defaults to regular syslog output (no -d)
 	Log *logger.Writer
@@ -577,23 +582,19 @@ func rejectUserMsg() string {
 	return "Begone, " + spinsult.GetSentence() + "\r\n"
 }
 
-// Transmit request to server for it to set up the remote end of a tunnel
-//
-// Server responds with [CSOTunAck:rport] or [CSOTunRefused:rport]
-// (handled in xsnet.Read())
-func reqTunnel(hc *xsnet.Conn, lp uint16, p string /*net.Addr*/, rp uint16) {
-	// Write request to server so it can attempt to set up its end
-	var bTmp bytes.Buffer
-	if e := binary.Write(&bTmp, binary.BigEndian, lp); e != nil {
-		fmt.Fprintln(os.Stderr, "reqTunnel:", e) // nolint: errcheck
-	}
-	if e := binary.Write(&bTmp, binary.BigEndian, rp); e != nil {
-		fmt.Fprintln(os.Stderr, "reqTunnel:", e) // nolint: errcheck
-	}
-	_ = logger.LogDebug(fmt.Sprintln("[Client sending CSOTunSetup]")) // nolint: gosec
-	if n, e := hc.WritePacket(bTmp.Bytes(), xsnet.CSOTunSetup); e != nil || n != len(bTmp.Bytes()) {
-		fmt.Fprintln(os.Stderr, "reqTunnel:", e) // nolint: errcheck
+// askHostKey asks the user whether to trust a server not yet listed in
+// their known_hosts file.
+func askHostKey(hostport, fingerprint string) bool {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprintf(os.Stderr, "Host key %s for '%s' is unknown (no tty to confirm it).\n", fingerprint, hostport) // nolint: errcheck
+		return false
 	}
+	fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n", hostport) // nolint: errcheck
+	fmt.Fprintf(os.Stderr, "Host key fingerprint is %s.\n", fingerprint)                      // nolint: errcheck
+	fmt.Fprintf(os.Stderr, "Are you sure you want to continue connecting (yes/no)? ")         // nolint: errcheck
+	var reply string
+	_, _ = fmt.Scanln(&reply) // nolint: gosec
+	return strings.ToLower(strings.TrimSpace(reply)) == "yes"
 }
 
 func parseNonSwitchArgs(a []string) (user, host, path string, isDest bool, otherArgs []string) {
@@ -631,18 +632,79 @@ func parseNonSwitchArgs(a []string) (user, host, path string, isDest bool, other
 	return fancyUser, fancyHost, fancyPath, isDest, otherArgs
 }
 
-func launchTuns(conn *xsnet.Conn, remoteHost string, tuns string) {
-	remAddrs, _ := net.LookupHost(remoteHost) // nolint: gosec
+// launchTuns asks the server to set up tunnels, each lport:rport (to
+// the server itself) or lport:host:rport (host, as seen by the server,
+// in [] if an IPv6 address), prefixed with u: for UDP.
+func launchTuns(conn *xsnet.Conn, tuns string) {
+	if tuns == "" {
+		return
+	}
+
+	type tunKey struct {
+		udp   bool
+		lPort uint64
+	}
+	lPorts := make(map[tunKey]bool)
+	for _, tunItem := range strings.Split(tuns, ",") {
+		var host string
+		spec := strings.TrimPrefix(tunItem, "u:")
+		udp := spec != tunItem
+		i, j := strings.Index(spec, ":"), strings.LastIndex(spec, ":")
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "bad tunnelspec %q (want [u:]localPort:[host:]remotePort)\n", tunItem) // nolint: errcheck
+			continue
+		}
+		if i < j {
+			host = strings.TrimSuffix(strings.TrimPrefix(spec[i+1:j], "["), "]")
+		}
+		lPort, e1 := strconv.ParseUint(spec[:i], 10, 16)
+		rPort, e2 := strconv.ParseUint(spec[j+1:], 10, 16)
+		if e1 != nil || e2 != nil || (i < j && host == "") {
+			fmt.Fprintf(os.Stderr, "bad tunnelspec %q (want [u:]localPort:[host:]remotePort)\n", tunItem) // nolint: errcheck
+			continue
+		}
+		key := tunKey{udp, lPort}
+		if lPorts[key] {
+			fmt.Fprintf(os.Stderr, "tunnel %q: localPort %d already tunnelled\n", tunItem, lPort) // nolint: errcheck
+			continue
+		}
+		lPorts[key] = true
+		// Server responds with [CSOTunAck] or [CSOTunRefused]
+		// (handled in xsnet.Read())
+		var e error
+		if udp {
+			e = conn.RequestUDPTunnel(uint16(lPort), host, uint16(rPort))
+		} else {
+			e = conn.RequestTunnel(uint16(lPort), host, uint16(rPort))
+		}
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "tunnel %q: %s\n", tunItem, e) // nolint: errcheck
+		}
+	}
+}
 
+// launchRevTuns asks the server to set up reverse tunnels, each
+// rport:lhost:lport.
+func launchRevTuns(conn *xsnet.Conn, tuns string) {
 	if tuns == "" {
 		return
 	}
 
-	tunSpecs := strings.Split(tuns, ",")
-	for _, tunItem := range tunSpecs {
-		var lPort, rPort uint16
-		_, _ = fmt.Sscanf(tunItem, "%d:%d", &lPort, &rPort) // nolint: gosec
-		reqTunnel(conn, lPort, remAddrs[0], rPort)
+	for _, tunItem := range strings.Split(tuns, ",") {
+		f := strings.Split(tunItem, ":")
+		if len(f) != 3 {
+			fmt.Fprintf(os.Stderr, "bad reverse tunnelspec %q (want remotePort:localHost:localPort)\n", tunItem) // nolint: errcheck
+			continue
+		}
+		rPort, e1 := strconv.ParseUint(f[0], 10, 16)
+		lPort, e2 := strconv.ParseUint(f[2], 10, 16)
+		if e1 != nil || e2 != nil || f[1] == "" {
+			fmt.Fprintf(os.Stderr, "bad reverse tunnelspec %q (want remotePort:localHost:localPort)\n", tunItem) // nolint: errcheck
+			continue
+		}
+		if e := conn.RequestRevTunnel(uint16(rPort), f[1], uint16(lPort)); e != nil {
+			fmt.Fprintln(os.Stderr, "reverse tunnel:", e) // nolint: errcheck
+		}
 	}
 }
 
@@ -690,7 +752,9 @@ func main() {
 		server        string
 		port          uint
 		cmdStr        string
-		tunSpecStr    string // lport1:rport1[,lport2:rport2,...]
+		tunSpecStr    string // [u:]lport1:[host1:]rport1[,[u:]lport2:[host2:]rport2,...]
+		revTunSpecStr string // rport1:lhost1:lport1[,rport2:lhost2:lport2,...]
+		dynTunSpecStr string // [bind:]port of local SOCKS server
 
 		copySrc      []byte
 		copyDst      string
@@ -703,6 +767,9 @@ func main() {
 		chaffFreqMax  uint
 		chaffBytesMax uint
 
+		rekeyBytes    uint64
+		rekeyInterval time.Duration
+
 		op []byte
 	)
 
@@ -710,16 +777,22 @@ func main() {
 
 	flag.BoolVar(&vopt, "v", false, "show version")
 	flag.BoolVar(&dbg, "d", false, "debug logging")
-	flag.StringVar(&cipherAlg, "c", "C_AES_256", "session `cipher` [C_AES_256 | C_TWOFISH_128 | C_BLOWFISH_64 | C_CRYPTMT1 | C_CHACHA20_12]")
-	flag.StringVar(&hmacAlg, "m", "H_SHA256", "session `HMAC` [H_SHA256 | H_SHA512]")
-	flag.StringVar(&kexAlg, "k", "KEX_HERRADURA512", "KEx `alg` [KEX_HERRADURA{256/512/1024/2048} | KEX_KYBER{512/768/1024} | KEX_NEWHOPE | KEX_NEWHOPE_SIMPLE | KEX_FRODOKEM_{1344|976}{AES|SHAKE}]")
-	flag.StringVar(&kcpMode, "K", "unused", "KCP `alg`, one of [KCP_NONE | KCP_AES | KCP_BLOWFISH | KCP_CAST5 | KCP_SM4 | KCP_SALSA20 | KCP_SIMPLEXOR | KCP_TEA | KCP_3DES | KCP_TWOFISH | KCP_XTEA] to use KCP (github.com/xtaci/kcp-go) reliable UDP instead of TCP")
+	flag.StringVar(&cipherAlg, "c", "C_AES_256_GCM,C_CHACHA20_POLY1305,C_AES_256", "session `cipher`s, comma-separated in order of preference [C_AES_256 | C_TWOFISH_128 | C_BLOWFISH_64 | C_CRYPTMT1 | C_CHACHA20_12 | C_AES_256_GCM | C_CHACHA20_POLY1305]")
+	flag.StringVar(&hmacAlg, "m", "H_SHA256,H_SHA512", "session `HMAC`s, comma-separated in order of preference [H_SHA256 | H_SHA512]")
+	flag.StringVar(&kexAlg, "k", "KEX_X25519_KYBER768,KEX_X25519_FRODOKEM_976AES", "KEx `alg`s, comma-separated in order of preference [KEX_HERRADURA{256/512/1024/2048} | KEX_KYBER{512/768/1024} | KEX_NEWHOPE | KEX_NEWHOPE_SIMPLE | KEX_FRODOKEM_{1344|976}{AES|SHAKE} | KEX_X25519_KYBER768 | KEX_X25519_FRODOKEM_976AES]")
+	flag.StringVar(&kcpMode, "K", "unused", "KCP `alg[,profile][,setting=value...]`, alg one of [KCP_NONE | KCP_AES | KCP_BLOWFISH | KCP_CAST5 | KCP_SM4 | KCP_SALSA20 | KCP_SIMPLEXOR | KCP_TEA | KCP_3DES | KCP_TWOFISH | KCP_XTEA], profile one of ["+strings.Join(xsnet.KCPProfileNames(), " | ")+"] (see go doc xsnet.ParseKCPProfile), to use KCP (github.com/xtaci/kcp-go) reliable UDP instead of TCP")
+	flag.StringVar(&kcpKey, "kcpkey", "", "KCP pre-shared key `file` (as generated by xsd -kcpkey)")
+	flag.StringVar(&transport, "transport", "tcp", "`transport`, one of ["+strings.Join(xsnet.Transports(), " | ")+"] (-K implies kcp)")
+	flag.StringVar(&wsPath, "wspath", xsnet.WSPathDefault, "HTTP `path` of the ws and wss transports")
+	flag.StringVar(&proxy, "proxy", "", "connect via proxy `URL`, http://[user:passwd@]host[:port] (HTTP CONNECT) or socks5://[user:passwd@]host[:port] (default $HTTPS_PROXY or $ALL_PROXY; \"direct\" for none)")
 	flag.UintVar(&port, "p", 2000, "``port")
 	//flag.StringVar(&authCookie, "a", "", "auth cookie")
 	flag.BoolVar(&chaffEnabled, "e", true, "enable chaff pkts")
 	flag.UintVar(&chaffFreqMin, "f", 100, "chaff pkt freq min `msecs`")
 	flag.UintVar(&chaffFreqMax, "F", 5000, "chaff pkt freq max `msecs`")
 	flag.UintVar(&chaffBytesMax, "B", 64, "chaff pkt size max `bytes`")
+	flag.Uint64Var(&rekeyBytes, "rekeybytes", xsnet.RekeyBytesDefault, "rekey session after this many `bytes` (0: never)")
+	flag.DurationVar(&rekeyInterval, "rekeytime", xsnet.RekeyIntervalDefault, "rekey session after this `duration` (0: never)")
 
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "write cpu profile to <`file`>")
 	flag.StringVar(&memprofile, "memprofile", "", "write memory profile to <`file`>")
@@ -735,7 +808,9 @@ func main() {
 		// xs accepts a command (-x) but not
 		// a srcpath (-r) or dstpath (-t)
 		flag.StringVar(&cmdStr, "x", "", "run <`command`> (if not specified, run interactive shell)")
-		flag.StringVar(&tunSpecStr, "T", "", "``tunnelspec - localPort:remotePort[,localPort:remotePort,...]")
+		flag.StringVar(&tunSpecStr, "T", "", "``tunnelspec - [u:]localPort:[host:]remotePort[,[u:]localPort:[host:]remotePort,...] (u: for UDP)")
+		flag.StringVar(&dynTunSpecStr, "D", "", "dynamic tunnel - run a SOCKS5/4a server on local `[bind:]port` (bind default localhost) whose connections are made by the server")
+		flag.StringVar(&revTunSpecStr, "R", "", "reverse `tunnelspec` - remotePort:localHost:localPort[,...] (server listens on its loopback remotePort)")
 		flag.BoolVar(&gopt, "g", false, "ask server to generate authtoken")
 		shellMode = true
 		flag.Usage = usageShell
@@ -786,6 +861,11 @@ func main() {
 
 	if remoteHost != "" {
 		server = remoteHost + ":" + fmt.Sprintf("%d", port)
+		if transport == "unix" {
+			server = remoteHost // socket path
+		} else if transport == "ws" || transport == "wss" {
+			server += wsPath
+		}
 	}
 	if tmpPath == "" {
 		tmpPath = "."
@@ -924,17 +1004,58 @@ func main() {
 		}
 	}
 
-	//=== TCP / KCP Dial setup
+	//=== Server host key verification against ~/.xs/known_hosts
 
-	proto := "tcp"
-	if kcpMode != "unused" {
+	u, uerr := user.Current()
+	if uerr != nil {
+		log.Fatal("could not get current user for known hosts: ", uerr)
+	}
+	knownHosts := filepath.Join(u.HomeDir, ".xs", "known_hosts")
+	xsnet.SetHostKeyCallback(xsnet.KnownHostsCallback(knownHosts, askHostKey))
+
+	//=== Transport (TCP, KCP, ...) Dial setup
+
+	// -K alg[,profile][,setting=value...]
+	if i := strings.IndexByte(kcpMode, ','); i >= 0 {
+		p, err := xsnet.ParseKCPProfile(kcpMode[i+1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		xsnet.SetKCPProfile(p)
+		kcpMode = kcpMode[:i]
+	}
+	proto := transport
+	if kcpMode != "unused" && proto == "tcp" {
 		proto = "kcp"
 	}
-	conn, err := xsnet.Dial(proto, server, cipherAlg, hmacAlg, kexAlg, kcpMode)
+	// The server chooses from our alg preferences, in order
+	var exts []string
+	for _, a := range []string{kexAlg, cipherAlg, hmacAlg} {
+		exts = append(exts, strings.Split(a, ",")...)
+	}
+	if kcpMode != "unused" {
+		exts = append(exts, kcpMode)
+	}
+	if kcpKey != "" {
+		if err := xsnet.LoadKCPKey(kcpKey, false); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg, err := xsnet.NewConfig(proto, exts...)
 	if err != nil {
 		fmt.Println(err)
 		exitWithStatus(3)
 	}
+	cfg.Proxy = proxy
+	conn, err := xsnet.DialContext(context.Background(), server, cfg)
+	if err != nil {
+		fmt.Println(err)
+		if err == xsnet.ErrHostKeyMismatch {
+			fmt.Printf("If the host key of %s was legitimately changed, remove its entry from %s\n", server, knownHosts)
+		}
+		exitWithStatus(3)
+	}
+	conn.SetupRekey(rekeyBytes, rekeyInterval)
 
 	//=== Shell terminal mode (Shell vs. Copy) setup
 
@@ -992,7 +1113,7 @@ func main() {
 
 	// Set up session params and send over to server
 	rec := xs.NewSession(op, []byte(uname), []byte(remoteHost), []byte(os.Getenv("TERM")), []byte(cmdStr), []byte(authCookie), 0)
-	sendErr := sendSessionParams(&conn, rec)
+	sendErr := sendSessionParams(conn, rec)
 	if sendErr != nil {
 		restoreTermState(oldState)
 		rec.SetStatus(254)
@@ -1051,11 +1172,13 @@ func main() {
 		//=== Session entry (shellMode or copyMode)
 		if shellMode {
 			//=== (shell) launch tunnels
-			launchTuns(&conn, remoteHost, tunSpecStr)
-			doShellMode(isInteractive, &conn, oldState, rec)
+			launchTuns(conn, tunSpecStr)
+			launchRevTuns(conn, revTunSpecStr)
+			launchDynTun(conn, dynTunSpecStr)
+			doShellMode(isInteractive, conn, oldState, rec)
 		} else {
 			//=== (.. or file copy)
-			s, _ := doCopyMode(&conn, pathIsDest, fileArgs, copyQuiet, copyLimitBPS, rec) // nolint: errcheck,gosec
+			s, _ := doCopyMode(conn, pathIsDest, fileArgs, copyQuiet, copyLimitBPS, rec) // nolint: errcheck,gosec
 			rec.SetStatus(s)
 		}
 
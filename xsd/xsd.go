@@ -10,6 +10,7 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -34,6 +35,7 @@ import (
 	"blitter.com/go/xs/logger"
 	"blitter.com/go/xs/xsnet"
 	"github.com/creack/pty"
+	"golang.org/x/crypto/ed25519"
 )
 
 var (
@@ -42,6 +44,12 @@ var (
 
 	useSysLogin bool
 	kcpMode     string // set to a valid KCP BlockCrypt alg tag to use rather than TCP
+	transport   string // xsnet transport name (see xsnet.Transports())
+	kcpKey      string // KCP pre-shared key file
+	wsPath      string // HTTP path of the ws/wss transports
+	wsCert      string // TLS certificate file (wss)
+	wsKey       string // TLS key file (wss)
+	dynTuns     bool   // allow clients' dynamic tunnels
 
 	// Log - syslog output (with no -d)
 	Log *logger.Writer
@@ -435,61 +443,34 @@ var (
 	aHMACAlgs   allowedHMACAlgs
 )
 
-type allowedKEXAlgs []string    // TODO
-type allowedCipherAlgs []string // TODO
-type allowedHMACAlgs []string   // TODO
-
-func (a allowedKEXAlgs) allowed(k xsnet.KEXAlg) bool {
-	for i := 0; i < len(a); i++ {
-		if a[i] == "KEX_all" || a[i] == k.String() {
-			return true
-		}
-	}
-	return false
-}
+type allowedKEXAlgs []string
+type allowedCipherAlgs []string
+type allowedHMACAlgs []string
 
 func (a *allowedKEXAlgs) String() string {
 	return fmt.Sprintf("allowedKEXAlgs: %v", *a)
 }
 
 func (a *allowedKEXAlgs) Set(value string) error {
-	*a = append(*a, strings.TrimSpace(value))
+	*a = append(*a, strings.Fields(strings.Replace(value, ",", " ", -1))...)
 	return nil
 }
 
-func (a allowedCipherAlgs) allowed(c xsnet.CSCipherAlg) bool {
-	for i := 0; i < len(a); i++ {
-		if a[i] == "C_all" || a[i] == c.String() {
-			return true
-		}
-	}
-	return false
-}
-
 func (a *allowedCipherAlgs) String() string {
 	return fmt.Sprintf("allowedCipherAlgs: %v", *a)
 }
 
 func (a *allowedCipherAlgs) Set(value string) error {
-	*a = append(*a, strings.TrimSpace(value))
+	*a = append(*a, strings.Fields(strings.Replace(value, ",", " ", -1))...)
 	return nil
 }
 
-func (a allowedHMACAlgs) allowed(h xsnet.CSHmacAlg) bool {
-	for i := 0; i < len(a); i++ {
-		if a[i] == "H_all" || a[i] == h.String() {
-			return true
-		}
-	}
-	return false
-}
-
 func (a *allowedHMACAlgs) String() string {
 	return fmt.Sprintf("allowedHMACAlgs: %v", *a)
 }
 
 func (a *allowedHMACAlgs) Set(value string) error {
-	*a = append(*a, strings.TrimSpace(value))
+	*a = append(*a, strings.Fields(strings.Replace(value, ",", " ", -1))...)
 	return nil
 }
 
@@ -509,12 +490,23 @@ func main() {
 	var chaffBytesMax uint
 	var dbg bool
 	var laddr string
+	var hostKeyFile string
 
 	var useSystemPasswd bool
 
+	var hsTimeout time.Duration
+	var hsMax int
+
 	flag.BoolVar(&vopt, "v", false, "show version")
 	flag.StringVar(&laddr, "l", ":2000", "interface[:port] to listen")
-	flag.StringVar(&kcpMode, "K", "unused", `set to one of ["KCP_NONE","KCP_AES", "KCP_BLOWFISH", "KCP_CAST5", "KCP_SM4", "KCP_SALSA20", "KCP_SIMPLEXOR", "KCP_TEA", "KCP_3DES", "KCP_TWOFISH", "KCP_XTEA"] to use KCP (github.com/xtaci/kcp-go) reliable UDP instead of TCP`)
+	flag.StringVar(&hostKeyFile, "k", "/etc/xs.hostkey", "host key `file` (created if missing)")
+	flag.StringVar(&kcpMode, "K", "unused", `set to one of ["KCP_NONE","KCP_AES", "KCP_BLOWFISH", "KCP_CAST5", "KCP_SM4", "KCP_SALSA20", "KCP_SIMPLEXOR", "KCP_TEA", "KCP_3DES", "KCP_TWOFISH", "KCP_XTEA"], optionally followed by ",profile" and/or ",setting=value..." (see go doc xsnet.ParseKCPProfile), to use KCP (github.com/xtaci/kcp-go) reliable UDP instead of TCP`)
+	flag.StringVar(&kcpKey, "kcpkey", "", "KCP pre-shared key `file` (created if missing; copy it to clients)")
+	flag.StringVar(&transport, "transport", "tcp", "`transport`, one of ["+strings.Join(xsnet.Transports(), " | ")+"] (-K implies kcp)")
+	flag.StringVar(&wsPath, "wspath", xsnet.WSPathDefault, "HTTP `path` to accept ws and wss transport connections on")
+	flag.StringVar(&wsCert, "wscert", "", "TLS certificate `file` (PEM) for the wss transport")
+	flag.StringVar(&wsKey, "wskey", "", "TLS key `file` (PEM) for the wss transport")
+	flag.BoolVar(&dynTuns, "dyntun", false, "allow clients' dynamic tunnels (xs -D), and tunnels given a host (xs -T), to any host:port reachable from the server")
 	flag.BoolVar(&useSysLogin, "L", false, "use system login")
 	flag.BoolVar(&chaffEnabled, "e", true, "enable chaff pkts")
 	flag.UintVar(&chaffFreqMin, "f", 100, "chaff pkt freq min (msecs)")
@@ -522,6 +514,8 @@ func main() {
 	flag.UintVar(&chaffBytesMax, "B", 64, "chaff pkt size max (bytes)")
 	flag.BoolVar(&useSystemPasswd, "s", true, "use system shadow passwds")
 	flag.BoolVar(&dbg, "d", false, "debug logging")
+	flag.DurationVar(&hsTimeout, "ht", xsnet.HandshakeTimeoutDefault, "client handshake (KEx) timeout")
+	flag.IntVar(&hsMax, "hn", xsnet.MaxHandshakesDefault, "max client handshakes (KEx) in progress at once")
 
 	flag.Var(&aKEXAlgs, "aK", `List of allowed KEX algs (eg. 'KEXAlgA KEXAlgB ... KEXAlgN') (default allow all)`)
 	flag.Var(&aCipherAlgs, "aC", `List of allowed ciphers (eg. 'CipherAlgA CipherAlgB ... CipherAlgN') (default allow all)`)
@@ -560,6 +554,14 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	// Load (or on first run, generate) our host key, used to prove
+	// the server's identity to clients
+	hostKey, err := xsnet.LoadHostKey(hostKeyFile, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.LogNotice(fmt.Sprintf("Host key: %s\n", xsnet.HostKeyFingerprint(hostKey.Public().(ed25519.PublicKey)))) // nolint: gosec,errcheck
+
 	// Set up allowed algs, if specified (default allow all)
 	if len(aKEXAlgs) == 0 {
 		aKEXAlgs = []string{"KEX_all"}
@@ -599,35 +601,58 @@ func main() {
 		}
 	}()
 
-	proto := "tcp"
-	if kcpMode != "unused" {
+	// -K alg[,profile][,setting=value...]
+	if i := strings.IndexByte(kcpMode, ','); i >= 0 {
+		p, err := xsnet.ParseKCPProfile(kcpMode[i+1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		xsnet.SetKCPProfile(p)
+		kcpMode = kcpMode[:i]
+	}
+	proto := transport
+	if kcpMode != "unused" && proto == "tcp" {
 		proto = "kcp"
 	}
-	l, err := xsnet.Listen(proto, laddr, kcpMode)
+	if kcpKey != "" {
+		if err := xsnet.LoadKCPKey(kcpKey, true); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if proto == "ws" || proto == "wss" {
+		if wsCert != "" {
+			cert, err := tls.LoadX509KeyPair(wsCert, wsKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			xsnet.SetWSTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+		laddr += wsPath
+	}
+	xsnet.AllowDynTunnels(dynTuns)
+	lcfg := &xsnet.Config{Transport: proto, KCPAlg: xsnet.KCP_AES}
+	if proto == "kcp" && kcpMode != "unused" {
+		if lcfg, err = xsnet.NewConfig(proto, kcpMode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	lcfg.HostKey = hostKey
+	l, err := xsnet.ListenConfig(laddr, lcfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer l.Close() // nolint: errcheck
 
+	// Clients are refused unless they offer an allowed alg of each kind
+	l.SetAllowedAlgs(aKEXAlgs, aCipherAlgs, aHMACAlgs)
+	l.SetHandshakeLimits(hsTimeout, hsMax)
+
 	log.Println("Serving on", laddr)
 	for {
 		// Wait for a connection.
-		// Then check if client-proposed algs are allowed
-		conn, err := l.Accept()
+		conn, err := l.AcceptConn()
 		if err != nil {
 			log.Printf("Accept() got error(%v), hanging up.\n", err)
-		} else if !aKEXAlgs.allowed(conn.KEX()) {
-			log.Printf("Accept() rejected for banned KEX alg %d, hanging up.\n", conn.KEX())
-			conn.SetStatus(xsnet.CSEKEXAlgDenied)
-			conn.Close()
-		} else if !aCipherAlgs.allowed(conn.CAlg()) {
-			log.Printf("Accept() rejected for banned Cipher alg %d, hanging up.\n", conn.CAlg())
-			conn.SetStatus(xsnet.CSECipherAlgDenied)
-			conn.Close()
-		} else if !aHMACAlgs.allowed(conn.HAlg()) {
-			log.Printf("Accept() rejected for banned HMAC alg %d, hanging up.\n", conn.HAlg())
-			conn.SetStatus(xsnet.CSEHMACAlgDenied)
-			conn.Close()
 		} else {
 			log.Println("Accepted client")
 
@@ -734,6 +759,7 @@ func main() {
 
 				// Tell client if auth was valid
 				if valid {
+					hc.EnableTunnels()
 					hc.Write([]byte{1}) // nolint: gosec,errcheck
 				} else {
 					logger.LogNotice(fmt.Sprintln("Invalid user", string(rec.Who()))) // nolint: errcheck,gosec
@@ -842,7 +868,7 @@ func main() {
 					logger.LogErr(fmt.Sprintln("[Bad xs.Session]")) // nolint: gosec,errcheck
 				}
 				return
-			}(&conn) // nolint: errcheck
+			}(conn) // nolint: errcheck
 		} // Accept() success
 	} //endfor
 	//logger.LogNotice(fmt.Sprintln("[Exiting]")) // nolint: gosec,errcheck
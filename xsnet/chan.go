@@ -11,151 +11,151 @@ established with FA exchange and support channel operations
 (echo, file-copy, remote-cmd, ...) */
 
 import (
-	"crypto"
-	"crypto/aes"
 	"crypto/cipher"
-	"encoding/hex"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
+	"io"
 	"log"
 
-	"blitter.com/go/cryptmt"
-	"github.com/aead/chacha20/chacha"
-	"golang.org/x/crypto/blowfish"
-	"golang.org/x/crypto/twofish"
-
-	// hash algos must be manually imported thusly:
-	// (Would be nice if the golang pkg docs were more clear
-	// on this...)
-	_ "crypto/sha256"
-	_ "crypto/sha512"
+	"golang.org/x/crypto/hkdf"
 )
 
-// Expand keymat, if necessary, to a minimum of 2x(blocksize).
-// Keymat is used for initial key and the IV, hence the 2x.
-// This is occasionally necessary for smaller modes of KEX algorithms
-// (eg., KEX_HERRADURA256); perhaps an indication these should be
-// avoided in favour of larger modes.
-//
-// This is used for block ciphers; stream ciphers should do their
-// own key expansion.
-func expandKeyMat(keymat []byte, blocksize int) []byte {
-	if len(keymat) < 2*blocksize {
-		halg := crypto.SHA256
-		mc := halg.New()
-		if !halg.Available() {
-			log.Fatal("hash not available!")
-		}
-		_, _ = mc.Write(keymat)
-		var xpand []byte
-		xpand = mc.Sum(xpand)
-		keymat = append(keymat, xpand...)
-		log.Println("[NOTE: keymat short - applying key expansion using SHA256]")
+// keySched is the session key schedule (see KeySchedV1). HKDF-SHA256
+// is used to extract a pseudorandom key from the KEx shared secret,
+// salted with a hash of the KEx transcript, from which independent keys,
+// IVs and MAC keys are then expanded for each direction.
+type keySched struct {
+	prk []byte
+}
+
+func newKeySched(secret, transcriptHash []byte) *keySched {
+	return &keySched{prk: hkdf.Extract(sha256.New, secret, transcriptHash)}
+}
+
+// expand returns n bytes of key material for the given purpose
+// (eg., "c2s key"), which is unrelated to that of any other purpose.
+func (ks *keySched) expand(label string, n int) []byte {
+	k := make([]byte, n)
+	r := hkdf.Expand(sha256.New, ks.prk, []byte(fmt.Sprintf("xsnet ks%d %s", KeySchedV1, label)))
+	if _, err := io.ReadFull(r, k); err != nil {
+		panic(err) // only if n > 255*sha256.Size
 	}
-	return keymat
+	return k
 }
 
-/* Support functionality to set up encryption after a channel has
-been negotiated via xsnet.go
-*/
-func (hc *Conn) getStream(keymat []byte) (rc cipher.Stream, mc hash.Hash, err error) {
-	var key []byte
-	var block cipher.Block
-	var iv []byte
-	var ivlen int
-
-	copts := hc.cipheropts & 0xFF
-	// TODO: each cipher alg case should ensure len(keymat.Bytes())
-	// is >= 2*cipher.BlockSize (enough for both key and iv)
-	switch copts {
-	case CAlgAES256:
-		keymat = expandKeyMat(keymat, aes.BlockSize)
-		key = keymat[0:aes.BlockSize]
-		block, err = aes.NewCipher(key)
-		ivlen = aes.BlockSize
-		iv = keymat[aes.BlockSize : aes.BlockSize+ivlen]
-		rc = cipher.NewOFB(block, iv)
-		log.Printf("[cipher AES_256 (%d)]\n", copts)
-	case CAlgTwofish128:
-		keymat = expandKeyMat(keymat, twofish.BlockSize)
-		key = keymat[0:twofish.BlockSize]
-		block, err = twofish.NewCipher(key)
-		ivlen = twofish.BlockSize
-		iv = keymat[twofish.BlockSize : twofish.BlockSize+ivlen]
-		rc = cipher.NewOFB(block, iv)
-		log.Printf("[cipher TWOFISH_128 (%d)]\n", copts)
-	case CAlgBlowfish64:
-		keymat = expandKeyMat(keymat, blowfish.BlockSize)
-		key = keymat[0:blowfish.BlockSize]
-		block, err = blowfish.NewCipher(key)
-		ivlen = blowfish.BlockSize
-		// N.b. Bounds enforcement of differing cipher algorithms
-		// ------------------------------------------------------
-		// cipher/aes and x/cipher/twofish appear to allow one to
-		// pass an iv larger than the blockSize harmlessly to
-		// cipher.NewOFB(); x/cipher/blowfish implementation will
-		// segfault here if len(iv) is not exactly blowfish.BlockSize.
-		//
-		// I assume the other two check bounds and only
-		// copy what's needed whereas blowfish does no such check.
-		iv = keymat[blowfish.BlockSize : blowfish.BlockSize+ivlen]
-		rc = cipher.NewOFB(block, iv)
-		log.Printf("[cipher BLOWFISH_64 (%d)]\n", copts)
-	case CAlgCryptMT1:
-		rc = cryptmt.New(nil, nil, keymat)
-		log.Printf("[cipher CRYPTMT1 (%d)]\n", copts)
-	case CAlgChaCha20_12:
-		keymat = expandKeyMat(keymat, chacha.KeySize)
-		key = keymat[0:chacha.KeySize]
-		ivlen = chacha.INonceSize
-		iv = keymat[chacha.KeySize : chacha.KeySize+ivlen]
-		rc, err = chacha.NewCipher(iv, key, chacha.INonceSize)
-		if err != nil {
-			log.Printf("[ChaCha20 config error]\n")
-			fmt.Printf("[ChaCha20 config error]\n")
-		}
-		// TODO: SetCounter() to something derived from key or nonce or extra keymat?
-		log.Printf("[cipher CHACHA20_12 (%d)]\n", copts)
-	default:
-		log.Printf("[invalid cipher (%d)]\n", copts)
-		fmt.Printf("DOOFUS SET A VALID CIPHER ALG (%d)\n", copts)
-		err = errors.New("hkexchan: INVALID CIPHER ALG")
-		//os.Exit(1)
+// setupStreams sets up the read and write cipher and MAC state of hc
+// from the KEx shared secret. Each direction (client->server, "c2s" and
+// server->client, "s2c") has its own keys.
+func (hc *Conn) setupStreams(secret []byte) (err error) {
+	if v := (hc.cipheropts >> 16) & 0xFF; v != KeySchedV1 {
+		return fmt.Errorf("hkexchan: unsupported key schedule version %d", v)
+	}
+	if hc.kexT == nil {
+		return errors.New("hkexchan: no KEx transcript")
+	}
+	ks := newKeySched(secret, hc.kexT.digest(hc.server, "xsnet key schedule", nil))
+
+	rdir, wdir := "s2c", "c2s"
+	if hc.server {
+		rdir, wdir = wdir, rdir
 	}
 
-	hopts := (hc.cipheropts >> 8) & 0xFF
-	switch hopts {
-	case HmacSHA256:
-		log.Printf("[hash HmacSHA256 (%d)]\n", hopts)
-		halg := crypto.SHA256
-		mc = halg.New()
-		if !halg.Available() {
-			log.Fatal("hash not available!")
+	c, ok := lookupCipher(hc.CAlg())
+	if !ok {
+		return fmt.Errorf("hkexchan: invalid cipher alg %d", hc.CAlg())
+	}
+	r, w := &dirKeys{}, &dirKeys{}
+	switch c := c.(type) {
+	case AEADCipher:
+		// AEAD ciphers authenticate each packet themselves (so no
+		// HMAC was negotiated)
+		r.a, err = getAEAD(c, ks, rdir)
+		if err == nil {
+			w.a, err = getAEAD(c, ks, wdir)
 		}
-	case HmacSHA512:
-		log.Printf("[hash HmacSHA512 (%d)]\n", hopts)
-		halg := crypto.SHA512
-		mc = halg.New()
-		if !halg.Available() {
-			log.Fatal("hash not available!")
+	case StreamCipher:
+		r.s, r.m, err = hc.getStream(c, ks, rdir)
+		if err == nil {
+			w.s, w.m, err = hc.getStream(c, ks, wdir)
 		}
-	default:
-		log.Printf("[invalid hmac (%d)]\n", hopts)
-		fmt.Printf("DOOFUS SET A VALID HMAC ALG (%d)\n", hopts)
-		err = errors.New("hkexchan: INVALID HMAC ALG")
-		return
-		//os.Exit(1)
 	}
+	if err == nil {
+		hc.r, hc.w = r, w
+	}
+	return
+}
 
+// dirKeys is the cipher and MAC state for one direction of a Conn.
+// It is shared by all copies of the Conn, so that on rekeying new
+// keys can be switched in (see rekey.go).
+type dirKeys struct {
+	s   cipher.Stream // stream cipher, or
+	a   *aeadState    // AEAD cipher, or nil
+	m   hash.Hash     // hmac (stream ciphers only)
+	seq uint64        // sequence number of next frame
+}
+
+// nextSeq returns the sequence number of the next frame sent or
+// received in this direction. Sequence numbers are implicit (never
+// sent) and restart from zero with each new set of keys; as they are
+// authenticated along with each frame, a dropped, replayed or
+// reordered frame fails authentication.
+func (d *dirKeys) nextSeq() uint64 {
+	s := d.seq
+	d.seq++
+	return s
+}
+
+// getStream sets up a stream session cipher and the session MAC for
+// one direction.
+func (hc *Conn) getStream(c StreamCipher, ks *keySched, dir string) (rc cipher.Stream, mc hash.Hash, err error) {
+	rc, err = c.NewStream(ks.expand(dir+" key", c.KeySize()), ks.expand(dir+" iv", c.IVSize()))
 	if err != nil {
-		// Feed the IV into the hmac: all traffic in the connection must
-		// feed its data into the hmac afterwards, so both ends can xor
-		// that with the stream to detect corruption.
-		_, _ = mc.Write(iv)
-		var currentHash []byte
-		currentHash = mc.Sum(currentHash)
-		log.Printf("Channel init hmac(iv):%s\n", hex.EncodeToString(currentHash))
+		log.Printf("[%s config error]\n", c.Name())
+		return nil, nil, err
 	}
+	log.Printf("[cipher %s (%d)]\n", c.Name(), c.ID())
+
+	m, ok := lookupMAC(hc.HAlg())
+	if !ok {
+		log.Printf("[invalid hmac (%d)]\n", hc.HAlg())
+		return nil, nil, fmt.Errorf("hkexchan: invalid HMAC alg %d", hc.HAlg())
+	}
+	log.Printf("[hash %s (%d)]\n", m.Name(), m.ID())
+	mc = m.New(ks.expand(dir+" mac", m.KeySize()))
 	return
 }
+
+// aeadState is the per-direction state of an AEAD session cipher.
+// Each packet's nonce is the direction's base iv XORed with the frame
+// sequence number, so no nonce is ever reused under one key.
+type aeadState struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+// getAEAD sets up an AEAD session cipher (which provides its own
+// per-packet authentication, in place of an HMAC) for one direction.
+func getAEAD(c AEADCipher, ks *keySched, dir string) (s *aeadState, err error) {
+	a, err := c.NewAEAD(ks.expand(dir+" key", c.KeySize()))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[cipher %s (%d)]\n", c.Name(), c.ID())
+	return &aeadState{aead: a, iv: ks.expand(dir+" iv", a.NonceSize())}, nil
+}
+
+// nonce returns the nonce for the frame with sequence number seq.
+func (s *aeadState) nonce(seq uint64) []byte {
+	n := make([]byte, len(s.iv))
+	copy(n, s.iv)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], seq)
+	for i := range ctr {
+		n[len(n)-8+i] ^= ctr[i]
+	}
+	return n
+}
@@ -0,0 +1,212 @@
+// cipher.go - registry of session (symmetric) cipher algs
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Each session cipher is a Cipher registered by its ID (the value
+// carried in the low byte of the conn's cipheropts) and Name (as used
+// in Dial() extensions, Config and xsd's allowed-alg lists). A Cipher
+// is either a StreamCipher, whose packets are authenticated by the
+// session MAC (see mac.go), or an AEADCipher, which authenticates
+// packets itself. Other packages may add their own with
+// RegisterCipher(), using an otherwise unused ID.
+//
+// Keys and IVs are supplied by the session key schedule, so a Cipher
+// only states how much of each it needs.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"sort"
+	"sync"
+
+	"blitter.com/go/cryptmt"
+	"github.com/aead/chacha20/chacha"
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/twofish"
+)
+
+// Cipher is a session cipher alg. It must also implement either
+// StreamCipher or AEADCipher.
+type Cipher interface {
+	// ID is the alg's value in alg negotiation (0-255)
+	ID() CSCipherAlg
+	// Name is the alg's name, eg. "C_AES_256"
+	Name() string
+	// KeySize is the length of key wanted, in bytes
+	KeySize() int
+}
+
+// StreamCipher is a Cipher producing a keystream, used along with
+// the session MAC.
+type StreamCipher interface {
+	Cipher
+	// IVSize is the length of iv wanted, in bytes
+	IVSize() int
+	// BlockSize is the block size of the underlying block cipher,
+	// in bytes (or 0 for a native stream cipher). Sessions using a
+	// 64-bit block cipher are rekeyed more often.
+	BlockSize() int
+	NewStream(key, iv []byte) (cipher.Stream, error)
+}
+
+// AEADCipher is a Cipher which authenticates each packet itself; the
+// session MAC is not used.
+type AEADCipher interface {
+	Cipher
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	cipherMu       sync.RWMutex
+	cipherRegistry = make(map[CSCipherAlg]Cipher)
+)
+
+// RegisterCipher adds c to the session ciphers xsnet may negotiate.
+// It is an error if c's ID or Name is already registered, or c is
+// neither a StreamCipher nor an AEADCipher.
+func RegisterCipher(c Cipher) error {
+	cipherMu.Lock()
+	defer cipherMu.Unlock()
+	if c.ID() > 0xFF {
+		return fmt.Errorf("cipher alg %s: invalid ID %d", c.Name(), c.ID())
+	}
+	switch c.(type) {
+	case StreamCipher, AEADCipher:
+	default:
+		return fmt.Errorf("cipher alg %s is neither a StreamCipher nor an AEADCipher", c.Name())
+	}
+	if o, ok := cipherRegistry[c.ID()]; ok {
+		return fmt.Errorf("cipher alg %s: ID %d already registered for %s", c.Name(), c.ID(), o.Name())
+	}
+	for _, o := range cipherRegistry {
+		if o.Name() == c.Name() {
+			return fmt.Errorf("cipher alg %s already registered (ID %d)", c.Name(), o.ID())
+		}
+	}
+	cipherRegistry[c.ID()] = c
+	return nil
+}
+
+// lookupCipher returns the registered Cipher with the given ID.
+func lookupCipher(id CSCipherAlg) (c Cipher, ok bool) {
+	cipherMu.RLock()
+	c, ok = cipherRegistry[id]
+	cipherMu.RUnlock()
+	return
+}
+
+// registeredCiphers returns all registered Ciphers in ID order.
+func registeredCiphers() (cs []Cipher) {
+	cipherMu.RLock()
+	for _, c := range cipherRegistry {
+		cs = append(cs, c)
+	}
+	cipherMu.RUnlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID() < cs[j].ID() })
+	return
+}
+
+// builtinStream is a StreamCipher implemented by a constructor func.
+type builtinStream struct {
+	id                         CSCipherAlg
+	name                       string
+	keySize, ivSize, blockSize int
+	new                        func(key, iv []byte) (cipher.Stream, error)
+}
+
+func (c *builtinStream) ID() CSCipherAlg { return c.id }
+func (c *builtinStream) Name() string    { return c.name }
+func (c *builtinStream) KeySize() int    { return c.keySize }
+func (c *builtinStream) IVSize() int     { return c.ivSize }
+func (c *builtinStream) BlockSize() int  { return c.blockSize }
+
+func (c *builtinStream) NewStream(key, iv []byte) (cipher.Stream, error) {
+	return c.new(key, iv)
+}
+
+// builtinAEAD is an AEADCipher implemented by a constructor func.
+type builtinAEAD struct {
+	id      CSCipherAlg
+	name    string
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+}
+
+func (c *builtinAEAD) ID() CSCipherAlg { return c.id }
+func (c *builtinAEAD) Name() string    { return c.name }
+func (c *builtinAEAD) KeySize() int    { return c.keySize }
+
+func (c *builtinAEAD) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return c.new(key)
+}
+
+func newAES256OFB(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewOFB(block, iv), nil
+}
+
+func newTwofish128OFB(key, iv []byte) (cipher.Stream, error) {
+	block, err := twofish.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewOFB(block, iv), nil
+}
+
+func newBlowfish64OFB(key, iv []byte) (cipher.Stream, error) {
+	block, err := blowfish.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// N.b. x/cipher/blowfish will segfault in cipher.NewOFB()
+	// if len(iv) is not exactly blowfish.BlockSize.
+	return cipher.NewOFB(block, iv), nil
+}
+
+// newCryptMT1 seeds CryptMT, which takes no IV, with key followed by
+// iv, so that streams with the same key but different IVs (eg., the
+// two directions of a session) do not share a keystream.
+func newCryptMT1(key, iv []byte) (cipher.Stream, error) {
+	seed := make([]byte, 0, len(key)+len(iv))
+	seed = append(append(seed, key...), iv...)
+	return cryptmt.New(nil, nil, seed), nil
+}
+
+func newChaCha20_12(key, iv []byte) (cipher.Stream, error) {
+	return chacha.NewCipher(iv, key, 12)
+}
+
+func newAES256GCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func init() {
+	for _, c := range []Cipher{
+		&builtinStream{CAlgAES256, "C_AES_256", 32, aes.BlockSize, aes.BlockSize, newAES256OFB},
+		&builtinStream{CAlgTwofish128, "C_TWOFISH_128", 16, twofish.BlockSize, twofish.BlockSize, newTwofish128OFB},
+		&builtinStream{CAlgBlowfish64, "C_BLOWFISH_64", 16, blowfish.BlockSize, blowfish.BlockSize, newBlowfish64OFB},
+		&builtinStream{CAlgCryptMT1, "C_CRYPTMT1", 64, 16, 0, newCryptMT1},
+		&builtinStream{CAlgChaCha20_12, "C_CHACHA20_12", chacha.KeySize, chacha.INonceSize, 0, newChaCha20_12},
+		&builtinAEAD{CAlgAES256GCM, "C_AES_256_GCM", 32, newAES256GCM},
+		&builtinAEAD{CAlgChaCha20Poly1305, "C_CHACHA20_POLY1305", chacha20poly1305.KeySize, chacha20poly1305.New},
+	} {
+		if err := RegisterCipher(c); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package xsnet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func _unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Known-answer tests for the built-in stream ciphers (with the
+// registered key and IV sizes).
+func TestStreamCipherKAT(t *testing.T) {
+	for _, v := range []struct {
+		alg               CSCipherAlg
+		key, iv, pt, want string
+	}{
+		// NIST SP 800-38A F.4.5 (OFB-AES256.Encrypt), block #1
+		{CAlgAES256,
+			"603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4",
+			"000102030405060708090a0b0c0d0e0f",
+			"6bc1bee22e409f96e93d7e117393172a",
+			"dc7e84bfda79164b7ecd8486985d3860"},
+		// With a zero IV the first OFB block is the ECB encryption of
+		// zero: Twofish paper (Schneier et al.) 128-bit key I=1
+		{CAlgTwofish128,
+			"00000000000000000000000000000000",
+			"00000000000000000000000000000000",
+			"00000000000000000000000000000000",
+			"9f589f5cf6122c32b6bfec2f2ae8c35a"},
+		// Blowfish (Schneier) all-zero key and plaintext
+		{CAlgBlowfish64,
+			"00000000000000000000000000000000",
+			"0000000000000000",
+			"0000000000000000",
+			"4ef997456198dd78"},
+		// draft-strombergson-chacha-test-vectors TC1, 256-bit key, 12
+		// rounds (with a zero nonce and counter the RFC 7539 nonce
+		// layout makes no difference)
+		{CAlgChaCha20_12,
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"000000000000000000000000",
+			"00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000",
+			"9bf49a6a0755f953811fce125f2683d50429c3bb49e074147e0089a52eae155f0564f879d27ae3c02ce82834acfa8c793a629f2ca0de6919610be82f411326be"},
+	} {
+		c, ok := lookupCipher(v.alg)
+		if !ok {
+			t.Fatalf("cipher %d not registered", v.alg)
+		}
+		sc := c.(StreamCipher)
+		key, iv := _unhex(t, v.key), _unhex(t, v.iv)
+		if len(key) != sc.KeySize() || len(iv) != sc.IVSize() {
+			t.Fatalf("%s: key/iv sizes %d/%d, want %d/%d", sc.Name(), len(key), len(iv), sc.KeySize(), sc.IVSize())
+		}
+		s, err := sc.NewStream(key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt := _unhex(t, v.pt)
+		ct := make([]byte, len(pt))
+		s.XORKeyStream(ct, pt)
+		if want := _unhex(t, v.want); !bytes.Equal(ct, want) {
+			t.Fatalf("%s: got %x, want %x", sc.Name(), ct, want)
+		}
+	}
+}
+
+// Known-answer tests for the built-in AEAD ciphers.
+func TestAEADCipherKAT(t *testing.T) {
+	for _, v := range []struct {
+		alg                                 CSCipherAlg
+		key, nonce, ad, pt, wantCT, wantTag string
+	}{
+		// McGrew & Viega, "The Galois/Counter Mode of Operation",
+		// test case 14
+		{CAlgAES256GCM,
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"000000000000000000000000",
+			"",
+			"00000000000000000000000000000000",
+			"cea7403d4d606b6e074ec5d3baf39d18",
+			"d0d1c8a799996bf0265b98b5d48ab919"},
+		// RFC 8439 2.8.2
+		{CAlgChaCha20Poly1305,
+			"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f",
+			"070000004041424344454647",
+			"50515253c0c1c2c3c4c5c6c7",
+			hex.EncodeToString([]byte("Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, sunscreen would be it.")),
+			"d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d6" +
+				"3dbea45e8ca9671282fafb69da92728b1a71de0a9e060b2905d6a5b67ecd3b36" +
+				"92ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc" +
+				"3ff4def08e4b7a9de576d26586cec64b6116",
+			"1ae10b594f09e26a7e902ecbd0600691"},
+	} {
+		c, ok := lookupCipher(v.alg)
+		if !ok {
+			t.Fatalf("cipher %d not registered", v.alg)
+		}
+		ac := c.(AEADCipher)
+		key := _unhex(t, v.key)
+		if len(key) != ac.KeySize() {
+			t.Fatalf("%s: key size %d, want %d", ac.Name(), len(key), ac.KeySize())
+		}
+		a, err := ac.NewAEAD(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(_unhex(t, v.wantCT), _unhex(t, v.wantTag)...)
+		if ct := a.Seal(nil, _unhex(t, v.nonce), _unhex(t, v.pt), _unhex(t, v.ad)); !bytes.Equal(ct, want) {
+			t.Fatalf("%s: got %x, want %x", ac.Name(), ct, want)
+		}
+	}
+}
+
+// CryptMT streams depend on the IV as well as the key, so the two
+// directions of a session (whose keys and IVs are expanded separately)
+// never share a keystream, even were their keys to match.
+func TestCryptMTIV(t *testing.T) {
+	c, _ := lookupCipher(CAlgCryptMT1)
+	sc := c.(StreamCipher)
+	key := bytes.Repeat([]byte{0x5a}, sc.KeySize())
+	ks := func(iv byte) []byte {
+		s, err := sc.NewStream(key, bytes.Repeat([]byte{iv}, sc.IVSize()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 64)
+		s.XORKeyStream(b, b)
+		return b
+	}
+	if sc.IVSize() == 0 {
+		t.Fatal("C_CRYPTMT1 takes no IV")
+	}
+	if !bytes.Equal(ks(1), ks(1)) {
+		t.Fatal("keystream differs for the same key and IV")
+	}
+	if bytes.Equal(ks(1), ks(2)) {
+		t.Fatal("keystream ignores the IV")
+	}
+}
+
+func TestRegisterCipherDup(t *testing.T) {
+	c, _ := lookupCipher(CAlgAES256)
+	if err := RegisterCipher(c); err == nil {
+		t.Fatal("duplicate cipher registered")
+	}
+	if _, ok := cipherAlgByName("C_AES_256"); !ok {
+		t.Fatal("C_AES_256 not found by name")
+	}
+}
@@ -0,0 +1,188 @@
+// config.go - typed connection settings for DialContext()
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// A Config gives the settings used by DialContext() to set up a
+// connection. Unlike the free-form Dial() extension strings every
+// field is typed, and a Config naming an unknown alg or transport is
+// rejected rather than silently replaced by a default.
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Config holds the settings for DialContext() and ListenConfig(). The
+// zero value (or a nil *Config) dials over TCP offering the default
+// algs.
+type Config struct {
+	// Transport is the name of the underlying network: "tcp" (the
+	// default), "tcp4", "tcp6", "unix", "kcp", "ws", "wss", "pipe"
+	// or any other registered with RegisterTransport()
+	Transport string
+	// Proxy is the URL of an HTTP CONNECT or SOCKS5 proxy, for the
+	// "tcp" and "ws" transports (empty for any given by the
+	// environment, "direct" for none; see proxy.go)
+	Proxy string
+	// KCPAlg is the KCP BlockCrypt alg, for the "kcp" transport
+	// (NewConfig() defaults to KCP_AES)
+	KCPAlg KCPAlg
+	// KCPProfile gives the KCP tuning settings (nil for those set
+	// by SetKCPProfile())
+	KCPProfile *KCPProfile
+
+	// KEx, cipher and HMAC algs offered to the server, most
+	// preferred first (nil for the defaults)
+	KEX     []KEXAlg
+	Ciphers []CSCipherAlg
+	HMACs   []CSHmacAlg
+
+	// Chaffing (see SetupChaff()); if Chaff is set chaffing is
+	// started as soon as the connection is up (see EnableChaff())
+	Chaff         bool
+	ChaffMsecsMin uint
+	ChaffMsecsMax uint
+	ChaffBytesMax uint
+
+	// HostKeyCallback decides whether the server's host key is
+	// trusted (nil for the one set by SetHostKeyCallback()); with
+	// neither, every server is refused
+	HostKeyCallback HostKeyCallback
+	// HostKey is the listener's own host key, with which it signs
+	// each client's KEx (see LoadHostKey()); ListenConfig() requires
+	// one
+	HostKey ed25519.PrivateKey
+}
+
+// NewConfig returns a Config for the given transport from Dial()
+// extension strings, or an error naming any which are not recognised.
+//
+// Currently defined extension values
+//
+// KEx algs
+//
+// KEX_HERRADURA256 KEX_HERRADURA512 KEX_HERRADURA1024 KEX_HERRADURA2048
+//
+// KEX_KYBER512 KEX_KYBER768 KEX_KYBER1024
+//
+// KEX_NEWHOPE KEX_NEWHOPE_SIMPLE
+//
+// KEX_FRODOKEM_1344AES KEX_FRODOKEM_1344SHAKE KEX_FRODOKEM_976AES
+// KEX_FRODOKEM_976SHAKE
+//
+// KEX_X25519_KYBER768 KEX_X25519_FRODOKEM_976AES (hybrid)
+//
+// Session (symmetric) crypto
+//
+// C_AES_256 C_TWOFISH_128 C_BLOWFISH_64 C_CRYPTMT1 C_CHACHA20_12
+//
+// C_AES_256_GCM C_CHACHA20_POLY1305 (AEAD; session HMAC is not used)
+//
+// Session HMACs
+//
+// H_SHA256 H_SHA512
+//
+// KCP BlockCrypt algs (for transport "kcp")
+//
+// KCP_NONE KCP_AES KCP_BLOWFISH KCP_CAST5 KCP_SM4 KCP_SALSA20
+// KCP_SIMPLEXOR KCP_TEA KCP_3DES KCP_TWOFISH KCP_XTEA
+//
+// Each kind of alg may be given more than once, the first being the
+// most preferred.
+func NewConfig(transport string, extensions ...string) (cfg *Config, err error) {
+	cfg = &Config{Transport: transport, KCPAlg: KCP_AES}
+	for _, s := range extensions {
+		if k, ok := kexAlgByName(s); ok {
+			cfg.KEX = append(cfg.KEX, k)
+		} else if c, ok := cipherAlgByName(s); ok {
+			cfg.Ciphers = append(cfg.Ciphers, c)
+		} else if h, ok := hmacAlgByName(s); ok {
+			cfg.HMACs = append(cfg.HMACs, h)
+		} else if a, ok := kcpAlgByName(s); ok {
+			cfg.KCPAlg = a
+		} else {
+			return nil, fmt.Errorf("unknown extension %q", s)
+		}
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks that all of cfg's settings are supported.
+func (cfg *Config) validate() error {
+	if _, ok := lookupTransport(cfg.transport()); !ok {
+		return fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+	if proxied(cfg.transport()) {
+		if _, err := cfg.proxyURL(""); err != nil {
+			return err
+		}
+	}
+	if cfg.Transport == "kcp" && cfg.KCPAlg.String() == "KCP_ERR_UNK" {
+		return fmt.Errorf("invalid KCP alg %d", cfg.KCPAlg)
+	}
+	for i := range cfg.KEX {
+		if cfg.KEX[i].String() == "KEX_ERR_UNK" {
+			return fmt.Errorf("invalid KEX alg %d", cfg.KEX[i])
+		}
+	}
+	for i := range cfg.Ciphers {
+		if _, ok := lookupCipher(cfg.Ciphers[i]); !ok {
+			return fmt.Errorf("invalid cipher alg %d", cfg.Ciphers[i])
+		}
+	}
+	for i := range cfg.HMACs {
+		if _, ok := lookupMAC(cfg.HMACs[i]); !ok {
+			return fmt.Errorf("invalid HMAC alg %d", cfg.HMACs[i])
+		}
+	}
+	if cfg.ChaffMsecsMin > cfg.ChaffMsecsMax {
+		return fmt.Errorf("chaff interval min (%d) exceeds max (%d)", cfg.ChaffMsecsMin, cfg.ChaffMsecsMax)
+	}
+	if cfg.Chaff && (cfg.ChaffMsecsMin == cfg.ChaffMsecsMax || cfg.ChaffBytesMax == 0) {
+		return fmt.Errorf("chaff enabled without an interval range and max size")
+	}
+	return nil
+}
+
+// transport returns cfg's network name, as for net.Dial().
+func (cfg *Config) transport() string {
+	if cfg.Transport == "" {
+		return "tcp"
+	}
+	return cfg.Transport
+}
+
+// kcpProfile returns the KCP settings to use.
+func (cfg *Config) kcpProfile() *KCPProfile {
+	if cfg.KCPProfile != nil {
+		return cfg.KCPProfile
+	}
+	p := kcpProfile
+	return &p
+}
+
+// algPrefs returns the KEx, cipher and HMAC algs to offer the server,
+// using the defaults for any not set.
+func (cfg *Config) algPrefs() (p algPrefs) {
+	p = algPrefs{kex: cfg.KEX, ciphers: cfg.Ciphers, hmacs: cfg.HMACs}
+	if len(p.kex) == 0 {
+		p.kex = defaultKEXPrefs
+	}
+	if len(p.ciphers) == 0 {
+		p.ciphers = defaultCipherPrefs
+	}
+	if len(p.hmacs) == 0 {
+		p.hmacs = defaultHMACPrefs
+	}
+	return
+}
@@ -7,6 +7,26 @@
 // golang implementation by Russ Magee (rmagee_at_gmail.com)
 package xsnet
 
+// Protocol versions (exchanged in the hello which precedes KEx)
+//
+// ProtoVersion 1: v0.9 and later (Encrypt-then-MAC, host keys)
+const (
+	ProtoVersion    = 1 // highest version supported
+	ProtoVersionMin = 1 // lowest version supported
+)
+
+// Protocol feature bits (exchanged in the hello which precedes KEx).
+// A feature is only used if both peers advertise it.
+const (
+	FeatHostKey   = 1 << iota // server signs KEx transcript with host key
+	FeatRekey                 // session is periodically rekeyed
+	FeatRevTun                // server supports reverse tunnels
+	FeatDynTun                // server supports dynamic tunnels
+	FeatTunHost               // server dials tunnels to hosts other than itself
+	FeatTunStream             // tunnel packets carry a connection id
+	FeatTunUDP                // server supports UDP tunnels
+)
+
 // KEX algorithm values
 //
 // Specified (in string form) as the extensions parameter
@@ -33,7 +53,9 @@ const (
 	KEX_FRODOKEM_1344SHAKE
 	KEX_FRODOKEM_976AES
 	KEX_FRODOKEM_976SHAKE
-	KEX_invalid = 255
+	KEX_X25519_KYBER768        // hybrid: X25519 ECDH + KEX_KYBER768
+	KEX_X25519_FRODOKEM_976AES // hybrid: X25519 ECDH + KEX_FRODOKEM_976AES
+	KEX_invalid                = 255
 )
 
 // Sent from client to server in order to specify which
@@ -71,13 +93,37 @@ const (
 	CSOLoginTimeout
 
 	// Tunnel setup/control/status
-	CSOTunSetup     // client -> server tunnel setup request (dstport)
-	CSOTunSetupAck  // server -> client tunnel setup ack
-	CSOTunRefused   // server -> client: tunnel rport connection refused
-	CSOTunData      // packet contains tunnel data [rport:data]
+	CSOTunSetup     // client -> server tunnel (id 0) or conn setup request [lport:rport:id[:dsthost]]
+	CSOTunSetupAck  // tunnel (server -> client) or conn setup ack [lport:rport:id[:dsthost]]
+	CSOTunRefused   // tunnel rport (server -> client) or conn id refused
+	CSOTunData      // packet contains tunnel data [lport:rport:id:data]
 	CSOTunKeepAlive // client tunnel heartbeat
-	CSOTunDisconn   // server -> client: tunnel rport disconnected
-	CSOTunHangup    // client -> server: tunnel lport hung up
+	CSOTunDisconn   // server -> client: tunnel conn id disconnected (rport side)
+	CSOTunHangup    // client -> server: tunnel conn id hung up (lport side)
+
+	// Session rekeying (see rekey.go)
+	CSORekey     // packet contains rekey KEx message
+	CSORekeyDone // last packet sent under old keys
+
+	// Reverse tunnels (see revtun.go)
+	CSOTunRevSetup  // client -> server: listen on rport for client's lport
+	CSOTunRevAccept // server -> client: rport conn accepted, dial lport
+
+	// Dynamic tunnels (see dyntun.go)
+	CSOTunDynSetup    // client -> server: dial host:port for stream [id]
+	CSOTunDynSetupAck // server -> client: stream [id] connected
+	CSOTunDynRefused  // server -> client: stream [id] dial failed
+	CSOTunDynData     // packet contains stream data [id:data]
+	CSOTunDynClose    // either way: stream [id] closed
+
+	// UDP tunnels (see udptun.go)
+	CSOTunUDPSetup    // client -> server: UDP tunnel setup [lport:rport[:dsthost]]
+	CSOTunUDPSetupAck // server -> client: UDP tunnel ready, listen on lport
+	CSOTunUDPData     // either way: datagram [lport:rport:srclen:src:data]
+	CSOTunUDPRefused  // server -> client: UDP tunnel refused [lport:rport[:dsthost]]
+
+	// Tunnel stream flow control (see tunstream.go)
+	CSOTunCredit // either way: stream [id] may send [n] more data packets
 )
 
 // TunEndpoint.tunCtl control values - used to control workers for client
@@ -97,8 +143,14 @@ const (
 // Channel status Op byte type (see CSONone, ... and CSENone, ...)
 type CSOType uint32
 
-//TODO: this should be small (max unfragmented packet size?)
-const MAX_PAYLOAD_LEN = 2*1024*1024*1024 - 1
+// MAX_PAYLOAD_LEN is the largest frame payload (ciphertext, including
+// padding and any AEAD tag) accepted by Read(); frames claiming to be
+// larger are rejected before anything is allocated for them.
+const MAX_PAYLOAD_LEN = 64 * 1024
+
+// MAX_FRAG_LEN is the most data sent in one frame; WritePacket() splits
+// larger buffers into several frames.
+const MAX_FRAG_LEN = 32 * 1024
 
 // Session symmetric crypto algs
 const (
@@ -107,6 +159,8 @@ const (
 	CAlgBlowfish64 // golang.org/x/crypto/blowfish
 	CAlgCryptMT1   //cryptmt using mtwist64
 	CAlgChaCha20_12
+	CAlgAES256GCM        // AEAD; no separate HMAC
+	CAlgChaCha20Poly1305 // AEAD; golang.org/x/crypto/chacha20poly1305
 	CAlgNoneDisallowed
 )
 
@@ -122,3 +176,13 @@ const (
 
 // Available HMACs for hkex.Conn
 type CSHmacAlg uint32
+
+// Session key schedule versions, sent by the client in bits 16-23 of
+// the cipheropts during KEx. A peer using any other version is refused.
+//
+// KeySchedV1: HKDF-SHA256, with the KEx shared secret as input key
+// material and a hash of the KEx transcript as salt, expanded to
+// separate cipher keys, IVs and MAC keys for each direction.
+const (
+	KeySchedV1 = 1
+)
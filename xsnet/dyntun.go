@@ -0,0 +1,178 @@
+// dyntun.go - Dynamic tunnels: streams to any host:port dialled by the server
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Dynamic tunnels
+// --
+// Unlike the fixed lport:rport tunnels of tun.go, each dynamic tunnel
+// is a single stream to a host:port chosen per connection (eg., by the
+// SOCKS server of xs -D), identified by an id chosen by the client
+// (see tunstream.go).
+//
+// client=> [CSOTunDynSetup:id:host:port] =>remhost
+//
+// remhost dials host:port and replies
+// client<= [CSOTunDynSetupAck:id] <=remhost
+//   ... or if it can't,
+// client<= [CSOTunDynRefused:id:reason] <=remhost
+//
+// then data flows either way as [CSOTunDynData:id:data] until one side
+// closes the stream with [CSOTunDynClose:id]. All of a Conn's streams
+// are closed with it.
+// --
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"blitter.com/go/xs/logger"
+)
+
+// dynTunsAllowed says whether servers will dial hosts of their clients'
+// choosing: for dynamic tunnels, and tunnels given a host.
+var dynTunsAllowed = false
+
+// AllowDynTunnels sets whether servers dial dynamic tunnels, and fixed
+// tunnels given a host other than the server, for their (logged in)
+// clients. By default they don't: a server which does relays its users'
+// connections to any host it can reach.
+func AllowDynTunnels(allow bool) {
+	dynTunsAllowed = allow
+}
+
+// dynHdr returns the [id] header of dynamic tunnel packets.
+func dynHdr(id uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, id)
+	return b
+}
+
+// DialTunnel asks the server to connect to addr (host:port, as seen
+// from the server) and returns a stream over hc to it. If ctx is done
+// before the server replies the stream is abandoned.
+func (hc *Conn) DialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	if hc.features&FeatDynTun == 0 {
+		return nil, errors.New("server does not support dynamic tunnels")
+	}
+	if len(addr) > MAX_FRAG_LEN-2 {
+		return nil, fmt.Errorf("tunnel address too long")
+	}
+	s := &tunStream{addr: addr, dataOp: CSOTunDynData, closeOp: CSOTunDynClose}
+	if err := hc.addStream(s, dynHdr); err != nil {
+		return nil, err
+	}
+
+	logger.LogDebug(fmt.Sprintf("[Client sending CSOTunDynSetup [%d:%s]]", s.id, addr))
+	if _, err := hc.WritePacket(append(s.hdr(), addr...), CSOTunDynSetup); err != nil {
+		s.closeLocal()
+		return nil, err
+	}
+	select {
+	case err := <-s.ack:
+		if err != nil {
+			s.closeLocal()
+			return nil, err
+		}
+		return s, nil
+	case <-s.done:
+		return nil, errors.New("connection closed")
+	case <-ctx.Done():
+		_ = s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// gotDynTun handles dynamic tunnel packet p of type op.
+func (hc *Conn) gotDynTun(op byte, p []byte) {
+	if len(p) < 2 {
+		logger.LogDebug(fmt.Sprintf("[Truncated dynamic tunnel packet (type %d)]", op))
+		return
+	}
+	id := binary.BigEndian.Uint16(p[0:2])
+	s := hc.stream(id)
+
+	switch op {
+	case CSOTunDynSetup:
+		if s != nil {
+			logger.LogDebug(fmt.Sprintf("[Server] CSOTunDynSetup for open stream %d", id))
+			return
+		}
+		hc.serveDynTun(id, string(p[2:]))
+	case CSOTunDynSetupAck, CSOTunDynRefused:
+		if s == nil {
+			// Abandoned by DialTunnel()
+			if op == CSOTunDynSetupAck {
+				hc.WritePacket(p[0:2], CSOTunDynClose) // nolint: errcheck
+			}
+			return
+		}
+		var err error
+		if op == CSOTunDynRefused {
+			err = fmt.Errorf("%s: %s", s.addr, p[2:])
+		}
+		s.acked(err)
+	case CSOTunDynData:
+		if s == nil {
+			if hc.logTunActivity {
+				logger.LogDebug(fmt.Sprintf("[Data for closed tunnel stream %d]", id))
+			}
+			return
+		}
+		s.got(p[2:])
+	case CSOTunDynClose:
+		if s != nil && s.closedByPeer() {
+			logger.LogDebug(fmt.Sprintf("[Tunnel stream %d closed by peer]", id))
+		}
+	}
+}
+
+// serveDynTun dials addr for the client's dynamic tunnel stream id,
+// and relays between them.
+func (hc *Conn) serveDynTun(id uint16, addr string) {
+	refuse := func(reason string) {
+		logger.LogDebug(fmt.Sprintf("[ServerDynTun] Refusing stream %d to %s: %s", id, addr, reason))
+		hc.WritePacket(append(dynHdr(id), reason...), CSOTunDynRefused) // nolint: errcheck
+	}
+	if !hc.tunnelsEnabled() {
+		refuse("not logged in")
+		return
+	}
+	if !dynTunsAllowed {
+		refuse("dynamic tunnels disabled")
+		return
+	}
+	// Register the stream now, so data which arrives while dialling
+	// is kept (the client sends none before the ack)
+	s := &tunStream{id: id, addr: addr, dataOp: CSOTunDynData, closeOp: CSOTunDynClose}
+	if err := hc.addStream(s, dynHdr); err != nil {
+		refuse(err.Error())
+		return
+	}
+
+	go func() {
+		c, e := net.DialTimeout("tcp", addr, 10*time.Second)
+		if e != nil {
+			s.closeLocal()
+			refuse(e.Error())
+			return
+		}
+		logger.LogDebug(fmt.Sprintf("[ServerDynTun] Stream %d opened to %s", id, addr))
+		if _, e = hc.WritePacket(s.hdr(), CSOTunDynSetupAck); e != nil {
+			s.closeLocal()
+			_ = c.Close()
+			return
+		}
+		s.relay(c)
+		logger.LogDebug(fmt.Sprintf("[ServerDynTun] Stream %d to %s closed", id, addr))
+	}()
+}
@@ -0,0 +1,109 @@
+package xsnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Concurrent dynamic tunnel streams reach the hosts dialled by the
+// server, and failed dials are reported.
+func TestDialTunnel(t *testing.T) {
+	l, err := Listen("pipe", "dyntun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close() // nolint: errcheck
+		s.(*Conn).EnableTunnels()
+		_readLoop(s.(*Conn))
+	}()
+	hc, err := Dial("pipe", "dyntun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan struct{})
+	go func() {
+		_readLoop(hc)
+		close(read)
+	}()
+	defer func() { // both ends done before the next test
+		_ = hc.Close()
+		<-read
+		<-served
+	}()
+
+	AllowDynTunnels(true)
+	defer AllowDynTunnels(false)
+
+	el, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close() // nolint: errcheck
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			s, err := hc.DialTunnel(ctx, el.Addr().String())
+			if err != nil {
+				done <- err
+				return
+			}
+			defer s.Close() // nolint: errcheck
+			msg := make([]byte, 64*1024)
+			_, _ = rand.Read(msg)
+			go func() { _, _ = s.Write(msg) }()
+			got := make([]byte, len(msg))
+			if _, err = io.ReadFull(s, got); err == nil && !bytes.Equal(got, msg) {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing listens on a just-closed port
+	rl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rl.Close()
+	if _, err = hc.DialTunnel(ctx, rl.Addr().String()); err == nil {
+		t.Fatal("dial to closed port succeeded")
+	}
+
+	AllowDynTunnels(false)
+	if _, err = hc.DialTunnel(ctx, el.Addr().String()); err == nil {
+		t.Fatal("dial succeeded with dynamic tunnels disabled")
+	}
+}
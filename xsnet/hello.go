@@ -0,0 +1,147 @@
+// hello.go - protocol version and capability exchange, prior to KEx
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Before anything else the client sends a hello line stating the
+// protocol version it speaks and the features it supports:
+//
+//	XS/<version> 0x<features>
+//
+// and the server replies with its own version and features, and either
+// OK or NO followed by a human-readable reason for refusing the client:
+//
+//	XS/<version> 0x<features> OK
+//	XS/<version> 0x<features> NO <reason>
+//
+// The hello lines are part of the KEx transcript signed by the server
+// host key, so they cannot be altered by a man-in-the-middle to force
+// a downgrade.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+const maxHelloLen = 256
+
+// Features supported by this implementation
+const ourFeatures = FeatHostKey | FeatRekey | FeatRevTun | FeatDynTun | FeatTunHost | FeatTunStream | FeatTunUDP
+
+// Features that must be supported by the peer
+const requiredFeatures = FeatHostKey
+
+// Features returns the protocol features negotiated with the peer
+// (see FeatHostKey, ...).
+func (hc *Conn) Features() uint32 {
+	return hc.features
+}
+
+// ProtoVersion returns the protocol version negotiated with the peer.
+func (hc *Conn) ProtoVersion() uint32 {
+	return hc.protoVersion
+}
+
+// readLine reads a single '\n'-terminated line, of at most max bytes,
+// from c without reading beyond it (so the caller may continue with
+// fmt.Fscanf()).
+func readLine(c io.Reader, max int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < max {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("line too long (over %d bytes)", max)
+}
+
+func parseHello(line string) (ver, feat uint32, rest string, err error) {
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 {
+		return 0, 0, "", fmt.Errorf("malformed hello %q", line)
+	}
+	if _, err = fmt.Sscanf(f[0], "XS/%d", &ver); err != nil {
+		return 0, 0, "", fmt.Errorf("malformed hello %q", line)
+	}
+	if _, err = fmt.Sscanf(f[1], "0x%x", &feat); err != nil {
+		return 0, 0, "", fmt.Errorf("malformed hello %q", line)
+	}
+	if len(f) == 3 {
+		rest = f[2]
+	}
+	return
+}
+
+// clientHello sends the client hello and checks the server's reply,
+// returning the negotiated protocol version and features.
+func clientHello(c io.ReadWriter) (ver, feat uint32, err error) {
+	fmt.Fprintf(c, "XS/%d 0x%x\n", ProtoVersion, ourFeatures)
+
+	line, err := readLine(c, maxHelloLen)
+	if err != nil {
+		return 0, 0, err
+	}
+	ver, feat, rest, err := parseHello(line)
+	if err != nil {
+		return 0, 0, err
+	}
+	if strings.HasPrefix(rest, "NO") {
+		return 0, 0, fmt.Errorf("server refused connection: %s", strings.TrimSpace(strings.TrimPrefix(rest, "NO")))
+	}
+	if rest != "OK" {
+		return 0, 0, fmt.Errorf("malformed hello %q", line)
+	}
+	if ver < ProtoVersionMin || ver > ProtoVersion {
+		return 0, 0, fmt.Errorf("server protocol version %d not supported (need %d..%d)", ver, ProtoVersionMin, ProtoVersion)
+	}
+	if feat&requiredFeatures != requiredFeatures {
+		return 0, 0, fmt.Errorf("server lacks required features (0x%x)", requiredFeatures&^feat)
+	}
+	log.Printf("[Server protocol XS/%d, features 0x%x]\n", ver, feat)
+	return ver, feat & ourFeatures, nil
+}
+
+// serverHello reads the client hello and replies, refusing clients
+// which do not speak a compatible protocol version or lack a
+// required feature. It returns the negotiated version and features.
+func serverHello(c io.ReadWriter) (ver, feat uint32, err error) {
+	line, err := readLine(c, maxHelloLen)
+	if err != nil {
+		return 0, 0, err
+	}
+	ver, feat, _, err = parseHello(line)
+	if err != nil {
+		// Most likely a pre-hello (< v0.9) client, which starts with
+		// its KEx alg
+		err = errors.New("client protocol version too old (no hello)")
+	} else if ver < ProtoVersionMin {
+		err = fmt.Errorf("client protocol version %d not supported (need %d..%d)", ver, ProtoVersionMin, ProtoVersion)
+	} else if feat&requiredFeatures != requiredFeatures {
+		err = fmt.Errorf("client lacks required features (0x%x)", requiredFeatures&^feat)
+	}
+	if err != nil {
+		fmt.Fprintf(c, "XS/%d 0x%x NO %s\n", ProtoVersion, ourFeatures, err)
+		return 0, 0, err
+	}
+
+	// Client may be newer; we speak our own version
+	if ver > ProtoVersion {
+		ver = ProtoVersion
+	}
+	fmt.Fprintf(c, "XS/%d 0x%x OK\n", ver, ourFeatures)
+	log.Printf("[Client protocol XS/%d, features 0x%x]\n", ver, feat)
+	return ver, feat & ourFeatures, nil
+}
@@ -0,0 +1,118 @@
+package xsnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// _serverHello runs serverHello() over a pipe, the client end of which
+// is returned.
+func _serverHello() (c net.Conn, done chan error) {
+	c, s := net.Pipe()
+	done = make(chan error, 1)
+	go func() {
+		defer s.Close() // nolint: errcheck
+		_, _, err := serverHello(s)
+		done <- err
+	}()
+	return c, done
+}
+
+func TestHelloAccepted(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close() // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	type result struct {
+		ver, feat uint32
+		err       error
+	}
+	srv := make(chan result, 1)
+	go func() {
+		ver, feat, err := serverHello(s)
+		srv <- result{ver, feat, err}
+	}()
+	ver, feat, err := clientHello(c)
+	if err != nil || ver != ProtoVersion || feat != ourFeatures {
+		t.Fatalf("client: XS/%d 0x%x, %v", ver, feat, err)
+	}
+	if r := <-srv; r.err != nil || r.ver != ProtoVersion || r.feat != ourFeatures {
+		t.Fatalf("server: XS/%d 0x%x, %v", r.ver, r.feat, r.err)
+	}
+
+	// A newer client is answered with our version
+	c, done := _serverHello()
+	defer c.Close() // nolint: errcheck
+	fmt.Fprintf(c, "XS/%d 0x%x\n", ProtoVersion+1, ourFeatures)
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	if want := fmt.Sprintf("XS/%d 0x%x OK\n", ProtoVersion, ourFeatures); line != want {
+		t.Fatalf("newer client: got %q, want %q", line, want)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHelloRefusedVersion(t *testing.T) {
+	// Server refuses an older client ...
+	c, done := _serverHello()
+	defer c.Close() // nolint: errcheck
+	fmt.Fprintf(c, "XS/%d 0x%x\n", ProtoVersionMin-1, ourFeatures)
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	if !strings.Contains(line, " NO client protocol version") {
+		t.Fatalf("older client: got %q", line)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("older client accepted")
+	}
+
+	// ... and client refuses an unsupported server
+	for _, reply := range []string{
+		fmt.Sprintf("XS/%d 0x%x OK\n", ProtoVersionMin-1, ourFeatures),
+		fmt.Sprintf("XS/%d 0x%x OK\n", ProtoVersion+1, ourFeatures),
+		fmt.Sprintf("XS/%d 0x%x NO go away\n", ProtoVersion, ourFeatures),
+	} {
+		c, s := net.Pipe()
+		go func() {
+			defer s.Close() // nolint: errcheck
+			_, _ = bufio.NewReader(s).ReadString('\n')
+			_, _ = io.WriteString(s, reply)
+		}()
+		if _, _, err := clientHello(c); err == nil {
+			t.Fatalf("server reply %q accepted", reply)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestHelloMalformed(t *testing.T) {
+	for _, hello := range []string{
+		"SSH-2.0-OpenSSH_8.0\n",
+		"XS/1\n",
+		"XS/one 0x1\n",
+		"XS/1 features\n",
+		"01\n", // a pre-hello client's KEx alg
+	} {
+		c, done := _serverHello()
+		go func() { _, _ = io.Copy(ioutil.Discard, c) }()
+		_, _ = io.WriteString(c, hello)
+		if err := <-done; err == nil {
+			t.Fatalf("malformed hello %q accepted", hello)
+		}
+		_ = c.Close()
+	}
+}
+
+func TestHelloTooLong(t *testing.T) {
+	c, done := _serverHello()
+	defer c.Close() // nolint: errcheck
+	go func() { _, _ = io.Copy(ioutil.Discard, c) }()
+	go func() { _, _ = io.WriteString(c, "XS/1 0x1 "+strings.Repeat("x", maxHelloLen)+"\n") }()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatal("over-long hello: got", err)
+	}
+}
@@ -0,0 +1,231 @@
+// hostkey.go - server host keys and client known-hosts verification
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// The KEx algorithms alone only give an anonymous secure channel:
+// nothing stops a man-in-the-middle from completing one exchange with
+// the client and another with the server. To prevent this the server
+// holds a long-term (ed25519) host key and, at the end of Accept(),
+// signs a digest of the exact bytes exchanged during KEx. The client
+// checks the signature and then asks a HostKeyCallback (normally backed
+// by a known_hosts file) whether it trusts the key for that server.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const hostKeyType = "xs-ed25519"
+
+// HostKeyCallback is called by Dial() after the server has proven it
+// holds the private half of key. Returning a non-nil error aborts the
+// connection.
+type HostKeyCallback func(hostport string, key ed25519.PublicKey) error
+
+var (
+	// ErrHostKeyUnknown is returned by a KnownHostsCallback when the
+	// server is not yet in the known hosts file and the user did not
+	// choose to add it.
+	ErrHostKeyUnknown = errors.New("host key is not known for this server")
+
+	// ErrHostKeyMismatch is returned by a KnownHostsCallback when the
+	// server presents a key different from the one recorded for it.
+	ErrHostKeyMismatch = errors.New("HOST KEY MISMATCH - possible man-in-the-middle attack")
+
+	// ErrNoHostKeyCallback is returned by Dial() when there is no
+	// HostKeyCallback to check the server's host key with.
+	ErrNoHostKeyCallback = errors.New("no HostKeyCallback set, server host key cannot be checked")
+
+	hostKey   ed25519.PrivateKey // default server host key (Listen())
+	hostKeyCB HostKeyCallback    // default client host key check
+)
+
+// SetHostKey sets the host key given to listeners by Listen(), which
+// they use to sign the KEx transcript. It does not change the keys of
+// existing listeners; ListenConfig() takes one from its Config
+// instead. See LoadHostKey().
+func SetHostKey(k ed25519.PrivateKey) {
+	hostKey = k
+}
+
+// SetHostKeyCallback sets the function used by Dial(), and by
+// DialContext() if its Config has none, to decide whether a server's
+// host key is trusted. See KnownHostsCallback().
+//
+// With no callback every server is refused (ErrNoHostKeyCallback).
+func SetHostKeyCallback(cb HostKeyCallback) {
+	hostKeyCB = cb
+}
+
+// LoadHostKey reads a host key from fname, which holds the hex-encoded
+// ed25519 seed. If the file does not exist and create is true a new
+// key is generated and saved (mode 0600).
+func LoadHostKey(fname string, create bool) (k ed25519.PrivateKey, e error) {
+	b, e := ioutil.ReadFile(fname) // nolint: gosec
+	if e == nil {
+		seed, de := hex.DecodeString(strings.TrimSpace(string(b)))
+		if de != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: malformed host key", fname)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(e) || !create {
+		return nil, e
+	}
+
+	_, k, e = ed25519.GenerateKey(nil)
+	if e != nil {
+		return nil, e
+	}
+	e = ioutil.WriteFile(fname, []byte(hex.EncodeToString(k.Seed())+"\n"), 0600)
+	if e == nil {
+		log.Printf("[Generated new host key %s]\n", fname)
+	}
+	return k, e
+}
+
+// HostKeyFingerprint returns the printable (SHA256, base64) fingerprint
+// of a host key, in the same form used by ssh.
+func HostKeyFingerprint(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// KnownHostsCallback returns a HostKeyCallback which checks server keys
+// against the known hosts file fname, with lines of the form
+//
+//	host:port xs-ed25519 <base64 key>
+//
+// If a server has no entry, ask (if non-nil) is called with its
+// fingerprint and, if it returns true, the key is appended to fname.
+// A key differing from a recorded one is always refused.
+func KnownHostsCallback(fname string, ask func(hostport, fingerprint string) bool) HostKeyCallback {
+	return func(hostport string, key ed25519.PublicKey) error {
+		f, e := os.Open(fname) // nolint: gosec
+		if e == nil {
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				fields := strings.Fields(s.Text())
+				if len(fields) < 3 || fields[0] != hostport || fields[1] != hostKeyType {
+					continue
+				}
+				known, de := base64.StdEncoding.DecodeString(fields[2])
+				_ = f.Close()
+				if de != nil || !bytes.Equal(known, key) {
+					return ErrHostKeyMismatch
+				}
+				return nil
+			}
+			_ = f.Close()
+		} else if !os.IsNotExist(e) {
+			return e
+		}
+
+		if ask == nil || !ask(hostport, HostKeyFingerprint(key)) {
+			return ErrHostKeyUnknown
+		}
+		if e = os.MkdirAll(filepath.Dir(fname), 0700); e != nil {
+			return e
+		}
+		f, e = os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) // nolint: gosec
+		if e != nil {
+			return e
+		}
+		_, e = fmt.Fprintf(f, "%s %s %s\n", hostport, hostKeyType, base64.StdEncoding.EncodeToString(key))
+		if ce := f.Close(); e == nil {
+			e = ce
+		}
+		return e
+	}
+}
+
+/*---------------------------------------------------------------------*/
+
+// kexTranscript wraps the raw net.Conn during KEx, recording all bytes
+// sent and received so both ends can compute the same digest of what
+// was actually exchanged.
+type kexTranscript struct {
+	net.Conn
+	sent bytes.Buffer
+	rcvd bytes.Buffer
+}
+
+func newKexTranscript(c net.Conn) *kexTranscript {
+	return &kexTranscript{Conn: c}
+}
+
+func (t *kexTranscript) Read(b []byte) (n int, err error) {
+	n, err = t.Conn.Read(b)
+	t.rcvd.Write(b[:n])
+	return
+}
+
+func (t *kexTranscript) Write(b []byte) (n int, err error) {
+	n, err = t.Conn.Write(b)
+	t.sent.Write(b[:n])
+	return
+}
+
+// digest returns the hash, for the given purpose, of the transcript
+// (client->server bytes, then server->client bytes) and pub.
+func (t *kexTranscript) digest(server bool, purpose string, pub []byte) []byte {
+	cs, sc := t.sent.Bytes(), t.rcvd.Bytes()
+	if server {
+		cs, sc = sc, cs
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte(purpose))
+	for _, b := range [][]byte{cs, sc, pub} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(b)))
+		_, _ = h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// signHostKey sends the server host key and its signature over the
+// KEx transcript to the client (server side, end of Accept()).
+func (t *kexTranscript) signHostKey(k ed25519.PrivateKey) (err error) {
+	pub := k.Public().(ed25519.PublicKey)
+	sig := ed25519.Sign(k, t.digest(true, "xsnet kex transcript", pub))
+	_, err = fmt.Fprintf(t.Conn, "0x%x\n0x%x\n", []byte(pub), sig)
+	return
+}
+
+// verifyHostKey reads the server host key and transcript signature
+// (client side, end of Dial()), then consults cb.
+func (t *kexTranscript) verifyHostKey(hostport string, cb HostKeyCallback) (err error) {
+	var pub, sig []byte
+	_, err = fmt.Fscanf(t.Conn, "0x%x\n0x%x\n", &pub, &sig)
+	if err != nil {
+		return err
+	}
+	if len(pub) != ed25519.PublicKeySize ||
+		!ed25519.Verify(pub, t.digest(false, "xsnet kex transcript", pub), sig) {
+		return errors.New("host key signature verification failed")
+	}
+	log.Printf("[Server host key %s]\n", HostKeyFingerprint(pub))
+	if cb == nil {
+		return ErrNoHostKeyCallback
+	}
+	return cb(hostport, pub)
+}
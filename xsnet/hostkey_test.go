@@ -0,0 +1,208 @@
+package xsnet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The other tests' listeners sign with a throwaway host key, which
+// their clients trust.
+func init() {
+	_, k, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	SetHostKey(k)
+	SetHostKeyCallback(_trustAnyHostKey)
+}
+
+func _trustAnyHostKey(hostport string, key ed25519.PublicKey) error {
+	return nil
+}
+
+func _genKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestKnownHostsCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xsnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	fname := filepath.Join(dir, ".xs", "known_hosts")
+	k1, _ := _genKey(t)
+	k2, _ := _genKey(t)
+
+	// Unknown host, refused by the user
+	cb := KnownHostsCallback(fname, func(hostport, fp string) bool { return false })
+	if err = cb("server:2000", k1); err != ErrHostKeyUnknown {
+		t.Fatalf("unknown host refused: got %v", err)
+	}
+	if _, err = os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatal("refused host written to known hosts")
+	}
+	if err = KnownHostsCallback(fname, nil)("server:2000", k1); err != ErrHostKeyUnknown {
+		t.Fatalf("unknown host with no ask func: got %v", err)
+	}
+
+	// Unknown host, accepted by the user
+	asked := 0
+	cb = KnownHostsCallback(fname, func(hostport, fp string) bool {
+		asked++
+		return hostport == "server:2000" && fp == HostKeyFingerprint(k1)
+	})
+	if err = cb("server:2000", k1); err != nil || asked != 1 {
+		t.Fatalf("unknown host accepted: got %v (asked %d)", err, asked)
+	}
+	b, err := ioutil.ReadFile(fname)
+	if err != nil || !strings.HasPrefix(string(b), "server:2000 "+hostKeyType+" ") {
+		t.Fatalf("known hosts holds %q (%v)", b, err)
+	}
+
+	// Now known, without asking again
+	if err = cb("server:2000", k1); err != nil || asked != 1 {
+		t.Fatalf("known host: got %v (asked %d)", err, asked)
+	}
+
+	// A changed key is refused, whatever the user would say
+	if err = cb("server:2000", k2); err != ErrHostKeyMismatch || asked != 1 {
+		t.Fatalf("changed host key: got %v (asked %d)", err, asked)
+	}
+	// ... but the key is only recorded for that host:port
+	if err = cb("server:2001", k2); err != ErrHostKeyUnknown {
+		t.Fatalf("other port: got %v", err)
+	}
+}
+
+// testSignedTranscript runs a toy KEx over a pipe, the server then
+// signing its transcript (altered by tamper, if non-nil) with its
+// host key, and returns the client's verifyHostKey() result with cb.
+func testSignedTranscript(t *testing.T, cb HostKeyCallback, tamper func(st *kexTranscript)) error {
+	_, priv := _genKey(t)
+	cc, sc := net.Pipe()
+	defer cc.Close() // nolint: errcheck
+	defer sc.Close() // nolint: errcheck
+	ct, st := newKexTranscript(cc), newKexTranscript(sc)
+
+	done := make(chan error, 1)
+	go func() {
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(st, b); err != nil {
+			done <- err
+			return
+		}
+		if _, err := st.Write([]byte("world")); err != nil {
+			done <- err
+			return
+		}
+		if tamper != nil {
+			tamper(st)
+		}
+		done <- st.signHostKey(priv)
+	}()
+	if _, err := ct.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ct, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	err := ct.verifyHostKey("server:2000", cb)
+	if e := <-done; e != nil {
+		t.Fatal(e)
+	}
+	return err
+}
+
+func TestHostKeySignature(t *testing.T) {
+	if err := testSignedTranscript(t, _trustAnyHostKey, nil); err != nil {
+		t.Fatal("good transcript signature refused:", err)
+	}
+
+	// With no callback to check it with, any host key is refused
+	if err := testSignedTranscript(t, nil, nil); err != ErrNoHostKeyCallback {
+		t.Fatal("host key accepted without a callback: got", err)
+	}
+
+	// Server saw (so signed) a different transcript to the client, as
+	// if a MITM altered the KEx
+	err := testSignedTranscript(t, _trustAnyHostKey, func(st *kexTranscript) { st.rcvd.WriteByte('!') })
+	if err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Fatal("bad transcript signature: got", err)
+	}
+
+	// The callback's verdict is that of the handshake
+	SetHostKeyCallback(func(hostport string, key ed25519.PublicKey) error { return ErrHostKeyMismatch })
+	defer SetHostKeyCallback(_trustAnyHostKey)
+	if err = testSignedTranscript(t, hostKeyCB, nil); err != ErrHostKeyMismatch {
+		t.Fatal("host key callback not consulted: got", err)
+	}
+
+	// ... and so of Dial()
+	l, err := Listen("pipe", "hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			_ = c.Close()
+		}
+	}()
+	if c, err := Dial("pipe", "hostkey"); err != ErrHostKeyMismatch {
+		if c != nil {
+			_ = c.Close()
+		}
+		t.Fatal("Dial() with host key refused: got", err)
+	}
+}
+
+// Each listener signs with the host key in its Config, which the
+// client's Config callback sees; one without a key is refused.
+func TestListenConfigHostKey(t *testing.T) {
+	if l, err := ListenConfig("hostkey-none", &Config{Transport: "pipe"}); err == nil {
+		_ = l.Close()
+		t.Fatal("listener without a host key allowed")
+	}
+
+	for _, addr := range []string{"hostkey-a", "hostkey-b"} {
+		pub, priv := _genKey(t)
+		l, err := ListenConfig(addr, &Config{Transport: "pipe", HostKey: priv})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close() // nolint: errcheck
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				_ = c.Close()
+			}
+		}()
+
+		var got ed25519.PublicKey
+		cfg := &Config{Transport: "pipe", HostKeyCallback: func(hostport string, key ed25519.PublicKey) error {
+			got = key
+			return nil
+		}}
+		c, err := DialContext(context.Background(), addr, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+		if !bytes.Equal(got, pub) {
+			t.Fatalf("%s: signed with the wrong host key", addr)
+		}
+	}
+}
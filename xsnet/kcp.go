@@ -1,10 +1,17 @@
 package xsnet
 
 import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
+	"os"
 
 	"blitter.com/go/xs/logger"
 	kcp "github.com/xtaci/kcp-go"
@@ -28,62 +35,94 @@ const (
 // for github.com/xtaci/kcp-go BlockCrypt alg selection
 type KCPAlg uint8
 
+var kcpAlgNames = []string{"KCP_NONE", "KCP_AES", "KCP_BLOWFISH", "KCP_CAST5",
+	"KCP_SM4", "KCP_SALSA20", "KCP_SIMPLEXOR", "KCP_TEA", "KCP_3DES",
+	"KCP_TWOFISH", "KCP_XTEA"}
+
+func (k KCPAlg) String() string {
+	if int(k) < len(kcpAlgNames) {
+		return kcpAlgNames[k]
+	}
+	return "KCP_ERR_UNK"
+}
+
+func kcpAlgByName(s string) (KCPAlg, bool) {
+	for i := range kcpAlgNames {
+		if kcpAlgNames[i] == s {
+			return KCPAlg(i), true
+		}
+	}
+	return KCP_NONE, false
+}
+
 var (
 	kcpKeyBytes  []byte = []byte("SET THIS") // symmetric crypto key for KCP (github.com/xtaci/kcp-go) if used
 	kcpSaltBytes []byte = []byte("ALSO SET THIS")
+	kcpKeySet    bool   // false while the (public) default key above is in use
 )
 
-func getKCPalgnum(extensions []string) (k KCPAlg) {
-	k = KCP_AES // default
-	var s string
-	for _, s = range extensions {
-		switch s {
-		case "KCP_NONE":
-			k = KCP_NONE
-			break //golint:ignore SA4011 out of for
-		case "KCP_AES":
-			k = KCP_AES
-			break //out of for
-		case "KCP_BLOWFISH":
-			k = KCP_BLOWFISH
-			break //out of for
-		case "KCP_CAST5":
-			k = KCP_CAST5
-			break //out of for
-		case "KCP_SM4":
-			k = KCP_SM4
-			break //out of for
-		case "KCP_SALSA20":
-			k = KCP_SALSA20
-			break //out of for
-		case "KCP_SIMPLEXOR":
-			k = KCP_SIMPLEXOR
-			break //out of for
-		case "KCP_TEA":
-			k = KCP_TEA
-			break //out of for
-		case "KCP_3DES":
-			k = KCP_3DES
-			break //out of for
-		case "KCP_TWOFISH":
-			k = KCP_TWOFISH
-			break //out of for
-		case "KCP_XTEA":
-			k = KCP_XTEA
-			break //out of for
-		}
-	}
-	logger.LogDebug(fmt.Sprintf("[KCP BlockCrypt '%s' activated]", s))
-	return
-}
+// KCPKeyMinLen is the shortest KCP pre-shared key accepted by
+// LoadKCPKey().
+const KCPKeyMinLen = 16
 
+// SetKCPKeyAndSalt sets the pre-shared key (and salt) from which the
+// KCP BlockCrypt key is derived. Both ends of a KCP connection must use
+// the same key.
+//
+// N.b. this key protects only the KCP packets themselves (which carry
+// the xsnet session, encrypted with its own negotiated keys). kcp-go
+// decrypts all packets arriving at a listener with one BlockCrypt
+// before it knows which session they belong to, so the key cannot be
+// derived from each session's KEx.
 func SetKCPKeyAndSalt(key []byte, salt []byte) {
 	kcpKeyBytes = key
 	kcpSaltBytes = salt
+	kcpKeySet = true
 }
 
-func _newKCPBlockCrypt(key []byte, extensions []string) (b kcp.BlockCrypt, e error) {
-	switch getKCPalgnum(extensions) {
+// LoadKCPKey reads a KCP pre-shared key from fname and sets it as
+// the KCP key (see SetKCPKeyAndSalt()). If create is set and fname
+// doesn't exist, a new random key is generated and saved in it (to be
+// copied to the other end).
+func LoadKCPKey(fname string, create bool) (e error) {
+	b, e := ioutil.ReadFile(fname) // nolint: gosec
+	if e == nil {
+		key := bytes.TrimSpace(b)
+		if len(key) < KCPKeyMinLen {
+			return fmt.Errorf("%s: KCP key shorter than %d bytes", fname, KCPKeyMinLen)
+		}
+		SetKCPKeyAndSalt(key, kcpSaltBytes)
+		return nil
+	}
+	if !os.IsNotExist(e) || !create {
+		return e
+	}
+
+	k := make([]byte, 32)
+	if _, e = crand.Read(k); e != nil {
+		return e
+	}
+	key := []byte(hex.EncodeToString(k))
+	e = ioutil.WriteFile(fname, append(key, '\n'), 0600)
+	if e == nil {
+		log.Printf("[Generated new KCP key %s]\n", fname)
+		SetKCPKeyAndSalt(key, kcpSaltBytes)
+	}
+	return e
+}
+
+// kcpBlockCrypt returns the KCP BlockCrypt for alg, keyed from the
+// pre-shared key.
+func kcpBlockCrypt(alg KCPAlg) (kcp.BlockCrypt, error) {
+	if !kcpKeySet {
+		log.Println("[WARNING: no KCP key set, using the built-in default]")
+	}
+	kcpKey := pbkdf2.Key(kcpKeyBytes, kcpSaltBytes, 1024, 32, sha1.New)
+	return _newKCPBlockCrypt(kcpKey, alg)
+}
+
+func _newKCPBlockCrypt(key []byte, alg KCPAlg) (b kcp.BlockCrypt, e error) {
+	switch alg {
 	case KCP_NONE:
 		return kcp.NewNoneBlockCrypt(key)
 	case KCP_AES:
@@ -110,20 +149,100 @@ func _newKCPBlockCrypt(key []byte, extensions []string) (b kcp.BlockCrypt, e err
 	return nil, errors.New("Invalid KCP BlockCrypto specified")
 }
 
-func kcpDial(ipport string, extensions []string) (c net.Conn, err error) {
-	kcpKey := pbkdf2.Key(kcpKeyBytes, kcpSaltBytes, 1024, 32, sha1.New)
-	block, be := _newKCPBlockCrypt([]byte(kcpKey), extensions)
-	_ = be
-	return kcp.DialWithOptions(ipport, block, 10, 3)
+// kcpTransport is KCP (github.com/xtaci/kcp-go) reliable UDP, using
+// the BlockCrypt alg given by Config.KCPAlg.
+type kcpTransport struct{}
+
+func (kcpTransport) Name() string { return "kcp" }
+
+func (kcpTransport) Dial(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	block, err := kcpBlockCrypt(cfg.KCPAlg)
+	if err != nil {
+		return nil, err
+	}
+	p := cfg.kcpProfile()
+	s, err := kcp.DialWithOptions(addr, block, p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	p.apply(s)
+	return s, nil
 }
 
-func kcpListen(ipport string, extensions []string) (l net.Listener, err error) {
-	kcpKey := pbkdf2.Key(kcpKeyBytes, kcpSaltBytes, 1024, 32, sha1.New)
-	block, be := _newKCPBlockCrypt([]byte(kcpKey), extensions)
-	_ = be
-	return kcp.ListenWithOptions(ipport, block, 10, 3)
+func (kcpTransport) Listen(addr string, cfg *Config) (net.Listener, error) {
+	block, err := kcpBlockCrypt(cfg.KCPAlg)
+	if err != nil {
+		return nil, err
+	}
+	logger.LogDebug(fmt.Sprintf("[KCP BlockCrypt '%s' activated]", cfg.KCPAlg))
+	p := cfg.kcpProfile()
+	l, err := kcp.ListenWithOptions(addr, block, p.DataShards, p.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{l, p}, nil
 }
 
-func (hl *HKExListener) AcceptKCP() (c net.Conn, e error) {
-	return hl.l.(*kcp.Listener).AcceptKCP()
+// kcpDialConn and kcpServeConn are as kcpTransport's Dial() and
+// Listen(), but over an existing PacketConn (eg. for tests).
+func kcpDialConn(addr net.Addr, block kcp.BlockCrypt, p *KCPProfile, conn net.PacketConn) (*kcp.UDPSession, error) {
+	s, err := kcp.NewConn2(addr, block, p.DataShards, p.ParityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	p.apply(s)
+	return s, nil
+}
+
+func kcpServeConn(block kcp.BlockCrypt, p *KCPProfile, conn net.PacketConn) (*kcpListener, error) {
+	l, err := kcp.ServeConn(block, p.DataShards, p.ParityShards, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{l, p}, nil
+}
+
+// kcpListener applies a KCP profile to each session it accepts.
+type kcpListener struct {
+	*kcp.Listener
+	p *KCPProfile
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	s, err := l.AcceptKCP()
+	if err != nil {
+		// not s: a nil *kcp.UDPSession is a non-nil net.Conn
+		return nil, err
+	}
+	return s, nil
+}
+
+func (l *kcpListener) AcceptKCP() (*kcp.UDPSession, error) {
+	s, err := l.Listener.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.p.apply(s)
+	return s, nil
+}
+
+func init() {
+	if err := RegisterTransport(kcpTransport{}); err != nil {
+		panic(err)
+	}
+}
+
+// AcceptKCP accepts a raw (not yet handshaken) KCP session from hl,
+// which must be listening on the kcp transport.
+func (hl *HKExListener) AcceptKCP() (net.Conn, error) {
+	l, ok := hl.l.(*kcpListener)
+	if !ok {
+		return nil, errors.New("not a KCP listener")
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		// not s, as in kcpListener.Accept()
+		return nil, err
+	}
+	return s, nil
 }
@@ -0,0 +1,103 @@
+package xsnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/lossyconn"
+)
+
+func TestParseKCPProfile(t *testing.T) {
+	p, err := ParseKCPProfile("bulk,mtu=1200,stream=0,parityshards=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := kcpProfiles["bulk"]
+	want.MTU, want.StreamMode, want.ParityShards = 1200, false, 4
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if p, _ = ParseKCPProfile(""); p != kcpProfiles["default"] {
+		t.Fatalf("empty profile: got %+v", p)
+	}
+	for _, s := range []string{"warp", "mtu=big", "mtu=-1", "colour=red", "mtu=1200,fast"} {
+		if _, err = ParseKCPProfile(s); err == nil {
+			t.Fatalf("%q accepted", s)
+		}
+	}
+}
+
+// Data sent over KCP with each profile arrives intact despite packet
+// loss and delay.
+func TestKCPProfilesLossy(t *testing.T) {
+	for _, name := range []string{"default", "normal", "fast", "bulk"} {
+		t.Run(name, func(t *testing.T) {
+			p := kcpProfiles[name]
+			testKCPLossy(t, &p)
+		})
+	}
+}
+
+// AcceptKCP on another transport's listener fails, returning no conn.
+func TestAcceptKCPNotKCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	hl := &HKExListener{l: l, proto: "tcp4"}
+	if c, err := hl.AcceptKCP(); err == nil || c != nil {
+		t.Fatal("AcceptKCP on a TCP listener:", c, err)
+	}
+}
+
+func testKCPLossy(t *testing.T, p *KCPProfile) {
+	block, err := kcpBlockCrypt(KCP_AES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvConn, err := lossyconn.NewLossyConn(0.2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliConn, err := lossyconn.NewLossyConn(0.2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := kcpServeConn(block, p, srvConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()      // nolint: errcheck
+		_, _ = io.Copy(s, s) // echo
+	}()
+
+	s, err := kcpDialConn(srvConn.LocalAddr(), block, p, cliConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() // nolint: errcheck
+
+	msg := make([]byte, 256*1024)
+	_, _ = rand.Read(msg)
+	go func() { _, _ = s.Write(msg) }()
+	_ = s.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data corrupted")
+	}
+}
@@ -0,0 +1,151 @@
+// kcpprofile.go - KCP tuning and FEC settings
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// A KCPProfile gives the KCP protocol settings applied to each KCP
+// session, on both the client and server side. There are a few named
+// profiles to start from, whose settings may then be overridden, eg.
+//
+//   bulk,mtu=1200,parityshards=4
+//
+// The settings are those of kcp-go (and kcptun, whose profiles these
+// follow): see go doc github.com/xtaci/kcp-go UDPSession.
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// KCPProfile holds KCP tuning and forward error correction (FEC)
+// settings. Zero values (or false) leave kcp-go's defaults, except
+// for the FEC shards.
+type KCPProfile struct {
+	// See kcp.(*UDPSession).SetNoDelay(); applied if Interval is set
+	NoDelay      int // 1: faster retransmission
+	Interval     int // internal update interval (ms)
+	Resend       int // fast resend after this many skipped ACKs (0: off)
+	NoCongestion int // 1: no congestion control
+
+	SndWnd, RcvWnd int  // window sizes (packets)
+	MTU            int  // max packet size (bytes)
+	StreamMode     bool // merge writes into full packets
+	ACKNoDelay     bool // send ACKs immediately
+
+	// Reed-Solomon FEC; these must be the same at both ends (0, 0
+	// for no FEC)
+	DataShards, ParityShards int
+}
+
+// Named KCP profiles. "default" (kcp-go defaults, with FEC) is used
+// unless another is set with SetKCPProfile() or Config.KCPProfile.
+var kcpProfiles = map[string]KCPProfile{
+	"default": {DataShards: 10, ParityShards: 3},
+	"normal": {NoDelay: 0, Interval: 40, Resend: 2, NoCongestion: 1,
+		SndWnd: 128, RcvWnd: 512, MTU: 1350, StreamMode: true,
+		DataShards: 10, ParityShards: 3},
+	"fast": {NoDelay: 1, Interval: 10, Resend: 2, NoCongestion: 1,
+		SndWnd: 128, RcvWnd: 512, MTU: 1350, StreamMode: true, ACKNoDelay: true,
+		DataShards: 10, ParityShards: 3},
+	"bulk": {NoDelay: 0, Interval: 40, Resend: 2, NoCongestion: 1,
+		SndWnd: 1024, RcvWnd: 1024, MTU: 1350, StreamMode: true,
+		DataShards: 10, ParityShards: 3},
+}
+
+var kcpProfile = kcpProfiles["default"]
+
+// KCPProfileNames returns the names of the predefined KCP profiles.
+func KCPProfileNames() (names []string) {
+	for n := range kcpProfiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return
+}
+
+// SetKCPProfile sets the KCP profile used by KCP connections whose
+// Config doesn't give one (including those of Listen()).
+func SetKCPProfile(p KCPProfile) {
+	kcpProfile = p
+}
+
+// ParseKCPProfile returns the KCP profile given by s: a comma-separated
+// list of an optional profile name (default "default") followed by any
+// overrides, each setting=value, of
+//
+//	nodelay interval resend nc sndwnd rcvwnd mtu stream acknodelay
+//	datashards parityshards
+//
+// (stream and acknodelay taking 0 or 1).
+func ParseKCPProfile(s string) (p KCPProfile, err error) {
+	p = kcpProfiles["default"]
+	for i, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) == 1 {
+			np, ok := kcpProfiles[f]
+			if !ok || i > 0 {
+				return p, fmt.Errorf("KCP profile: unknown profile %q", f)
+			}
+			p = np
+			continue
+		}
+		v, err := strconv.Atoi(kv[1])
+		if err != nil || v < 0 {
+			return p, fmt.Errorf("KCP profile: bad value for %s: %q", kv[0], kv[1])
+		}
+		switch kv[0] {
+		case "nodelay":
+			p.NoDelay = v
+		case "interval":
+			p.Interval = v
+		case "resend":
+			p.Resend = v
+		case "nc":
+			p.NoCongestion = v
+		case "sndwnd":
+			p.SndWnd = v
+		case "rcvwnd":
+			p.RcvWnd = v
+		case "mtu":
+			p.MTU = v
+		case "stream":
+			p.StreamMode = v != 0
+		case "acknodelay":
+			p.ACKNoDelay = v != 0
+		case "datashards":
+			p.DataShards = v
+		case "parityshards":
+			p.ParityShards = v
+		default:
+			return p, fmt.Errorf("KCP profile: unknown setting %q", kv[0])
+		}
+	}
+	return p, nil
+}
+
+// apply sets p's tuning settings on KCP session s. (The FEC shards are
+// set when s is created.)
+func (p *KCPProfile) apply(s *kcp.UDPSession) {
+	if p.Interval > 0 {
+		s.SetNoDelay(p.NoDelay, p.Interval, p.Resend, p.NoCongestion)
+	}
+	s.SetWindowSize(p.SndWnd, p.RcvWnd)
+	if p.MTU > 0 {
+		s.SetMtu(p.MTU)
+	}
+	s.SetStreamMode(p.StreamMode)
+	s.SetACKNoDelay(p.ACKNoDelay)
+}
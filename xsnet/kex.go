@@ -0,0 +1,131 @@
+// kex.go - registry of key exchange (KEx/KEM) algs
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Each KEx alg is a KEX registered by its ID (the KEXAlg value sent
+// in alg negotiation) and Name (as used in Dial() extensions, Config
+// and xsd's allowed-alg lists). The built-in Herradura, Kyber, NewHope,
+// FrodoKEM and hybrid algs are registered below; other packages may
+// add their own with RegisterKEX(), using an otherwise unused ID.
+//
+// A KEX performs its exchange over the raw connection before the
+// session is encrypted (or, on rekeying, inside CSORekey packets) and
+// returns the shared secret, from which the session keys are derived.
+// It exchanges nothing else: the conn's cipher and session opts (see
+// (*Conn).ConnOpts() and Opts()) are sent around it by xsnet.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// KEX is a key exchange (or KEM) alg.
+type KEX interface {
+	// ID is the alg's value in alg negotiation
+	ID() KEXAlg
+	// Name is the alg's name, eg. "KEX_KYBER768"
+	Name() string
+	// DialSetup performs the client side of the KEx over c for
+	// conn hc, returning the shared secret
+	DialSetup(c io.ReadWriter, hc *Conn) (secret []byte, err error)
+	// AcceptSetup performs the server side of the KEx over c for
+	// conn hc, returning the shared secret
+	AcceptSetup(c io.ReadWriter, hc *Conn) (secret []byte, err error)
+}
+
+var (
+	kexMu       sync.RWMutex
+	kexRegistry = make(map[KEXAlg]KEX)
+)
+
+// RegisterKEX adds k to the KEx algs xsnet may negotiate. It is an
+// error if k's ID or Name is already registered, or its ID is
+// KEX_invalid.
+func RegisterKEX(k KEX) error {
+	kexMu.Lock()
+	defer kexMu.Unlock()
+	if k.ID() == KEX_invalid {
+		return fmt.Errorf("KEx alg %s: invalid ID %d", k.Name(), k.ID())
+	}
+	if o, ok := kexRegistry[k.ID()]; ok {
+		return fmt.Errorf("KEx alg %s: ID %d already registered for %s", k.Name(), k.ID(), o.Name())
+	}
+	for _, o := range kexRegistry {
+		if o.Name() == k.Name() {
+			return fmt.Errorf("KEx alg %s already registered (ID %d)", k.Name(), o.ID())
+		}
+	}
+	kexRegistry[k.ID()] = k
+	return nil
+}
+
+// lookupKEX returns the registered KEX with the given ID.
+func lookupKEX(id KEXAlg) (k KEX, ok bool) {
+	kexMu.RLock()
+	k, ok = kexRegistry[id]
+	kexMu.RUnlock()
+	return
+}
+
+// registeredKEX returns all registered KEXs in ID order.
+func registeredKEX() (ks []KEX) {
+	kexMu.RLock()
+	for _, k := range kexRegistry {
+		ks = append(ks, k)
+	}
+	kexMu.RUnlock()
+	sort.Slice(ks, func(i, j int) bool { return ks[i].ID() < ks[j].ID() })
+	return
+}
+
+// builtinKEX is a KEX implemented by a pair of setup funcs (which
+// look at hc.kex for the alg's parameters).
+type builtinKEX struct {
+	id     KEXAlg
+	name   string
+	dial   func(c io.ReadWriter, hc *Conn) ([]byte, error)
+	accept func(c io.ReadWriter, hc *Conn) ([]byte, error)
+}
+
+func (k *builtinKEX) ID() KEXAlg   { return k.id }
+func (k *builtinKEX) Name() string { return k.name }
+
+func (k *builtinKEX) DialSetup(c io.ReadWriter, hc *Conn) ([]byte, error) {
+	return k.dial(c, hc)
+}
+
+func (k *builtinKEX) AcceptSetup(c io.ReadWriter, hc *Conn) ([]byte, error) {
+	return k.accept(c, hc)
+}
+
+func init() {
+	for _, k := range []*builtinKEX{
+		{KEX_HERRADURA256, "KEX_HERRADURA256", hkexDialSecret, hkexAcceptSecret},
+		{KEX_HERRADURA512, "KEX_HERRADURA512", hkexDialSecret, hkexAcceptSecret},
+		{KEX_HERRADURA1024, "KEX_HERRADURA1024", hkexDialSecret, hkexAcceptSecret},
+		{KEX_HERRADURA2048, "KEX_HERRADURA2048", hkexDialSecret, hkexAcceptSecret},
+		{KEX_KYBER512, "KEX_KYBER512", kyberDialSecret, kyberAcceptSecret},
+		{KEX_KYBER768, "KEX_KYBER768", kyberDialSecret, kyberAcceptSecret},
+		{KEX_KYBER1024, "KEX_KYBER1024", kyberDialSecret, kyberAcceptSecret},
+		{KEX_NEWHOPE, "KEX_NEWHOPE", newHopeDialSecret, newHopeAcceptSecret},
+		{KEX_NEWHOPE_SIMPLE, "KEX_NEWHOPE_SIMPLE", newHopeSimpleDialSecret, newHopeSimpleAcceptSecret},
+		{KEX_FRODOKEM_1344AES, "KEX_FRODOKEM_1344AES", frodoKEMDialSecret, frodoKEMAcceptSecret},
+		{KEX_FRODOKEM_1344SHAKE, "KEX_FRODOKEM_1344SHAKE", frodoKEMDialSecret, frodoKEMAcceptSecret},
+		{KEX_FRODOKEM_976AES, "KEX_FRODOKEM_976AES", frodoKEMDialSecret, frodoKEMAcceptSecret},
+		{KEX_FRODOKEM_976SHAKE, "KEX_FRODOKEM_976SHAKE", frodoKEMDialSecret, frodoKEMAcceptSecret},
+		{KEX_X25519_KYBER768, "KEX_X25519_KYBER768", hybridDialSecret, hybridAcceptSecret},
+		{KEX_X25519_FRODOKEM_976AES, "KEX_X25519_FRODOKEM_976AES", hybridDialSecret, hybridAcceptSecret},
+	} {
+		if err := RegisterKEX(k); err != nil {
+			panic(err)
+		}
+	}
+}
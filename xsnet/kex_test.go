@@ -0,0 +1,81 @@
+package xsnet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// toyKEX is an (insecure) KEX of the kind another package might
+// register: it knows nothing of xsnet's wire format beyond its own
+// messages.
+type toyKEX struct{}
+
+func (toyKEX) ID() KEXAlg   { return 200 }
+func (toyKEX) Name() string { return "KEX_TOY" }
+
+func (toyKEX) DialSetup(c io.ReadWriter, hc *Conn) ([]byte, error) {
+	if _, err := fmt.Fprintf(c, "toy\n"); err != nil {
+		return nil, err
+	}
+	var s string
+	if _, err := fmt.Fscanln(c, &s); err != nil {
+		return nil, err
+	}
+	return bytes.Repeat([]byte(s), 16), nil
+}
+
+func (toyKEX) AcceptSetup(c io.ReadWriter, hc *Conn) ([]byte, error) {
+	var s string
+	if _, err := fmt.Fscanln(c, &s); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c, "%s\n", s); err != nil {
+		return nil, err
+	}
+	return bytes.Repeat([]byte(s), 16), nil
+}
+
+// A registered KEX is negotiated, and sets up a working session,
+// without exchanging the conn's opts itself.
+func TestRegisterKEX(t *testing.T) {
+	if _, ok := lookupKEX(toyKEX{}.ID()); !ok { // (once, for -count)
+		if err := RegisterKEX(toyKEX{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if RegisterKEX(toyKEX{}) == nil {
+		t.Fatal("KEx alg registered twice")
+	}
+
+	l, err := Listen("pipe", "toykex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()      // nolint: errcheck
+		_, _ = io.Copy(c, c) // echo
+	}()
+
+	c, err := Dial("pipe", "toykex", "KEX_TOY", "C_AES_256", "H_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() // nolint: errcheck
+	if k := c.KEX(); k != 200 {
+		t.Fatal("negotiated", k.String())
+	}
+	if _, err = c.Write([]byte("hello, toy")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len("hello, toy"))
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello, toy" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
@@ -0,0 +1,110 @@
+// mac.go - registry of session packet MAC algs
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Each session MAC is a MAC registered by its ID (the value carried in
+// bits 8-15 of the conn's cipheropts) and Name (as used in Dial()
+// extensions, Config and xsd's allowed-alg lists). It authenticates
+// each packet sent with a StreamCipher (see cipher.go); the first
+// HMAC_CHK_SZ bytes of its sum are sent. Other packages may add their
+// own with RegisterMAC(), using an otherwise unused ID.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+)
+
+// MAC is a session packet MAC alg.
+type MAC interface {
+	// ID is the alg's value in alg negotiation (0-255)
+	ID() CSHmacAlg
+	// Name is the alg's name, eg. "H_SHA256"
+	Name() string
+	// KeySize is the length of key wanted, in bytes
+	KeySize() int
+	// New returns a MAC keyed with key. Its Size() must be at
+	// least HMAC_CHK_SZ.
+	New(key []byte) hash.Hash
+}
+
+var (
+	macMu       sync.RWMutex
+	macRegistry = make(map[CSHmacAlg]MAC)
+)
+
+// RegisterMAC adds m to the session MACs xsnet may negotiate. It is an
+// error if m's ID or Name is already registered.
+func RegisterMAC(m MAC) error {
+	macMu.Lock()
+	defer macMu.Unlock()
+	if m.ID() > 0xFF {
+		return fmt.Errorf("MAC alg %s: invalid ID %d", m.Name(), m.ID())
+	}
+	if o, ok := macRegistry[m.ID()]; ok {
+		return fmt.Errorf("MAC alg %s: ID %d already registered for %s", m.Name(), m.ID(), o.Name())
+	}
+	for _, o := range macRegistry {
+		if o.Name() == m.Name() {
+			return fmt.Errorf("MAC alg %s already registered (ID %d)", m.Name(), o.ID())
+		}
+	}
+	macRegistry[m.ID()] = m
+	return nil
+}
+
+// lookupMAC returns the registered MAC with the given ID.
+func lookupMAC(id CSHmacAlg) (m MAC, ok bool) {
+	macMu.RLock()
+	m, ok = macRegistry[id]
+	macMu.RUnlock()
+	return
+}
+
+// registeredMACs returns all registered MACs in ID order.
+func registeredMACs() (ms []MAC) {
+	macMu.RLock()
+	for _, m := range macRegistry {
+		ms = append(ms, m)
+	}
+	macMu.RUnlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID() < ms[j].ID() })
+	return
+}
+
+// builtinHMAC is an HMAC over one of the standard library hashes.
+type builtinHMAC struct {
+	id   CSHmacAlg
+	name string
+	h    func() hash.Hash
+	size int
+}
+
+func (m *builtinHMAC) ID() CSHmacAlg { return m.id }
+func (m *builtinHMAC) Name() string  { return m.name }
+func (m *builtinHMAC) KeySize() int  { return m.size }
+
+func (m *builtinHMAC) New(key []byte) hash.Hash {
+	return hmac.New(m.h, key)
+}
+
+func init() {
+	for _, m := range []MAC{
+		&builtinHMAC{HmacSHA256, "H_SHA256", sha256.New, sha256.Size},
+		&builtinHMAC{HmacSHA512, "H_SHA512", sha512.New, sha512.Size},
+	} {
+		if err := RegisterMAC(m); err != nil {
+			panic(err)
+		}
+	}
+}
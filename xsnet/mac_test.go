@@ -0,0 +1,31 @@
+package xsnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Known-answer tests for the built-in MACs: RFC 4231 test case 2.
+func TestMACKAT(t *testing.T) {
+	for _, v := range []struct {
+		alg  CSHmacAlg
+		want string
+	}{
+		{HmacSHA256, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{HmacSHA512, "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea250554" +
+			"9758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737"},
+	} {
+		m, ok := lookupMAC(v.alg)
+		if !ok {
+			t.Fatalf("MAC %d not registered", v.alg)
+		}
+		h := m.New([]byte("Jefe"))
+		h.Write([]byte("what do ya want for nothing?")) // nolint: errcheck
+		if got, want := h.Sum(nil), _unhex(t, v.want); !bytes.Equal(got, want) {
+			t.Fatalf("%s: got %x, want %x", m.Name(), got, want)
+		}
+		if h.Size() < HMAC_CHK_SZ {
+			t.Fatalf("%s: size %d < HMAC_CHK_SZ", m.Name(), h.Size())
+		}
+	}
+}
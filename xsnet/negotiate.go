@@ -0,0 +1,276 @@
+// negotiate.go - KEx/cipher/HMAC algorithm negotiation, prior to KEx
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// After the hello the client sends its KEx, cipher and HMAC algorithms,
+// each as a comma-separated list in order of preference:
+//
+//	ALGS <kex,...> <cipher,...> <hmac,...>
+//
+// and the server replies with the first of each which it allows
+// (see HKExListener.SetAllowedAlgs()), or refuses the client:
+//
+//	ALGS <kex> <cipher> <hmac>
+//	NO <reason>
+//
+// An AEAD cipher authenticates each packet itself, so if one is chosen
+// no HMAC is, and <hmac> is sent as "-".
+//
+// Like the hello, these lines are part of the signed KEx transcript.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// maxAlgsLen is the longest ALGS or NO line accepted.
+const maxAlgsLen = 4096
+
+// Client preferences used for any of KEx, cipher or HMAC algs not
+// set in the Config (see Config.algPrefs())
+var (
+	defaultKEXPrefs    = []KEXAlg{KEX_X25519_KYBER768, KEX_X25519_FRODOKEM_976AES, KEX_KYBER768, KEX_FRODOKEM_976AES, KEX_HERRADURA512}
+	defaultCipherPrefs = []CSCipherAlg{CAlgAES256GCM, CAlgChaCha20Poly1305, CAlgAES256, CAlgChaCha20_12}
+	defaultHMACPrefs   = []CSHmacAlg{HmacSHA256, HmacSHA512}
+)
+
+// algPrefs holds KEx, cipher and HMAC algorithm lists, for the client in
+// order of preference and for the server the allowed algs.
+type algPrefs struct {
+	kex     []KEXAlg
+	ciphers []CSCipherAlg
+	hmacs   []CSHmacAlg
+}
+
+// getAllowedAlgs returns the algs allowed by a server. As for xsd's
+// -aK, -aC and -aH options a nil list, or one containing "KEX_all",
+// "C_all" or "H_all" respectively, allows all supported algs.
+func getAllowedAlgs(kex, ciphers, hmacs []string) (p algPrefs) {
+	all := func(l []string, a string) bool {
+		if len(l) == 0 {
+			return true
+		}
+		for _, s := range l {
+			if s == a {
+				return true
+			}
+		}
+		return false
+	}
+
+	allK, allC, allH := all(kex, "KEX_all"), all(ciphers, "C_all"), all(hmacs, "H_all")
+	for _, k := range registeredKEX() {
+		if allK || all(kex, k.Name()) {
+			p.kex = append(p.kex, k.ID())
+		}
+	}
+	for _, c := range registeredCiphers() {
+		if allC || all(ciphers, c.Name()) {
+			p.ciphers = append(p.ciphers, c.ID())
+		}
+	}
+	for _, h := range registeredMACs() {
+		if allH || all(hmacs, h.Name()) {
+			p.hmacs = append(p.hmacs, h.ID())
+		}
+	}
+	return
+}
+
+func kexAlgByName(s string) (KEXAlg, bool) {
+	for _, k := range registeredKEX() {
+		if k.Name() == s {
+			return k.ID(), true
+		}
+	}
+	return KEX_invalid, false
+}
+
+func cipherAlgByName(s string) (CSCipherAlg, bool) {
+	for _, c := range registeredCiphers() {
+		if c.Name() == s {
+			return c.ID(), true
+		}
+	}
+	return CAlgNoneDisallowed, false
+}
+
+func hmacAlgByName(s string) (CSHmacAlg, bool) {
+	for _, h := range registeredMACs() {
+		if h.Name() == s {
+			return h.ID(), true
+		}
+	}
+	return HmacNoneDisallowed, false
+}
+
+// String returns the algs as sent by clientNegotiate(), eg.
+// "KEX_KYBER768,KEX_HERRADURA512 C_AES_256 H_SHA256"
+func (p algPrefs) String() string {
+	var k, c, h []string
+	for i := range p.kex {
+		k = append(k, p.kex[i].String())
+	}
+	for i := range p.ciphers {
+		c = append(c, p.ciphers[i].String())
+	}
+	for i := range p.hmacs {
+		h = append(h, p.hmacs[i].String())
+	}
+	if h == nil {
+		h = []string{"-"}
+	}
+	return strings.Join(k, ",") + " " + strings.Join(c, ",") + " " + strings.Join(h, ",")
+}
+
+// parseAlgPrefs parses the output of algPrefs.String(). Unknown
+// algs are skipped, as they may be supported by a newer peer.
+func parseAlgPrefs(s string) (p algPrefs, err error) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return p, fmt.Errorf("malformed alg list %q", s)
+	}
+	for _, n := range strings.Split(f[0], ",") {
+		if k, ok := kexAlgByName(n); ok {
+			p.kex = append(p.kex, k)
+		}
+	}
+	for _, n := range strings.Split(f[1], ",") {
+		if c, ok := cipherAlgByName(n); ok {
+			p.ciphers = append(p.ciphers, c)
+		}
+	}
+	for _, n := range strings.Split(f[2], ",") {
+		if h, ok := hmacAlgByName(n); ok {
+			p.hmacs = append(p.hmacs, h)
+		}
+	}
+	return p, nil
+}
+
+// choose returns, for each of KEx, cipher and HMAC, the first of the
+// client's preferences that is allowed by the server.
+func (p algPrefs) choose(allowed algPrefs) (c algPrefs, err error) {
+	for _, k := range p.kex {
+		for _, a := range allowed.kex {
+			if k == a && c.kex == nil {
+				c.kex = []KEXAlg{k}
+			}
+		}
+	}
+	if c.kex == nil {
+		return c, errors.New("no acceptable KEX alg offered")
+	}
+	for _, ci := range p.ciphers {
+		for _, a := range allowed.ciphers {
+			if ci == a && c.ciphers == nil {
+				c.ciphers = []CSCipherAlg{ci}
+			}
+		}
+	}
+	if c.ciphers == nil {
+		return c, errors.New("no acceptable cipher alg offered")
+	}
+	if isAEAD(c.ciphers[0]) {
+		return c, nil
+	}
+	for _, h := range p.hmacs {
+		for _, a := range allowed.hmacs {
+			if h == a && c.hmacs == nil {
+				c.hmacs = []CSHmacAlg{h}
+			}
+		}
+	}
+	if c.hmacs == nil {
+		return c, errors.New("no acceptable HMAC alg offered")
+	}
+	return c, nil
+}
+
+// cipheropts returns the cipher/hmac options value for the first
+// cipher and HMAC algs of p (HmacNoneDisallowed if it has none, as for
+// an AEAD cipher).
+func (p algPrefs) cipheropts() uint32 {
+	h := CSHmacAlg(HmacNoneDisallowed)
+	if len(p.hmacs) > 0 {
+		h = p.hmacs[0]
+	}
+	return uint32(p.ciphers[0]) | uint32(h)<<8 | KeySchedV1<<16
+}
+
+// isAEAD says whether c is an AEAD cipher, which needs no HMAC.
+func isAEAD(c CSCipherAlg) bool {
+	ci, _ := lookupCipher(c)
+	_, ok := ci.(AEADCipher)
+	return ok
+}
+
+// clientNegotiate sends the client's alg preferences, returning those
+// chosen by the server.
+func clientNegotiate(c io.ReadWriter, prefs algPrefs) (chosen algPrefs, err error) {
+	fmt.Fprintf(c, "ALGS %s\n", prefs)
+
+	line, err := readLine(c, maxAlgsLen)
+	if err != nil {
+		return chosen, err
+	}
+	if strings.HasPrefix(line, "NO ") {
+		return chosen, fmt.Errorf("server refused connection: %s", strings.TrimPrefix(line, "NO "))
+	}
+	if !strings.HasPrefix(line, "ALGS ") {
+		return chosen, fmt.Errorf("malformed alg reply %q", line)
+	}
+	chosen, err = parseAlgPrefs(strings.TrimPrefix(line, "ALGS "))
+	if err != nil {
+		return chosen, err
+	}
+	// The server must choose exactly one of each (but no HMAC for an
+	// AEAD cipher), from our lists
+	nHMACs := 1
+	if len(chosen.ciphers) == 1 && isAEAD(chosen.ciphers[0]) {
+		nHMACs = 0
+	}
+	if len(chosen.kex) != 1 || len(chosen.ciphers) != 1 || len(chosen.hmacs) != nHMACs {
+		return chosen, fmt.Errorf("malformed alg reply %q", line)
+	}
+	if _, e := chosen.choose(prefs); e != nil {
+		return chosen, fmt.Errorf("server chose an alg not offered (%s)", chosen)
+	}
+	log.Printf("[Negotiated algs: %s]\n", chosen)
+	return chosen, nil
+}
+
+// serverNegotiate reads the client's alg preferences and replies with
+// the algs chosen from those allowed, or refuses the client.
+func serverNegotiate(c io.ReadWriter, allowed algPrefs) (chosen algPrefs, err error) {
+	line, err := readLine(c, maxAlgsLen)
+	if err != nil {
+		return chosen, err
+	}
+	if !strings.HasPrefix(line, "ALGS ") {
+		err = fmt.Errorf("malformed alg list %q", line)
+	} else {
+		var prefs algPrefs
+		prefs, err = parseAlgPrefs(strings.TrimPrefix(line, "ALGS "))
+		if err == nil {
+			chosen, err = prefs.choose(allowed)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(c, "NO %s\n", err)
+		return chosen, err
+	}
+
+	fmt.Fprintf(c, "ALGS %s\n", chosen)
+	log.Printf("[Negotiated algs: %s]\n", chosen)
+	return chosen, nil
+}
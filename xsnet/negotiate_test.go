@@ -0,0 +1,91 @@
+package xsnet
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A client offering every supported alg (a line longer than a hello)
+// gets the first of its preferences that the server allows.
+func TestNegotiateLongPrefs(t *testing.T) {
+	all := getAllowedAlgs(nil, nil, nil)
+	if len(all.String()) <= maxHelloLen {
+		t.Fatalf("alg list only %d bytes", len(all.String()))
+	}
+	n := len(all.kex) - 1
+	allowed := algPrefs{kex: all.kex[n:], ciphers: all.ciphers, hmacs: all.hmacs}
+
+	c, s := net.Pipe()
+	defer c.Close() // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	served := make(chan error, 1)
+	go func() {
+		_, err := serverNegotiate(s, allowed)
+		served <- err
+	}()
+	chosen, err := clientNegotiate(c, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; err != nil {
+		t.Fatal(err)
+	}
+	if chosen.kex[0] != all.kex[n] || chosen.ciphers[0] != all.ciphers[0] || chosen.hmacs[0] != all.hmacs[0] {
+		t.Fatalf("chose %s", chosen)
+	}
+}
+
+// Alg lines longer than maxAlgsLen are refused.
+func TestNegotiateTooLong(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close() // nolint: errcheck
+	defer s.Close() // nolint: errcheck
+	go func() {
+		_, _ = c.Write([]byte("ALGS " + strings.Repeat("KEX_KYBER768,", maxAlgsLen/13) + " C_AES_256 H_SHA256\n"))
+	}()
+	go func() { _, _ = io.Copy(ioutil.Discard, c) }()
+	if _, err := serverNegotiate(s, getAllowedAlgs(nil, nil, nil)); err == nil {
+		t.Fatal("over-long alg line accepted")
+	}
+}
+
+// An AEAD cipher is chosen without an HMAC, even if the client offers
+// none the server allows; a stream cipher still needs one.
+func TestNegotiateAEAD(t *testing.T) {
+	allowed := getAllowedAlgs(nil, nil, []string{"H_SHA512"})
+	for _, tc := range []struct {
+		cipher CSCipherAlg
+		ok     bool
+	}{{CAlgAES256GCM, true}, {CAlgChaCha20Poly1305, true}, {CAlgAES256, false}} {
+		prefs := algPrefs{kex: []KEXAlg{KEX_HERRADURA512}, ciphers: []CSCipherAlg{tc.cipher},
+			hmacs: []CSHmacAlg{HmacSHA256}}
+
+		c, s := net.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			_, err := serverNegotiate(s, allowed)
+			served <- err
+		}()
+		chosen, err := clientNegotiate(c, prefs)
+		if e := <-served; (e == nil) != (err == nil) {
+			t.Fatalf("%s: server %v, client %v", tc.cipher.String(), e, err)
+		}
+		_ = c.Close()
+		_ = s.Close()
+		if !tc.ok {
+			if err == nil {
+				t.Fatalf("%s: chosen without an allowed HMAC", tc.cipher.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.cipher.String(), err)
+		}
+		if chosen.hmacs != nil || CSHmacAlg(chosen.cipheropts()>>8&0xFF) != HmacNoneDisallowed {
+			t.Fatalf("%s: HMAC chosen (%s)", tc.cipher.String(), chosen)
+		}
+	}
+}
@@ -24,12 +24,13 @@ package xsnet
 
 import (
 	"bytes"
+	"context"
 	"crypto/cipher"
+	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -38,14 +39,16 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	crand "crypto/rand"
 
 	hkex "blitter.com/go/herradurakex"
 	"blitter.com/go/kyber"
 	"blitter.com/go/newhope"
 	"blitter.com/go/xs/logger"
 	frodo "github.com/kuking/go-frodokem"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
 )
 
 /*---------------------------------------------------------------------*/
@@ -88,14 +91,25 @@ type (
 		Cols       uint16
 
 		chaff ChaffConfig
-		tuns  *map[uint16](*TunEndpoint)
-
-		closeStat *CSOType      // close status (CSOExitStatus)
-		r         cipher.Stream //read cipherStream
-		rm        hash.Hash
-		w         cipher.Stream //write cipherStream
-		wm        hash.Hash
-		dBuf      *bytes.Buffer //decrypt buffer for Read()
+		tuns  *map[uint16](*TunEndpoint) // by lport
+
+		revTuns      *map[uint16]revTun       // client: reverse tunnel ends, by rport
+		revListeners *map[uint16]net.Listener // server: reverse tunnel listeners, by rport
+		streams      *tunStreams              // connections carried by tunnels
+		udpTuns      *map[uint16]*udpTun      // UDP tunnels, by lport
+
+		closeStat *CSOType       // close status (CSOExitStatus)
+		r         *dirKeys       //read cipher/hmac
+		w         *dirKeys       //write cipher/hmac
+		dBuf      *bytes.Buffer  //decrypt buffer for Read()
+		server    bool           //true for Accept()ed conns
+		kexT      *kexTranscript //KEx traffic, during Dial()/Accept()
+		rk        *rekeyState    //rekey triggers and progress
+		authErr   *error         //set once a frame fails authentication
+
+		protoVersion uint32 // negotiated in hello (see ProtoVersion)
+		tunsEnabled  bool   // server: client may use tunnels (see EnableTunnels)
+		features     uint32 // negotiated in hello (see FeatHostKey, ...)
 	}
 )
 
@@ -103,42 +117,23 @@ var (
 	Log *logger.Writer // reg. syslog output (no -d)
 )
 
+// *Conn and *HKExListener may be used wherever a net.Conn or
+// net.Listener is expected.
+var (
+	_ net.Conn     = (*Conn)(nil)
+	_ net.Listener = (*HKExListener)(nil)
+)
+
 // Return string (suitable as map key) for a tunnel endpoint
 func (t *TunEndpoint) String() string {
-	return fmt.Sprintf("[%d:%s:%d]", t.Lport, t.Peer, t.Rport)
+	return fmt.Sprintf("[%d:%s:%d]", t.Lport, t.Host, t.Rport)
 }
 
 func (k *KEXAlg) String() string {
-	switch *k {
-	case KEX_HERRADURA256:
-		return "KEX_HERRADURA256"
-	case KEX_HERRADURA512:
-		return "KEX_HERRADURA512"
-	case KEX_HERRADURA1024:
-		return "KEX_HERRADURA1024"
-	case KEX_HERRADURA2048:
-		return "KEX_HERRADURA2048"
-	case KEX_KYBER512:
-		return "KEX_KYBER512"
-	case KEX_KYBER768:
-		return "KEX_KYBER768"
-	case KEX_KYBER1024:
-		return "KEX_KYBER1024"
-	case KEX_NEWHOPE:
-		return "KEX_NEWHOPE"
-	case KEX_NEWHOPE_SIMPLE:
-		return "KEX_NEWHOPE_SIMPLE"
-	case KEX_FRODOKEM_1344AES:
-		return "KEX_FRODOKEM_1344AES"
-	case KEX_FRODOKEM_1344SHAKE:
-		return "KEX_FRODOKEM_1344SHAKE"
-	case KEX_FRODOKEM_976AES:
-		return "KEX_FRODOKEM_976AES"
-	case KEX_FRODOKEM_976SHAKE:
-		return "KEX_FRODOKEM_976SHAKE"
-	default:
-		return "KEX_ERR_UNK"
+	if kx, ok := lookupKEX(*k); ok {
+		return kx.Name()
 	}
+	return "KEX_ERR_UNK"
 }
 
 func (hc *Conn) CAlg() CSCipherAlg {
@@ -146,20 +141,10 @@ func (hc *Conn) CAlg() CSCipherAlg {
 }
 
 func (c *CSCipherAlg) String() string {
-	switch *c & 0x0FF {
-	case CAlgAES256:
-		return "C_AES_256"
-	case CAlgTwofish128:
-		return "C_TWOFISH_128"
-	case CAlgBlowfish64:
-		return "C_BLOWFISH_64"
-	case CAlgCryptMT1:
-		return "C_CRYPTMT1"
-	case CAlgChaCha20_12:
-		return "C_CHACHA20_12"
-	default:
-		return "C_ERR_UNK"
+	if ci, ok := lookupCipher(*c & 0x0FF); ok {
+		return ci.Name()
 	}
+	return "C_ERR_UNK"
 }
 
 func (hc *Conn) HAlg() CSHmacAlg {
@@ -167,14 +152,10 @@ func (hc *Conn) HAlg() CSHmacAlg {
 }
 
 func (h *CSHmacAlg) String() string {
-	switch (*h >> 8) & 0x0FF {
-	case HmacSHA256:
-		return "H_SHA256"
-	case HmacSHA512:
-		return "C_SHA512"
-	default:
-		return "H_ERR_UNK"
+	if m, ok := lookupMAC(*h & 0x0FF); ok {
+		return m.Name()
 	}
+	return "H_ERR_UNK"
 }
 
 func _initLogging(d bool, c string, f logger.Priority) {
@@ -236,7 +217,7 @@ func (hc *Conn) SetConnOpts(copts uint32) {
 //
 // Consumers of this lib may use this for protocol-level options not part
 // of the KEx or encryption info used by the connection.
-func (hc Conn) Opts() uint32 {
+func (hc *Conn) Opts() uint32 {
 	return hc.opts
 }
 
@@ -261,42 +242,26 @@ func _new(kexAlg KEXAlg, conn *net.Conn) (hc *Conn, e error) {
 		c:         conn,
 		closeStat: new(CSOType),
 		WinCh:     make(chan WinSize, 1),
-		dBuf:      new(bytes.Buffer)}
+		dBuf:      new(bytes.Buffer),
+		rk:        newRekeyState(),
+		authErr:   new(error)}
 	tempMap := make(map[uint16]*TunEndpoint)
 	hc.tuns = &tempMap
+	revTuns := make(map[uint16]revTun)
+	hc.revTuns = &revTuns
+	revListeners := make(map[uint16]net.Listener)
+	hc.revListeners = &revListeners
+	hc.streams = newTunStreams()
+	udpTuns := make(map[uint16]*udpTun)
+	hc.udpTuns = &udpTuns
 
 	*hc.closeStat = CSEStillOpen // open or prematurely-closed status
 
 	// Set up KEx/KEM-specifics
-	switch kexAlg {
-	case KEX_HERRADURA256:
-		fallthrough
-	case KEX_HERRADURA512:
-		fallthrough
-	case KEX_HERRADURA1024:
-		fallthrough
-	case KEX_HERRADURA2048:
-		fallthrough
-	case KEX_KYBER512:
-		fallthrough
-	case KEX_KYBER768:
-		fallthrough
-	case KEX_KYBER1024:
-		fallthrough
-	case KEX_NEWHOPE:
-		fallthrough
-	case KEX_NEWHOPE_SIMPLE:
-		fallthrough
-	case KEX_FRODOKEM_1344AES:
-		fallthrough
-	case KEX_FRODOKEM_1344SHAKE:
-		fallthrough
-	case KEX_FRODOKEM_976AES:
-		fallthrough
-	case KEX_FRODOKEM_976SHAKE:
+	if _, ok := lookupKEX(kexAlg); ok {
 		log.Printf("[KEx alg %d accepted]\n", kexAlg)
-	default:
-		// UNREACHABLE: _getkexalgnum() guarantees a valid KEX value
+	} else {
+		// UNREACHABLE: alg negotiation guarantees a valid KEX value
 		hc.kex = KEX_HERRADURA512
 		log.Printf("[KEx alg %d ?? defaults to %d]\n", kexAlg, hc.kex)
 	}
@@ -305,114 +270,20 @@ func _new(kexAlg KEXAlg, conn *net.Conn) (hc *Conn, e error) {
 	return
 }
 
-// applyConnExtensions processes optional Dial() negotiation
-// parameters. See also getkexalgnum().
-//
-// Currently defined extension values
-//
-// KEx algs
-//
-// KEX_HERRADURA256 KEX_HERRADURA512 KEX_HERRADURA1024 KEX_HERRADURA2048
-//
-// KEX_KYBER512 KEX_KYBER768 KEX_KYBER1024
-//
-// KEX_NEWHOPE KEX_NEWHOPE_SIMPLE
-//
-// Session (symmetric) crypto
-//
-// C_AES_256 C_TWOFISH_128 C_BLOWFISH_128 C_CRYPTMT1 C_CHACHA20_12
-//
-// Session HMACs
-//
-// H_SHA256 H_SHA512
-func (hc *Conn) applyConnExtensions(extensions ...string) {
-	for _, s := range extensions {
-		switch s {
-		case "C_AES_256":
-			log.Println("[extension arg = C_AES_256]")
-			hc.cipheropts &= (0xFFFFFF00)
-			hc.cipheropts |= CAlgAES256
-		case "C_TWOFISH_128":
-			log.Println("[extension arg = C_TWOFISH_128]")
-			hc.cipheropts &= (0xFFFFFF00)
-			hc.cipheropts |= CAlgTwofish128
-		case "C_BLOWFISH_64":
-			log.Println("[extension arg = C_BLOWFISH_64]")
-			hc.cipheropts &= (0xFFFFFF00)
-			hc.cipheropts |= CAlgBlowfish64
-		case "C_CRYPTMT1":
-			log.Println("[extension arg = C_CRYPTMT1]")
-			hc.cipheropts &= (0xFFFFFF00)
-			hc.cipheropts |= CAlgCryptMT1
-		case "C_CHACHA20_12":
-			log.Println("[extension arg = C_CHACHA20_12]")
-			hc.cipheropts &= (0xFFFFFF00)
-			hc.cipheropts |= CAlgChaCha20_12
-		case "H_SHA256":
-			log.Println("[extension arg = H_SHA256]")
-			hc.cipheropts &= (0xFFFF00FF)
-			hc.cipheropts |= (HmacSHA256 << 8)
-		case "H_SHA512":
-			log.Println("[extension arg = H_SHA512]")
-			hc.cipheropts &= (0xFFFF00FF)
-			hc.cipheropts |= (HmacSHA512 << 8)
-			//default:
-			//	log.Printf("[Dial ext \"%s\" ignored]\n", s)
-		}
+// readHex reads a "0x<hex>" line from c, as sent by
+// fmt.Fprintf(c, "0x%x\n", b), returning b. If n > 0, b must be n
+// bytes long.
+func readHex(c io.Reader, n int) (b []byte, err error) {
+	if _, err = fmt.Fscanf(c, "0x%x\n", &b); err != nil {
+		return nil, err
 	}
-}
-
-func getkexalgnum(extensions ...string) (k KEXAlg) {
-	k = KEX_HERRADURA512 // default
-	for _, s := range extensions {
-		switch s {
-		case "KEX_HERRADURA256":
-			k = KEX_HERRADURA256
-			break //out of for
-		case "KEX_HERRADURA512":
-			k = KEX_HERRADURA512
-			break //out of for
-		case "KEX_HERRADURA1024":
-			k = KEX_HERRADURA1024
-			break //out of for
-		case "KEX_HERRADURA2048":
-			k = KEX_HERRADURA2048
-			break //out of for
-		case "KEX_KYBER512":
-			k = KEX_KYBER512
-			break //out of for
-		case "KEX_KYBER768":
-			k = KEX_KYBER768
-			break //out of for
-		case "KEX_KYBER1024":
-			k = KEX_KYBER1024
-			break //out of for
-		case "KEX_NEWHOPE":
-			k = KEX_NEWHOPE
-			break //out of for
-		case "KEX_NEWHOPE_SIMPLE":
-			k = KEX_NEWHOPE_SIMPLE
-			break //out of for
-		case "KEX_FRODOKEM_1344AES":
-			k = KEX_FRODOKEM_1344AES
-			break //out of for
-		case "KEX_FRODOKEM_1344SHAKE":
-			k = KEX_FRODOKEM_1344SHAKE
-			break //out of for
-		case "KEX_FRODOKEM_976AES":
-			k = KEX_FRODOKEM_976AES
-			break //out of for
-		case "KEX_FRODOKEM_976SHAKE":
-			k = KEX_FRODOKEM_976SHAKE
-			break //out of for
-		}
+	if n > 0 && len(b) != n {
+		return nil, fmt.Errorf("KEx value is %d bytes, want %d", len(b), n)
 	}
-	return
+	return b, nil
 }
 
-func FrodoKEMDialSetup(c io.ReadWriter, hc *Conn) (err error) {
-	// Send xsnet.Conn parameters to remote side
-
+func frodoKEMDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Alice, step 1: Generate a key pair.
 	var kem frodo.FrodoKEM
 
@@ -421,7 +292,7 @@ func FrodoKEMDialSetup(c io.ReadWriter, hc *Conn) (err error) {
 		kem = frodo.Frodo1344AES()
 	case KEX_FRODOKEM_1344SHAKE:
 		kem = frodo.Frodo1344SHAKE()
-	case KEX_FRODOKEM_976AES:
+	case KEX_FRODOKEM_976AES, KEX_X25519_FRODOKEM_976AES:
 		kem = frodo.Frodo976AES()
 	default:
 		kem = frodo.Frodo976SHAKE()
@@ -429,185 +300,193 @@ func FrodoKEMDialSetup(c io.ReadWriter, hc *Conn) (err error) {
 	pubA, secA := kem.Keygen() // pA
 
 	// Alice, step 2: Send the public key (na,ea) to Bob
-	n, err := fmt.Fprintf(c, "0x%x\n", pubA)
-	if err != nil {
-		panic(err)
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubA); err != nil {
+		return nil, err
 	}
-	if n < len(pubA) {
-		panic(errors.New("incomplete Fprintf() of pubA"))
-	}
-
-	// (... and send cipher, connection opts)
-	fmt.Fprintf(c, "0x%x:0x%x\n", hc.cipheropts, hc.opts)
 
 	// [Bob does the same and sends use a public key (nb, eb)
-	pubB_bigint := big.NewInt(0)
-	_, err = fmt.Fscanf(c, "0x%x\n", pubB_bigint)
-	pubB := pubB_bigint.Bytes()
-
-	// (... and sends us cipher, connection opts)
-	_, err = fmt.Fscanf(c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
+	pubB, err := readHex(c, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Alice, step 3: Create ctAtoB, shareA
 	ctAtoB, shareA, err := kem.Encapsulate(pubB)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Alice, step 4: Send ctAtoB to Bob
-	fmt.Fprintf(c, "0x%x\n", ctAtoB)
+	if _, err = fmt.Fprintf(c, "0x%x\n", ctAtoB); err != nil {
+		return nil, err
+	}
 
 	// Alice, step 5: Receive ctBtoA from Bob
-	ctBtoA_bigint := big.NewInt(0)
-	_, err = fmt.Fscanf(c, "0x%x\n", ctBtoA_bigint)
-	ctBtoA := ctBtoA_bigint.Bytes()
+	ctBtoA, err := readHex(c, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	// Alice, step 6: compute Bob's share
 	shareB, err := kem.Dencapsulate(secA, ctBtoA)
+	if err != nil {
+		return nil, err
+	}
 	sessionKey := append(shareA, shareB...)
 
-	hc.r, hc.rm, err = hc.getStream(sessionKey)
-	hc.w, hc.wm, err = hc.getStream(sessionKey)
+	secret = sessionKey
 	return
 }
 
-func NewHopeDialSetup(c io.ReadWriter, hc *Conn) (err error) {
-	// Send xsnet.Conn parameters to remote side
-
+func newHopeDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Alice, step 1: Generate a key pair.
 	privKeyAlice, pubKeyAlice, err := newhope.GenerateKeyPairAlice(crand.Reader)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Alice, step 2: Send the public key to Bob
-	fmt.Fprintf(c, "0x%x\n0x%x:0x%x\n", pubKeyAlice.Send,
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubKeyAlice.Send); err != nil {
+		return nil, err
+	}
 
 	// [Bob does step 1-3], from which we read Bob's pubkey
-	publicKeyBob := big.NewInt(0)
-	fmt.Fscanf(c, "0x%x\n", publicKeyBob)
 	var pubKeyBob newhope.PublicKeyBob
-	for i := range pubKeyBob.Send {
-		pubKeyBob.Send[i] = publicKeyBob.Bytes()[i]
-	}
-	//log.Printf("[Got server pubKey[]:%v]\n", pubKeyBob)
-
-	// Read cipheropts, session opts
-	_, err = fmt.Fscanf(c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
+	publicKeyBob, err := readHex(c, len(pubKeyBob.Send))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	copy(pubKeyBob.Send[:], publicKeyBob)
 
 	// Alice, step 3: Derive shared secret
 	// (NOTE: actual over-wire exchange was already done above. This is
 	//  the math voodoo 'exchange' done after receiving data from Bob.)
 	aliceSharedSecret, err := newhope.KeyExchangeAlice(&pubKeyBob, privKeyAlice)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	
-	hc.r, hc.rm, err = hc.getStream(aliceSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(aliceSharedSecret)
+
+	secret = aliceSharedSecret
 	return
 }
 
-func NewHopeSimpleDialSetup(c io.ReadWriter, hc *Conn) (err error) {
-	// Send xsnet.Conn parameters to remote side
-
+func newHopeSimpleDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Alice, step 1: Generate a key pair.
 	privKeyAlice, pubKeyAlice, err := newhope.GenerateKeyPairSimpleAlice(crand.Reader)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Alice, step 2: Send the public key to Bob
-	fmt.Fprintf(c, "0x%x\n0x%x:0x%x\n", pubKeyAlice.Send,
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubKeyAlice.Send); err != nil {
+		return nil, err
+	}
 
 	// [Bob does step 1-3], from which we read Bob's pubkey
-	publicKeyBob := big.NewInt(0)
-	fmt.Fscanf(c, "0x%x\n", publicKeyBob)
 	var pubKeyBob newhope.PublicKeySimpleBob
-	for i := range pubKeyBob.Send {
-		pubKeyBob.Send[i] = publicKeyBob.Bytes()[i]
-	}
-	//log.Printf("[Got server pubKey[]:%v]\n", pubKeyBob)
-
-	// Read cipheropts, session opts
-	_, err = fmt.Fscanf(c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
+	publicKeyBob, err := readHex(c, len(pubKeyBob.Send))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	copy(pubKeyBob.Send[:], publicKeyBob)
 
 	// Alice, step 3: Derive shared secret
 	// (NOTE: actual over-wire exchange was already done above. This is
 	//  the math voodoo 'exchange' done after receiving data from Bob.)
 	aliceSharedSecret, err := newhope.KeyExchangeSimpleAlice(&pubKeyBob, privKeyAlice)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	
-	hc.r, hc.rm, err = hc.getStream(aliceSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(aliceSharedSecret)
+
+	secret = aliceSharedSecret
 	return
 }
 
-func KyberDialSetup(c io.ReadWriter /*net.Conn*/, hc *Conn) (err error) {
-	// Send xsnet.Conn parameters to remote side
-
+func kyberDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Alice, step 1: Generate a key pair.
-	var alicePublicKey *kyber.PublicKey
-	var alicePrivateKey *kyber.PrivateKey
+	var params *kyber.ParameterSet
 	switch hc.kex {
 	case KEX_KYBER512:
-		alicePublicKey, alicePrivateKey, err = kyber.Kyber512.GenerateKeyPair(crand.Reader)
-	case KEX_KYBER768:
-		alicePublicKey, alicePrivateKey, err = kyber.Kyber768.GenerateKeyPair(crand.Reader)
+		params = kyber.Kyber512
+	case KEX_KYBER768, KEX_X25519_KYBER768:
+		params = kyber.Kyber768
 	case KEX_KYBER1024:
-		alicePublicKey, alicePrivateKey, err = kyber.Kyber1024.GenerateKeyPair(crand.Reader)
+		params = kyber.Kyber1024
 	default:
-		alicePublicKey, alicePrivateKey, err = kyber.Kyber768.GenerateKeyPair(crand.Reader)
+		params = kyber.Kyber768
 	}
-
+	alicePublicKey, alicePrivateKey, err := params.GenerateKeyPair(crand.Reader)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Alice, step 2: Send the public key to Bob
-	fmt.Fprintf(c, "0x%x\n0x%x:0x%x\n", alicePublicKey.Bytes(),
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", alicePublicKey.Bytes()); err != nil {
+		return nil, err
+	}
 
 	// [Bob, step 1-3], from which we read cipher text
-	pubKeyB := make([]byte, 4096)
-	fmt.Fscanf(c, "0x%x\n", &pubKeyB)
-	//if err != nil {
-	//	return err
-	//}
-	//log.Printf("[Got server pubKeyB[]:%v]\n", pubKeyB)
-
-	// Read cipheropts, session opts
-	_, err = fmt.Fscanf(c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
+	// (KEMDecrypt() panics on any of the wrong length)
+	pubKeyB, err := readHex(c, params.CipherTextSize())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Alice, step 3: Decrypt the KEM cipher text.
 	aliceSharedSecret := alicePrivateKey.KEMDecrypt(pubKeyB)
 
-	hc.r, hc.rm, err = hc.getStream(aliceSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(aliceSharedSecret)
+	secret = aliceSharedSecret
 	return
 }
 
-func HKExDialSetup(c io.ReadWriter /*net.Conn*/, hc *Conn) (err error) {
+// hybridDialSecret performs (client side) one of the hybrid KEx modes,
+// in which an X25519 ECDH exchange is done as well as a post-quantum
+// KEM (Kyber or FrodoKEM), so the session keys remain secure as long
+// as either one is unbroken.
+func hybridDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
+	xSecret, err := x25519DialSecret(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var pqSecret []byte
+	switch hc.kex {
+	case KEX_X25519_FRODOKEM_976AES:
+		pqSecret, err = frodoKEMDialSecret(c, hc)
+	default:
+		pqSecret, err = kyberDialSecret(c, hc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Both secrets are fed to the key schedule
+	secret = append(xSecret, pqSecret...)
+	return
+}
+
+func x25519DialSecret(c io.ReadWriter) (secret []byte, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = crand.Read(priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Alice sends her public key, then reads Bob's
+	if _, err = fmt.Fprintf(c, "0x%x\n", pub); err != nil {
+		return nil, err
+	}
+	peerPub, err := readHex(c, curve25519.PointSize)
+	if err != nil {
+		return nil, err
+	}
+	return curve25519.X25519(priv, peerPub)
+}
+
+func hkexDialSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	var h *hkex.HerraduraKEx
 	switch hc.kex {
 	case KEX_HERRADURA256:
@@ -622,21 +501,16 @@ func HKExDialSetup(c io.ReadWriter /*net.Conn*/, hc *Conn) (err error) {
 		h = hkex.New(256, 64)
 	}
 
-	// Send xsnet.Conn parameters to remote side
-	// d is value for Herradura key exchange
-	fmt.Fprintf(c, "0x%s\n0x%x:0x%x\n", h.D().Text(16),
-		hc.cipheropts, hc.opts)
+	// Send d, the value for Herradura key exchange
+	if _, err = fmt.Fprintf(c, "0x%s\n", h.D().Text(16)); err != nil {
+		return nil, err
+	}
 
 	// Read peer D over net.Conn (c)
 	d := big.NewInt(0)
 	_, err = fmt.Fscanln(c, d)
 	if err != nil {
-		return err
-	}
-	_, err = fmt.Fscanf(c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
 	h.SetPeerD(d)
@@ -645,12 +519,11 @@ func HKExDialSetup(c io.ReadWriter /*net.Conn*/, hc *Conn) (err error) {
 	h.ComputeFA()
 	log.Printf("**(c)** FA:%s\n", h.FA())
 
-	hc.r, hc.rm, err = hc.getStream(h.FA().Bytes())
-	hc.w, hc.wm, err = hc.getStream(h.FA().Bytes())
+	secret = h.FA().Bytes()
 	return
 }
 
-func FrodoKEMAcceptSetup(c *net.Conn, hc *Conn) (err error) {
+func frodoKEMAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Bob, step 1: Generate a key pair.
 	var kem frodo.FrodoKEM
 
@@ -659,180 +532,185 @@ func FrodoKEMAcceptSetup(c *net.Conn, hc *Conn) (err error) {
 		kem = frodo.Frodo1344AES()
 	case KEX_FRODOKEM_1344SHAKE:
 		kem = frodo.Frodo1344SHAKE()
-	case KEX_FRODOKEM_976AES:
+	case KEX_FRODOKEM_976AES, KEX_X25519_FRODOKEM_976AES:
 		kem = frodo.Frodo976AES()
 	default:
 		kem = frodo.Frodo976SHAKE()
 	}
 	pubB, secB := kem.Keygen()
 
-	
 	// [Alice sends use a public key (na, ea)
-	pubA_bigint := big.NewInt(0)
-	_, err = fmt.Fscanf(*c, "0x%x\n", pubA_bigint)
-	pubA := pubA_bigint.Bytes()
-
-	// (... and sends us cipher, connection opts)
-	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
+	pubA, err := readHex(c, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Bob, step 2: Send the public key (nb,eb) to Alice
-	n, err := fmt.Fprintf(*c, "0x%x\n", pubB)
-	if err != nil {
-		panic(err)
-	}
-	if n < len(pubB) {
-		panic(errors.New("incomplete Fprintf() of pubB"))
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubB); err != nil {
+		return nil, err
 	}
 
-	// (... and send cipher, connection opts)
-	fmt.Fprintf(*c, "0x%x:0x%x\n", hc.cipheropts, hc.opts)
-	
 	// Bob, step 3: Create ctBtoA, shareB
 	ctBtoA, shareB, err := kem.Encapsulate(pubA)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Bob, step 4: Send ctBtoA to Alice
-	fmt.Fprintf(*c, "0x%x\n", ctBtoA)
+	if _, err = fmt.Fprintf(c, "0x%x\n", ctBtoA); err != nil {
+		return nil, err
+	}
 
 	// Bob, step 5: Receive ctAtoB from Alice
-	ctAtoB_bigint := big.NewInt(0)
-	_, err = fmt.Fscanf(*c, "0x%x\n", ctAtoB_bigint)
-	ctAtoB := ctAtoB_bigint.Bytes()
+	ctAtoB, err := readHex(c, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	// Alice, step 6: compute Bob's share
 	shareA, err := kem.Dencapsulate(secB, ctAtoB)
+	if err != nil {
+		return nil, err
+	}
 	sessionKey := append(shareA, shareB...)
 
-	hc.r, hc.rm, err = hc.getStream(sessionKey)
-	hc.w, hc.wm, err = hc.getStream(sessionKey)
+	secret = sessionKey
 	return
 }
 
-func NewHopeAcceptSetup(c *net.Conn, hc *Conn) (err error) {
+func newHopeAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Bob, step 1: Deserialize Alice's public key from the binary encoding.
-	alicePublicKey := big.NewInt(0)
-	_, err = fmt.Fscanln(*c, alicePublicKey)
-	//log.Printf("[Got client pubKey:0x%x\n]", alicePublicKey)
-	if err != nil {
-		return err
-	}
-
 	var pubKeyAlice newhope.PublicKeyAlice
-	for i := range pubKeyAlice.Send {
-		pubKeyAlice.Send[i] = alicePublicKey.Bytes()[i]
-	}
-
-	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
-	log.Printf("[Got cipheropts, opts:%v, %v]", hc.cipheropts, hc.opts)
+	alicePublicKey, err := readHex(c, len(pubKeyAlice.Send))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	copy(pubKeyAlice.Send[:], alicePublicKey)
 
 	// Bob, step 2: Generate the KEM cipher text and shared secret.
 	pubKeyBob, bobSharedSecret, err := newhope.KeyExchangeBob(crand.Reader, &pubKeyAlice)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Bob, step 3: Send the cipher text to Alice.
-	fmt.Fprintf(*c, "0x%x\n0x%x:0x%x\n", pubKeyBob.Send,
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubKeyBob.Send); err != nil {
+		return nil, err
+	}
 
-	hc.r, hc.rm, err = hc.getStream(bobSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(bobSharedSecret)
+	secret = bobSharedSecret
 	return
 }
 
-func NewHopeSimpleAcceptSetup(c *net.Conn, hc *Conn) (err error) {
+func newHopeSimpleAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Bob, step 1: Deserialize Alice's public key from the binary encoding.
-	alicePublicKey := big.NewInt(0)
-	_, err = fmt.Fscanln(*c, alicePublicKey)
-	//log.Printf("[Got client pubKey:0x%x\n]", alicePublicKey)
-	if err != nil {
-		return err
-	}
-
 	var pubKeyAlice newhope.PublicKeySimpleAlice
-	for i := range pubKeyAlice.Send {
-		pubKeyAlice.Send[i] = alicePublicKey.Bytes()[i]
-	}
-
-	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
-	log.Printf("[Got cipheropts, opts:%v, %v]", hc.cipheropts, hc.opts)
+	alicePublicKey, err := readHex(c, len(pubKeyAlice.Send))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	copy(pubKeyAlice.Send[:], alicePublicKey)
 
 	// Bob, step 2: Generate the KEM cipher text and shared secret.
 	pubKeyBob, bobSharedSecret, err := newhope.KeyExchangeSimpleBob(crand.Reader, &pubKeyAlice)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Bob, step 3: Send the cipher text to Alice.
-	fmt.Fprintf(*c, "0x%x\n0x%x:0x%x\n", pubKeyBob.Send,
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", pubKeyBob.Send); err != nil {
+		return nil, err
+	}
 
-	hc.r, hc.rm, err = hc.getStream(bobSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(bobSharedSecret)
+	secret = bobSharedSecret
 	return
 }
 
-func KyberAcceptSetup(c *net.Conn, hc *Conn) (err error) {
+func kyberAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	// Bob, step 1: Deserialize Alice's public key from the binary encoding.
-	alicePublicKey := big.NewInt(0)
-	_, err = fmt.Fscanln(*c, alicePublicKey)
-	//log.Printf("[Got client pubKey:0x%x\n]", alicePublicKey)
+	alicePublicKey, err := readHex(c, 0)
 	if err != nil {
-		return err
-	}
-	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
-	log.Printf("[Got cipheropts, opts:%v, %v]", hc.cipheropts, hc.opts)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
+	// (PublicKeyFromBytes() checks the key's length)
 	var peerPublicKey *kyber.PublicKey
 	switch hc.kex {
 	case KEX_KYBER512:
-		peerPublicKey, err = kyber.Kyber512.PublicKeyFromBytes(alicePublicKey.Bytes())
-	case KEX_KYBER768:
-		peerPublicKey, err = kyber.Kyber768.PublicKeyFromBytes(alicePublicKey.Bytes())
+		peerPublicKey, err = kyber.Kyber512.PublicKeyFromBytes(alicePublicKey)
+	case KEX_KYBER768, KEX_X25519_KYBER768:
+		peerPublicKey, err = kyber.Kyber768.PublicKeyFromBytes(alicePublicKey)
 	case KEX_KYBER1024:
-		peerPublicKey, err = kyber.Kyber1024.PublicKeyFromBytes(alicePublicKey.Bytes())
+		peerPublicKey, err = kyber.Kyber1024.PublicKeyFromBytes(alicePublicKey)
 	default:
-		peerPublicKey, err = kyber.Kyber768.PublicKeyFromBytes(alicePublicKey.Bytes())
+		peerPublicKey, err = kyber.Kyber768.PublicKeyFromBytes(alicePublicKey)
 	}
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Bob, step 2: Generate the KEM cipher text and shared secret.
 	cipherText, bobSharedSecret, err := peerPublicKey.KEMEncrypt(crand.Reader)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Bob, step 3: Send the cipher text to Alice.
-	fmt.Fprintf(*c, "0x%x\n0x%x:0x%x\n", cipherText,
-		hc.cipheropts, hc.opts)
+	if _, err = fmt.Fprintf(c, "0x%x\n", cipherText); err != nil {
+		return nil, err
+	}
+
+	secret = bobSharedSecret
+	return
+}
+
+// hybridAcceptSecret performs (server side) one of the hybrid KEx
+// modes. See hybridDialSecret().
+func hybridAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
+	xSecret, err := x25519AcceptSecret(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var pqSecret []byte
+	switch hc.kex {
+	case KEX_X25519_FRODOKEM_976AES:
+		pqSecret, err = frodoKEMAcceptSecret(c, hc)
+	default:
+		pqSecret, err = kyberAcceptSecret(c, hc)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	hc.r, hc.rm, err = hc.getStream(bobSharedSecret)
-	hc.w, hc.wm, err = hc.getStream(bobSharedSecret)
+	// Both secrets are fed to the key schedule
+	secret = append(xSecret, pqSecret...)
 	return
 }
 
-func HKExAcceptSetup(c *net.Conn, hc *Conn) (err error) {
+func x25519AcceptSecret(c io.ReadWriter) (secret []byte, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = crand.Read(priv); err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bob reads Alice's public key, then sends his
+	peerPub, err := readHex(c, curve25519.PointSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fmt.Fprintf(c, "0x%x\n", pub); err != nil {
+		return nil, err
+	}
+	return curve25519.X25519(priv, peerPub)
+}
+
+func hkexAcceptSecret(c io.ReadWriter, hc *Conn) (secret []byte, err error) {
 	var h *hkex.HerraduraKEx
 	switch hc.kex {
 	case KEX_HERRADURA256:
@@ -847,19 +725,12 @@ func HKExAcceptSetup(c *net.Conn, hc *Conn) (err error) {
 		h = hkex.New(256, 64)
 	}
 
-	// Read in xsnet.Conn parameters over raw Conn c
-	// d is value for Herradura key exchange
+	// Read d, the peer's value for Herradura key exchange
 	d := big.NewInt(0)
-	_, err = fmt.Fscanln(*c, d)
+	_, err = fmt.Fscanln(c, d)
 	log.Printf("[Got d:%v]", d)
 	if err != nil {
-		return err
-	}
-	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n",
-		&hc.cipheropts, &hc.opts)
-	log.Printf("[Got cipheropts, opts:%v, %v]", hc.cipheropts, hc.opts)
-	if err != nil {
-		return err
+		return nil, err
 	}
 	h.SetPeerD(d)
 	log.Printf("** D:%s\n", h.D().Text(16))
@@ -867,103 +738,204 @@ func HKExAcceptSetup(c *net.Conn, hc *Conn) (err error) {
 	h.ComputeFA()
 	log.Printf("**(s)** FA:%s\n", h.FA())
 
-	// Send D and cipheropts/conn_opts to peer
-	fmt.Fprintf(*c, "0x%s\n0x%x:0x%x\n", h.D().Text(16),
-		hc.cipheropts, hc.opts)
+	// Send D to peer
+	if _, err = fmt.Fprintf(c, "0x%s\n", h.D().Text(16)); err != nil {
+		return nil, err
+	}
 
-	hc.r, hc.rm, err = hc.getStream(h.FA().Bytes())
-	hc.w, hc.wm, err = hc.getStream(h.FA().Bytes())
+	secret = h.FA().Bytes()
 	return
 }
 
+// dialSetup performs (client side) the KEx for the negotiated alg
+// over c, and sets up the session keys. It is used both when the
+// connection is first made and on rekeying.
+//
+// The conn's cipher and session opts are exchanged around the KEx,
+// which need not know of them: sent ahead of it, and the server's
+// (which must agree) read after it.
+func (hc *Conn) dialSetup(c io.ReadWriter) (err error) {
+	k, ok := lookupKEX(hc.kex)
+	if !ok {
+		return errors.New("invalid KEx alg")
+	}
+	log.Printf("[Setting up for %s %d]\n", k.Name(), hc.kex)
+	if _, err = fmt.Fprintf(c, "0x%x:0x%x\n", hc.cipheropts, hc.opts); err != nil {
+		return err
+	}
+	secret, err := k.DialSetup(c, hc)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fscanf(c, "0x%x:0x%x\n", &hc.cipheropts, &hc.opts); err != nil {
+		return err
+	}
+	return hc.setupStreams(secret)
+}
+
+// acceptSetup performs (server side) the KEx for the negotiated alg
+// over c, and sets up the session keys. See dialSetup().
+func (hc *Conn) acceptSetup(c *net.Conn) (err error) {
+	cipheropts := hc.cipheropts
+	k, ok := lookupKEX(hc.kex)
+	if !ok {
+		return errors.New("invalid KEx alg")
+	}
+	log.Printf("[Setting up for %s %d]\n", k.Name(), hc.kex)
+	_, err = fmt.Fscanf(*c, "0x%x:0x%x\n", &hc.cipheropts, &hc.opts)
+	log.Printf("[Got cipheropts, opts:%v, %v]", hc.cipheropts, hc.opts)
+	if err != nil {
+		return err
+	}
+
+	// The client must use the cipher/HMAC algs agreed on
+	if hc.cipheropts != cipheropts {
+		return errors.New("client cipheropts differ from those negotiated")
+	}
+	secret, err := k.AcceptSetup(*c, hc)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(*c, "0x%x:0x%x\n", hc.cipheropts, hc.opts); err != nil {
+		return err
+	}
+	return hc.setupStreams(secret)
+}
+
 // Dial as net.Dial(), but with implicit key exchange to set up secure
 // channel on connect
 //
-//   Can be called like net.Dial(), defaulting to C_AES_256/H_SHA256,
-//   or additional extensions can be passed amongst the following:
+//	Can be called like net.Dial(), offering a default list of algs,
+//	or additional extensions can be passed amongst the following,
+//	most preferred first, from which the server will choose:
+//
+//	"KEX_X25519_KYBER768" | "KEX_HERRADURA512" | ...
 //
-//   "C_AES_256" | "C_TWOFISH_128" | ...
+//	"C_AES_256" | "C_TWOFISH_128" | ...
 //
-//   "H_SHA256" | "H_SHA512" | ...
+//	"H_SHA256" | "H_SHA512" | ...
 //
-// See go doc -u xsnet.applyConnExtensions
-func Dial(protocol string, ipport string, extensions ...string) (hc Conn, err error) {
+//	An unrecognised extension is an error.
+//
+// See go doc xsnet.NewConfig
+func Dial(protocol string, ipport string, extensions ...string) (hc *Conn, err error) {
+	cfg, err := NewConfig(protocol, extensions...)
+	if err != nil {
+		return nil, err
+	}
+	return DialContext(context.Background(), ipport, cfg)
+}
+
+// DialContext connects to ipport as Dial(), using the settings in cfg
+// (nil for the defaults). The context covers the whole connection
+// setup including KEx: if it is cancelled, or its deadline passes,
+// before the connection is established the dial is abandoned and
+// ctx.Err() returned.
+func DialContext(ctx context.Context, ipport string, cfg *Config) (hc *Conn, err error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
 	if Log == nil {
 		Init(false, "client", logger.LOG_DAEMON|logger.LOG_DEBUG)
 	}
 
-	var c net.Conn
-	if protocol == "kcp" {
-		c, err = kcpDial(ipport, extensions)
-		if err != nil {
-			return Conn{}, err
+	// Open raw Conn c
+	t, ok := lookupTransport(cfg.transport())
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", cfg.transport())
+	}
+	c, err := t.Dial(ctx, ipport, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unblock the KEx if ctx is done before it completes
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Unix(1, 0))
+		case <-stop:
 		}
-	} else {
-		// Open raw Conn c
-		c, err = net.Dial(protocol, ipport)
-		if err != nil {
-			return Conn{}, err
+	}()
+	hc, err = dialKEx(c, ipport, cfg)
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	if cfg.ChaffMsecsMax > 0 {
+		hc.SetupChaff(cfg.ChaffMsecsMin, cfg.ChaffMsecsMax, cfg.ChaffBytesMax)
+	}
+	if cfg.Chaff {
+		hc.EnableChaff()
+	}
+	return hc, nil
+}
+
+// dialKEx performs the client side of connection setup (hello, alg
+// negotiation, KEx and host key check) over c.
+func dialKEx(c net.Conn, ipport string, cfg *Config) (hc *Conn, err error) {
+	// As for the server's handshake(), a malformed KEx message from
+	// the server fails the dial rather than panicking
+	defer func() {
+		if r := recover(); r != nil {
+			hc, err = nil, fmt.Errorf("KEx failed: %v", r)
 		}
+	}()
+
+	// Exchange protocol hello and negotiate algs
+	// (all KEx traffic is recorded, to verify the server's host key sig)
+	t := newKexTranscript(c)
+	protoVersion, features, err := clientHello(t)
+	if err != nil {
+		return nil, err
 	}
+	// Client proposes Conn extensions, in order of preference. It's the
+	// server's responsibility to choose from them, or reject them.
+	algs, err := clientNegotiate(t, cfg.algPrefs())
+	if err != nil {
+		return nil, err
+	}
+
 	// Init xsnet.Conn hc over net.Conn c
-	ret, err := _new(getkexalgnum(extensions...), &c)
+	hc, err = _new(algs.kex[0], &c)
 	if err != nil {
-		return Conn{}, err
+		return nil, err
 	}
-	hc = *ret
+	hc.kexT = t
+	hc.protoVersion, hc.features = protoVersion, features
+	hc.cipheropts = algs.cipheropts()
 
-	// Client has full control over Conn extensions. It's the server's
-	// responsibility to accept or reject the proposed parameters.
-	hc.applyConnExtensions(extensions...)
+	// Perform Key Exchange according to negotiated algorithm
+	if err = hc.dialSetup(t); err != nil {
+		return nil, err
+	}
 
-	// Perform Key Exchange according to client-request algorithm
-	fmt.Fprintf(c, "%02x\n", hc.kex)
-	switch hc.kex {
-	case KEX_HERRADURA256:
-		fallthrough
-	case KEX_HERRADURA512:
-		fallthrough
-	case KEX_HERRADURA1024:
-		fallthrough
-	case KEX_HERRADURA2048:
-		log.Printf("[Setting up for KEX_HERRADURA %d]\n", hc.kex)
-		if HKExDialSetup(c, &hc) != nil {
-			return Conn{}, nil
-		}
-	case KEX_KYBER512:
-		fallthrough
-	case KEX_KYBER768:
-		fallthrough
-	case KEX_KYBER1024:
-		log.Printf("[Setting up for KEX_KYBER %d]\n", hc.kex)
-		if KyberDialSetup(c, &hc) != nil {
-			return Conn{}, nil
-		}
-	case KEX_NEWHOPE:
-		log.Printf("[Setting up for KEX_NEWHOPE %d]\n", hc.kex)
-		if NewHopeDialSetup(c, &hc) != nil {
-			return Conn{}, nil
-		}
-	case KEX_NEWHOPE_SIMPLE:
-		log.Printf("[Setting up for KEX_NEWHOPE_SIMPLE %d]\n", hc.kex)
-		if NewHopeSimpleDialSetup(c, &hc) != nil {
-			return Conn{}, nil
-		}
-	case KEX_FRODOKEM_1344AES:
-		fallthrough
-	case KEX_FRODOKEM_1344SHAKE:
-		fallthrough
-	case KEX_FRODOKEM_976AES:
-		fallthrough
-	case KEX_FRODOKEM_976SHAKE:
-		log.Printf("[Setting up for KEX_FRODOKEM %d]\n", hc.kex)
-		if FrodoKEMDialSetup(c, &hc) != nil {
-			return Conn{}, nil
-		}
-	default:
-		return Conn{}, err
+	// Server proves its identity by signing the KEx transcript
+	cb := cfg.HostKeyCallback
+	if cb == nil {
+		cb = hostKeyCB
 	}
-	return
+	err = t.verifyHostKey(ipport, cb)
+	if err != nil {
+		return nil, err
+	}
+	hc.kexT = nil
+	return hc, nil
 }
 
 // Close a hkex.Conn
@@ -974,6 +946,10 @@ func (hc *Conn) Close() (err error) {
 	log.Printf("** Writing closeStat %d at Close()\n", *hc.closeStat)
 	//(*hc.c).SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
 	hc.WritePacket(s, CSOExitStatus)
+	hc.closeRevListeners()
+	hc.closeTunListeners()
+	hc.closeStreams()
+	hc.closeUDPTuns()
 	err = (*hc.c).Close()
 	logger.LogDebug(fmt.Sprintln("[Conn Closing]"))
 	return
@@ -1026,155 +1002,341 @@ func (hc *Conn) SetReadDeadline(t time.Time) error {
 
 /*---------------------------------------------------------------------*/
 
-// HKExListener is a Listener conforming to net.Listener
+const (
+	// HandshakeTimeoutDefault is the default time allowed for an
+	// accepted client to complete its handshake.
+	HandshakeTimeoutDefault = 30 * time.Second
+	// MaxHandshakesDefault is the default number of client handshakes
+	// a listener performs at once.
+	MaxHandshakesDefault = 64
+)
+
+var errListenerClosed = errors.New("use of closed network connection")
+
+// HKExListener is a Listener conforming to net.Listener.
+//
+// Client handshakes (hello, alg negotiation, KEx) are each performed
+// in their own goroutine, so that a slow or stalled client does not
+// hold up others; Accept() returns connections as their handshakes
+// complete. Each handshake must finish within a timeout, and the
+// number in progress at once is capped (see SetHandshakeLimits()).
 //
 // See go doc net.Listener
 type HKExListener struct {
 	l     net.Listener
 	proto string
+
+	aKEX    []string // allowed algs (see SetAllowedAlgs())
+	aCipher []string
+	aHMAC   []string
+
+	hsTimeout time.Duration // see SetHandshakeLimits()
+	hsMax     int
+
+	hostKey ed25519.PrivateKey // signs each client's KEx transcript
+
+	start    sync.Once
+	accepted chan acceptResult // handshaken conns, or listener errors
+	closed   chan struct{}
+	closing  sync.Once
+}
+
+type acceptResult struct {
+	hc  *Conn
+	err error
+}
+
+// SetHandshakeLimits sets the time allowed for each client's handshake
+// (a client which has not completed it by then is dropped) and the
+// number of handshakes in progress at once (further clients wait to be
+// accepted). Either may be zero to leave it unchanged, and they must be
+// set before the first call to Accept(). The defaults are
+// HandshakeTimeoutDefault and MaxHandshakesDefault.
+func (hl *HKExListener) SetHandshakeLimits(timeout time.Duration, max int) {
+	if timeout > 0 {
+		hl.hsTimeout = timeout
+	}
+	if max > 0 {
+		hl.hsMax = max
+	}
+}
+
+// SetAllowedAlgs sets the KEx, cipher and HMAC algs (named as for
+// Dial()) the listener will agree to use. A client offering none of
+// them is refused. A nil list, or one containing "KEX_all", "C_all" or
+// "H_all" respectively, allows all algs (the default).
+func (hl *HKExListener) SetAllowedAlgs(kex, ciphers, hmacs []string) {
+	hl.aKEX, hl.aCipher, hl.aHMAC = kex, ciphers, hmacs
 }
 
 // Listen for a connection
 //
+// proto names a registered Transport (see RegisterTransport()). The
+// listener signs with the host key set by SetHostKey().
+//
 // See go doc net.Listen
-func Listen(proto string, ipport string, extensions ...string) (hl HKExListener, e error) {
+func Listen(proto string, ipport string, extensions ...string) (hl *HKExListener, e error) {
+	// Only transport settings (eg., the KCP alg) are taken from
+	// extensions; the KEx and session algs are chosen by the client
+	cfg := &Config{Transport: proto, KCPAlg: KCP_AES, HostKey: hostKey}
+	for _, s := range extensions {
+		if a, ok := kcpAlgByName(s); ok {
+			cfg.KCPAlg = a
+		}
+	}
+	return ListenConfig(ipport, cfg)
+}
+
+// ListenConfig listens on ipport as Listen(), taking the transport
+// settings and host key from cfg. A listener without a host key can't
+// prove its identity to clients, so is refused.
+func ListenConfig(ipport string, cfg *Config) (hl *HKExListener, e error) {
 	if Log == nil {
 		Init(false, "server", logger.LOG_DAEMON|logger.LOG_DEBUG)
 	}
+	if cfg == nil || len(cfg.HostKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("no host key for listener (see LoadHostKey())")
+	}
 
-	var lErr error
-	var l net.Listener
-
-	if proto == "kcp" {
-		l, lErr = kcpListen(ipport, extensions)
-	} else {
-		l, lErr = net.Listen(proto, ipport)
+	proto := cfg.transport()
+	t, ok := lookupTransport(proto)
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", proto)
 	}
+	l, lErr := t.Listen(ipport, cfg)
 	if lErr != nil {
-		return HKExListener{nil, proto}, lErr
+		return nil, lErr
 	}
 	logger.LogDebug(fmt.Sprintf("[Listening (proto '%s') on %s]\n", proto, ipport))
-	hl.l = l
-	hl.proto = proto
-	return
+	return &HKExListener{l: l, proto: proto,
+		hsTimeout: HandshakeTimeoutDefault,
+		hsMax:     MaxHandshakesDefault,
+		hostKey:   cfg.HostKey,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{})}, nil
 }
 
 // Close a hkex Listener - closes the Listener.
 // Any blocked Accept operations will be unblocked and return errors.
 //
 // See go doc net.Listener.Close
-func (hl HKExListener) Close() error {
+func (hl *HKExListener) Close() error {
 	logger.LogDebug(fmt.Sprintln("[Listener Closed]"))
+	hl.closing.Do(func() { close(hl.closed) })
 	return hl.l.Close()
 }
 
 // Addr returns a the listener's network address.
 //
 // See go doc net.Listener.Addr
-func (hl HKExListener) Addr() net.Addr {
+func (hl *HKExListener) Addr() net.Addr {
 	return hl.l.Addr()
 }
 
 // Accept a client connection, conforming to net.Listener.Accept()
 //
 // See go doc net.Listener.Accept
-func (hl *HKExListener) Accept() (hc Conn, err error) {
-	var c net.Conn
-	if hl.proto == "kcp" {
-		c, err = hl.AcceptKCP()
-		if err != nil {
-			return Conn{}, err
+func (hl *HKExListener) Accept() (net.Conn, error) {
+	hc, err := hl.AcceptConn()
+	if err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+// AcceptConn accepts a client connection as Accept(), returning it as
+// an *xsnet.Conn.
+func (hl *HKExListener) AcceptConn() (hc *Conn, err error) {
+	hl.start.Do(func() { go hl.acceptLoop() })
+	select {
+	case r := <-hl.accepted:
+		return r.hc, r.err
+	case <-hl.closed:
+		return nil, errListenerClosed
+	}
+}
+
+// acceptLoop accepts raw connections, starting a handshake for each
+// (while fewer than hsMax are in progress), until the listener fails.
+func (hl *HKExListener) acceptLoop() {
+	inFlight := make(chan struct{}, hl.hsMax)
+	for {
+		select {
+		case inFlight <- struct{}{}:
+		case <-hl.closed:
+			return
 		}
-		logger.LogDebug(fmt.Sprintln("[kcp.Listener Accepted]"))
-	} else {
+
 		// Open raw Conn c
-		c, err = hl.l.Accept()
+		c, err := hl.l.Accept()
 		if err != nil {
-			return Conn{}, err
+			<-inFlight
+			// A temporary error is passed on once; any other ends the
+			// listener, and is returned by all further Accept() calls
+			temp := false
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				temp = true
+			}
+			for {
+				select {
+				case hl.accepted <- acceptResult{err: err}:
+				case <-hl.closed:
+					return
+				}
+				if temp {
+					break
+				}
+			}
+			continue
+		}
+		logger.LogDebug(fmt.Sprintf("[%s.Listener Accepted]", hl.proto))
+
+		go func() {
+			_ = c.SetDeadline(time.Now().Add(hl.hsTimeout))
+			hc, err := hl.handshake(c)
+			<-inFlight
+			if err != nil {
+				logger.LogDebug(fmt.Sprintf("[Handshake with %s failed: %s]", c.RemoteAddr(), err))
+				_ = c.Close()
+				return
+			}
+			_ = c.SetDeadline(time.Time{})
+			select {
+			case hl.accepted <- acceptResult{hc: hc}:
+			case <-hl.closed:
+				_ = c.Close()
+			}
+		}()
+	}
+}
+
+// handshake performs the server side of connection setup (hello, alg
+// negotiation, KEx and host key signature) over c.
+func (hl *HKExListener) handshake(c net.Conn) (hc *Conn, err error) {
+	// A panic here (eg. in a KEx alg, on a malformed message) fails
+	// only this client's handshake, not the server
+	defer func() {
+		if r := recover(); r != nil {
+			hc, err = nil, fmt.Errorf("handshake failed: %v", r)
 		}
+	}()
 
-		logger.LogDebug(fmt.Sprintln("[net.Listener Accepted]"))
+	// Read hello, then choose from the algs proposed by client
+	// (all KEx traffic is recorded, to sign with our host key)
+	t := newKexTranscript(c)
+	var tc net.Conn = t
+	protoVersion, features, err := serverHello(t)
+	if err == nil {
+		var algs algPrefs
+		algs, err = serverNegotiate(t, getAllowedAlgs(hl.aKEX, hl.aCipher, hl.aHMAC))
+		if err == nil {
+			hc, err = _new(algs.kex[0], &c)
+			if err == nil {
+				hc.cipheropts = algs.cipheropts()
+			}
+		}
 	}
-	// Read KEx alg proposed by client
-	var kexAlg KEXAlg
-	//! NB. Was using fmt.FScanln() here, but integers with a leading zero
-	//  were being mis-scanned? (is it an octal thing? Investigate.)
-	_, err = fmt.Fscanf(c, "%02x\n", &kexAlg)
 	if err != nil {
-		return Conn{}, err
+		logger.LogNotice(fmt.Sprintf("[Refused client %s: %s]", c.RemoteAddr(), err)) // nolint: gosec,errcheck
+		_ = c.Close()
+		return nil, err
 	}
-	log.Printf("[Client proposed KEx alg: %v]\n", kexAlg)
-	// --
-
-	ret, err := _new(kexAlg, &c)
-	if err != nil {
-		return Conn{}, err
+	log.Printf("[Client KEx alg: %v]\n", hc.kex)
+	hc.server = true
+	hc.kexT = t
+	hc.protoVersion, hc.features = protoVersion, features
+	if err = hc.acceptSetup(&tc); err != nil {
+		return nil, err
 	}
-	hc = *ret
 
-	switch hc.kex {
-	case KEX_HERRADURA256:
-		fallthrough
-	case KEX_HERRADURA512:
-		fallthrough
-	case KEX_HERRADURA1024:
-		fallthrough
-	case KEX_HERRADURA2048:
-		log.Printf("[Setting up for KEX_HERRADURA %d]\n", hc.kex)
-		if HKExAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_KYBER512:
-		fallthrough
-	case KEX_KYBER768:
-		fallthrough
-	case KEX_KYBER1024:
-		log.Printf("[Setting up for KEX_KYBER %d]\n", hc.kex)
-		if KyberAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_NEWHOPE:
-		log.Printf("[Setting up for KEX_NEWHOPE %d]\n", hc.kex)
-		if NewHopeAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_NEWHOPE_SIMPLE:
-		log.Printf("[Setting up for KEX_NEWHOPE_SIMPLE %d]\n", hc.kex)
-		if NewHopeSimpleAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_FRODOKEM_1344AES:
-		log.Printf("[Setting up for KEX_FRODOKEM_1344AES %d]\n", hc.kex)
-		if FrodoKEMAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_FRODOKEM_1344SHAKE:
-		log.Printf("[Setting up for KEX_FRODOKEM_1344SHAKE %d]\n", hc.kex)
-		if FrodoKEMAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_FRODOKEM_976AES:
-		log.Printf("[Setting up for KEX_FRODOKEM_976AES %d]\n", hc.kex)
-		if FrodoKEMAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	case KEX_FRODOKEM_976SHAKE:
-		log.Printf("[Setting up for KEX_FRODOKEM_976SHAKE %d]\n", hc.kex)
-		if FrodoKEMAcceptSetup(&c, &hc) != nil {
-			return Conn{}, err
-		}
-	default:
-		return Conn{}, err
+	// Prove our identity to the client by signing the KEx transcript
+	err = t.signHostKey(hl.hostKey)
+	if err != nil {
+		return nil, err
 	}
+	hc.kexT = nil
 
-	// Finally, ensure alg proposed by client is allowed by server config
-	//if hc.kex.String() {
 	log.Println("[hc.Accept successful]")
 	return
 }
 
 /*---------------------------------------------------------------------*/
 
+// AuthError is returned by Read() and Write() once a session has been
+// torn down because a frame failed authentication (HMAC mismatch, or
+// AEAD open failure): either the channel has been tampered with, or
+// frames were dropped, replayed or reordered.
+type AuthError struct {
+	Remote bool // the failure was detected, and reported, by the peer
+}
+
+func (e *AuthError) Error() string {
+	if e.Remote {
+		return "** ALERT - remote end detected HMAC mismatch - possible channel tampering **"
+	}
+	return "** ALERT - detected HMAC mismatch, possible channel tampering **"
+}
+
+var authFailures uint64
+
+// AuthFailures returns the number of sessions torn down (by this
+// process) due to frames failing authentication, whether detected
+// locally or reported by the peer.
+func AuthFailures() uint64 {
+	return atomic.LoadUint64(&authFailures)
+}
+
+// authFailed tears down the session after a frame failed authentication,
+// informing the peer (with a CSOHmacInvalid packet, framed and
+// authenticated as any other under our write keys, which are unaffected)
+// if the failure was detected locally. Any further Read() or Write()
+// returns the same *AuthError.
+//
+// Only the reader of hc calls authFailed().
+func (hc *Conn) authFailed(remote bool) error {
+	if err := hc.authError(); err != nil {
+		return err
+	}
+	if !remote {
+		_, _ = hc.WritePacket(nil, CSOHmacInvalid)
+	}
+	err := &AuthError{Remote: remote}
+	hc.Lock()
+	*hc.authErr = err
+	hc.Unlock()
+
+	atomic.AddUint64(&authFailures, 1)
+	logger.LogErr(fmt.Sprintf("[%s (peer %s)]", err, hc.RemoteAddr())) // nolint: gosec,errcheck
+	hc.DisableChaff()
+	_ = (*hc.c).Close()
+	return err
+}
+
+// authError returns the session's *AuthError, or nil.
+func (hc *Conn) authError() (err error) {
+	hc.Lock()
+	err = *hc.authErr
+	hc.Unlock()
+	return
+}
+
+// ErrFrameTooLarge is returned by Read() for a frame whose header gives
+// a payload length over MAX_PAYLOAD_LEN. The payload is not read, and
+// the session is closed.
+var ErrFrameTooLarge = errors.New("frame payload too large")
+
+// frameHdr returns the packet header fields which precede the payload
+// (ctrlStatOp, payloadLen), prefixed by the implicit frame sequence
+// number, as they are authenticated by the session hmac or AEAD cipher
+// so they cannot be altered in transit.
+func frameHdr(seq uint64, ctrlStatOp byte, payloadLen uint32) []byte {
+	hdr := make([]byte, 13)
+	binary.BigEndian.PutUint64(hdr, seq)
+	hdr[8] = ctrlStatOp
+	binary.BigEndian.PutUint32(hdr[9:], payloadLen)
+	return hdr
+}
+
 // Read into a byte slice
 //
 // In addition to regular io.Reader behaviour this does demultiplexing of
@@ -1182,17 +1344,20 @@ func (hl *HKExListener) Accept() (hc Conn, err error) {
 // packet processing.
 //
 // See go doc io.Reader
-func (hc Conn) Read(b []byte) (n int, err error) {
+func (hc *Conn) Read(b []byte) (n int, err error) {
 	for {
 		if hc.dBuf.Len() > 0 {
 			break
 		}
+		if err = hc.authError(); err != nil {
+			return 0, err
+		}
 
 		var ctrlStatOp uint8
 		var hmacIn [HMAC_CHK_SZ]uint8
 		var payloadLen uint32
 
-		// Read ctrl/status opcode (CSOHmacInvalid on hmac mismatch)
+		// Read ctrl/status opcode
 		err = binary.Read(*hc.c, binary.BigEndian, &ctrlStatOp)
 		if err != nil {
 			if err.Error() == "EOF" {
@@ -1207,14 +1372,11 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 			return 0, errors.New(etxt)
 		}
 		log.Printf("[ctrlStatOp: %v]\n", ctrlStatOp)
-		if ctrlStatOp == CSOHmacInvalid {
-			// Other side indicated channel tampering, close channel
-			hc.Close()
-			return 0, errors.New("** ALERT - remote end detected HMAC mismatch - possible channel tampering **")
-		}
 
-		// Read the hmac and payload len first
-		err = binary.Read(*hc.c, binary.BigEndian, &hmacIn)
+		// Read the hmac (if not using an AEAD cipher) and payload len first
+		if hc.r.a == nil {
+			err = binary.Read(*hc.c, binary.BigEndian, &hmacIn)
+		}
 		if err != nil {
 			if err.Error() == "EOF" {
 				return 0, io.EOF
@@ -1245,7 +1407,7 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 		if payloadLen > MAX_PAYLOAD_LEN {
 			logger.LogDebug(fmt.Sprintf("[Insane payloadLen:%v]\n", payloadLen))
 			hc.Close()
-			return 1, errors.New("Insane payloadLen")
+			return 0, ErrFrameTooLarge
 		}
 
 		var payloadBytes = make([]byte, payloadLen)
@@ -1268,24 +1430,39 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 		}
 		//fmt.Printf("  <:ctext:\r\n%s\r\n", hex.Dump(payloadBytes[:n]))
 
-		hc.rm.Write(payloadBytes) // Calc hmac on received data
-		hTmp := hc.rm.Sum(nil)[0:HMAC_CHK_SZ]
-		//log.Printf("<%04x) HMAC:(i)%s (c)%02x\r\n", decryptN, hex.EncodeToString([]byte(hmacIn[0:])), hTmp)
+		seq := hc.r.nextSeq()
+		hdr := frameHdr(seq, ctrlStatOp, payloadLen)
+		if hc.r.a != nil {
+			// AEAD ciphers authenticate the header (as additional data)
+			// and payload together, so there is nothing to decrypt on failure
+			payloadBytes, err = hc.r.a.aead.Open(payloadBytes[:0], hc.r.a.nonce(seq), payloadBytes[:n], hdr)
+			if err != nil {
+				return 0, hc.authFailed(false)
+			}
+			n = len(payloadBytes)
+		} else {
+			hc.r.m.Write(hdr) // Calc hmac on received header and data
+			hc.r.m.Write(payloadBytes)
+			hTmp := hc.r.m.Sum(nil)[0:HMAC_CHK_SZ]
+			//log.Printf("<%04x) HMAC:(i)%s (c)%02x\r\n", decryptN, hex.EncodeToString([]byte(hmacIn[0:])), hTmp)
+
+			// Log alert if hmac didn't match (corrupted channel, or a
+			// dropped, replayed or reordered frame); the frame is not
+			// decrypted and the session cannot continue
+			if !bytes.Equal(hTmp, []byte(hmacIn[0:])) /*|| hmacIn[0] > 0xf8*/ {
+				return 0, hc.authFailed(false)
+			}
 
-		// Log alert if hmac didn't match, corrupted channel
-		if !bytes.Equal(hTmp, []byte(hmacIn[0:])) /*|| hmacIn[0] > 0xf8*/ {
-			logger.LogDebug(fmt.Sprintln("** ALERT - detected HMAC mismatch, possible channel tampering **"))
-			_, _ = (*hc.c).Write([]byte{CSOHmacInvalid})
+			db := bytes.NewBuffer(payloadBytes[:n]) //copying payloadBytes to db
+			// The StreamReader acts like a pipe, decrypting
+			// whatever is available and forwarding the result
+			// to the parameter of Read() as a normal io.Reader
+			rs := &cipher.StreamReader{S: hc.r.s, R: db}
+			// The caller isn't necessarily reading the full payload so we need
+			// to decrypt to an intermediate buffer, draining it on demand of caller
+			_, err = rs.Read(payloadBytes)
 		}
-
-		db := bytes.NewBuffer(payloadBytes[:n]) //copying payloadBytes to db
-		// The StreamReader acts like a pipe, decrypting
-		// whatever is available and forwarding the result
-		// to the parameter of Read() as a normal io.Reader
-		rs := &cipher.StreamReader{S: hc.r, R: db}
-		// The caller isn't necessarily reading the full payload so we need
-		// to decrypt to an intermediate buffer, draining it on demand of caller
-		decryptN, err := rs.Read(payloadBytes)
+		decryptN := n
 
 		if hc.logPlainText {
 			log.Printf("  <:ptext:\r\n%s\r\n", hex.Dump(payloadBytes[:n]))
@@ -1295,6 +1472,11 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 			//panic(err)
 		} else {
 			// Padding: Read padSide, padLen, (padding | d) or (d | padding)
+			if len(payloadBytes) < 2 || len(payloadBytes) < 2+int(payloadBytes[1]) {
+				logger.LogDebug(fmt.Sprintf("[Malformed frame padding (len %d)]", len(payloadBytes)))
+				hc.Close()
+				return 0, errors.New("malformed frame padding")
+			}
 			padSide := payloadBytes[0]
 			padLen := payloadBytes[1]
 
@@ -1305,8 +1487,13 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 				payloadBytes = payloadBytes[0 : len(payloadBytes)-int(padLen)]
 			}
 
+			hc.rekeyCheck(int(payloadLen))
+
 			// Throw away pkt if it's chaff (ie., caller to Read() won't see this data)
-			if ctrlStatOp == CSOChaff {
+			if ctrlStatOp == CSOHmacInvalid {
+				// Other side indicated channel tampering, close channel
+				return 0, hc.authFailed(true)
+			} else if ctrlStatOp == CSOChaff {
 				log.Printf("[Chaff pkt, discarded (len %d)]\n", decryptN)
 			} else if ctrlStatOp == CSOTermSize {
 				fmt.Sscanf(string(payloadBytes), "%d %d", &hc.Rows, &hc.Cols)
@@ -1320,84 +1507,33 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 					hc.SetStatus(CSETruncCSO)
 				}
 				hc.Close()
-			} else if ctrlStatOp == CSOTunSetup {
-				// server side tunnel setup in response to client
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				if _, ok := (*hc.tuns)[rport]; !ok {
-					// tunnel first-time open
-					logger.LogDebug(fmt.Sprintf("[Server] Got Initial CSOTunSetup [%d:%d]", lport, rport))
-					hc.StartServerTunnel(lport, rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunSetup [%d:%d]", lport, rport))
-				}
-				(*hc.tuns)[rport].Ctl <- 'd' // Dial() rport
-			} else if ctrlStatOp == CSOTunSetupAck {
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				if _, ok := (*hc.tuns)[rport]; !ok {
-					// tunnel first-time open
-					logger.LogDebug(fmt.Sprintf("[Client] Got Initial CSOTunSetupAck [%d:%d]", lport, rport))
-					hc.StartClientTunnel(lport, rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunSetupAck [%d:%d]", lport, rport))
-				}
-				(*hc.tuns)[rport].Ctl <- 'a' // Listen() for lport connection
-			} else if ctrlStatOp == CSOTunRefused {
-				// client side receiving CSOTunRefused means the remote side
-				// could not dial() rport. So we cannot yet listen()
-				// for client-side on lport.
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunRefused [%d:%d]", lport, rport))
-				if _, ok := (*hc.tuns)[rport]; ok {
-					hc.MarkTunDead(rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Client] CSOTunRefused on already-closed tun [%d:%d]", lport, rport))
-				}
-			} else if ctrlStatOp == CSOTunDisconn {
-				// server side's rport has disconnected (server lost)
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunDisconn [%d:%d]", lport, rport))
-				if _, ok := (*hc.tuns)[rport]; ok {
-					hc.MarkTunDead(rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Client] CSOTunDisconn on already-closed tun [%d:%d]", lport, rport))
-				}
-			} else if ctrlStatOp == CSOTunHangup {
-				// client side's lport has hung up
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunHangup [%d:%d]", lport, rport))
-				if _, ok := (*hc.tuns)[rport]; ok {
-					hc.MarkTunDead(rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Server] CSOTunHangup to already-closed tun [%d:%d]", lport, rport))
-				}
-			} else if ctrlStatOp == CSOTunData {
-				lport := binary.BigEndian.Uint16(payloadBytes[0:2])
-				rport := binary.BigEndian.Uint16(payloadBytes[2:4])
-				//fmt.Printf("[Got CSOTunData: [lport %d:rport %d] data:%v\n", lport, rport, payloadBytes[4:])
-				if _, ok := (*hc.tuns)[rport]; ok {
-					if hc.logTunActivity {
-						logger.LogDebug(fmt.Sprintf("[Writing data to rport [%d:%d]", lport, rport))
-					}
-					(*hc.tuns)[rport].Data <- payloadBytes[4:]
-					hc.ResetTunnelAge(rport)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[Attempt to write data to closed tun [%d:%d]", lport, rport))
-				}
 			} else if ctrlStatOp == CSOTunKeepAlive {
 				// client side has sent keepalive for tunnels -- if client
 				// dies or exits unexpectedly the absence of this will
 				// let the server know to hang up on Dial()ed server rports.
 				_ = binary.BigEndian.Uint16(payloadBytes[0:2])
 				//logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunKeepAlive"))
+				hc.Lock()
 				for _, t := range *hc.tuns {
-					hc.Lock()
 					t.KeepAlive = 0
-					hc.Unlock()
+				}
+				hc.Unlock()
+			} else if (ctrlStatOp >= CSOTunSetup && ctrlStatOp <= CSOTunHangup) ||
+				ctrlStatOp == CSOTunRevSetup || ctrlStatOp == CSOTunRevAccept {
+				hc.gotTun(ctrlStatOp, payloadBytes)
+			} else if ctrlStatOp >= CSOTunDynSetup && ctrlStatOp <= CSOTunDynClose {
+				hc.gotDynTun(ctrlStatOp, payloadBytes)
+			} else if ctrlStatOp >= CSOTunUDPSetup && ctrlStatOp <= CSOTunUDPRefused {
+				hc.gotUDPTun(ctrlStatOp, payloadBytes)
+			} else if ctrlStatOp == CSOTunCredit {
+				hc.gotTunCredit(payloadBytes)
+			} else if ctrlStatOp == CSORekey {
+				hc.gotRekeyData(payloadBytes)
+			} else if ctrlStatOp == CSORekeyDone {
+				if err = hc.gotRekeyDone(); err != nil {
+					logger.LogErr(fmt.Sprintf("[Rekey failed: %s]", err)) // nolint: gosec,errcheck
+					hc.Close()
+					return 0, err
 				}
 			} else if ctrlStatOp == CSONone {
 				hc.dBuf.Write(payloadBytes)
@@ -1421,18 +1557,39 @@ func (hc Conn) Read(b []byte) (n int, err error) {
 // Write a byte slice
 //
 // See go doc io.Writer
-func (hc Conn) Write(b []byte) (n int, err error) {
+func (hc *Conn) Write(b []byte) (n int, err error) {
 	n, err = hc.WritePacket(b, CSONone)
 	return n, err
 }
 
 // Write a byte slice with specified ctrlStatOp byte
+//
+// Buffers longer than MAX_FRAG_LEN are sent as several frames, each
+// with the same ctrlStatOp. Only stream data (CSONone, and rekey KEx
+// messages) is reassembled by the peer, so other packet types must fit
+// in one frame.
 func (hc *Conn) WritePacket(b []byte, ctrlStatOp byte) (n int, err error) {
+	for len(b) > MAX_FRAG_LEN {
+		var fn int
+		// (cap is limited so padding can't overwrite the next fragment)
+		fn, err = hc.writeFrame(b[:MAX_FRAG_LEN:MAX_FRAG_LEN], ctrlStatOp)
+		n += fn
+		if err != nil {
+			return n, err
+		}
+		b = b[MAX_FRAG_LEN:]
+	}
+	fn, err := hc.writeFrame(b, ctrlStatOp)
+	return n + fn, err
+}
+
+// writeFrame writes a single frame of at most MAX_FRAG_LEN bytes.
+func (hc *Conn) writeFrame(b []byte, ctrlStatOp byte) (n int, err error) {
 	//log.Printf("[Encrypting...]\r\n")
 	var hmacOut []uint8
 	var payloadLen uint32
 
-	if hc.m == nil || hc.wm == nil {
+	if hc.m == nil || hc.w == nil {
 		return 0, errors.New("Secure chan not ready for writing")
 	}
 
@@ -1464,6 +1621,11 @@ func (hc *Conn) WritePacket(b []byte, ctrlStatOp byte) (n int, err error) {
 	// Would be nice to determine if the mutex scope
 	// could be tightened.
 	hc.Lock()
+	if *hc.authErr != nil {
+		err = *hc.authErr
+		hc.Unlock()
+		return 0, err
+	}
 	payloadLen = uint32(len(b))
 	if hc.logPlainText {
 		log.Printf("  >:ptext:\r\n%s\r\n", hex.Dump(b[0:payloadLen]))
@@ -1482,36 +1644,49 @@ func (hc *Conn) WritePacket(b []byte, ctrlStatOp byte) (n int, err error) {
 	// Encrypt-then-Auth and breaks interop with earlier versions.
 	// -rlm 2020-12-15
 
-	var wb bytes.Buffer
-	// The StreamWriter acts like a pipe, forwarding whatever is
-	// written to it through the cipher, encrypting as it goes
-	ws := &cipher.StreamWriter{S: hc.w, W: &wb}
-	wN, err := ws.Write(b[0:payloadLen])
-	if err != nil {
-		panic(err)
-	}
-	if wN < int(payloadLen) {
-		panic("truncated Write to cipher *****")
+	seq := hc.w.nextSeq()
+	var ct []byte
+	if hc.w.a != nil {
+		// AEAD ciphers authenticate the header (as additional data)
+		// and payload together; no separate hmac is sent
+		payloadLen += uint32(hc.w.a.aead.Overhead())
+		ct = hc.w.a.aead.Seal(nil, hc.w.a.nonce(seq), b, frameHdr(seq, ctrlStatOp, payloadLen))
+	} else {
+		var wb bytes.Buffer
+		// The StreamWriter acts like a pipe, forwarding whatever is
+		// written to it through the cipher, encrypting as it goes
+		ws := &cipher.StreamWriter{S: hc.w.s, W: &wb}
+		wN, err := ws.Write(b[0:payloadLen])
+		if err != nil {
+			panic(err)
+		}
+		if wN < int(payloadLen) {
+			panic("truncated Write to cipher *****")
+		}
+		ct = wb.Bytes()
+
+		// Calculate hmac on header and cipher payload
+		hc.w.m.Write(frameHdr(seq, ctrlStatOp, payloadLen))
+		hc.w.m.Write(ct)
+		hmacOut = hc.w.m.Sum(nil)[0:HMAC_CHK_SZ] //finalize
+		//log.Printf("  (%08x> HMAC(o):%s\r\n", payloadLen, hex.EncodeToString(hmacOut))
 	}
 
 	if hc.logCipherText {
-		log.Printf("  >:ctext:\r\n%s\r\n", hex.Dump(wb.Bytes()))
+		log.Printf("  >:ctext:\r\n%s\r\n", hex.Dump(ct))
 	}
-	//fmt.Printf("  >:ctext:\r\n%s\r\n", hex.Dump(wb.Bytes()))
-
-	// Calculate hmac on cipher payload
-	hc.wm.Write(wb.Bytes())
-	hmacOut = hc.wm.Sum(nil)[0:HMAC_CHK_SZ] //finalize
-	//log.Printf("  (%08x> HMAC(o):%s\r\n", payloadLen, hex.EncodeToString(hmacOut))
+	//fmt.Printf("  >:ctext:\r\n%s\r\n", hex.Dump(ct))
 
 	err = binary.Write(*hc.c, binary.BigEndian, &ctrlStatOp)
 	if err == nil {
 		// Write hmac LSB, payloadLen followed by payload
-		err = binary.Write(*hc.c, binary.BigEndian, hmacOut)
+		if hmacOut != nil {
+			err = binary.Write(*hc.c, binary.BigEndian, hmacOut)
+		}
 		if err == nil {
 			err = binary.Write(*hc.c, binary.BigEndian, payloadLen)
 			if err == nil {
-				n, err = (*hc.c).Write(wb.Bytes())
+				n, err = (*hc.c).Write(ct)
 			} else {
 				//fmt.Println("[c]WriteError!")
 			}
@@ -1521,15 +1696,21 @@ func (hc *Conn) WritePacket(b []byte, ctrlStatOp byte) (n int, err error) {
 	} else {
 		//fmt.Println("[a]WriteError!")
 	}
+	if err == nil && ctrlStatOp == CSORekeyDone {
+		// Packets from here on use the new keys
+		hc.sentRekeyDone()
+	}
 	hc.Unlock()
 
 	if err != nil {
 		log.Println(err)
+	} else {
+		hc.rekeyCheck(int(payloadLen))
 	}
 
 	// We must 'lie' to caller indicating the length of THEIR
 	// data written (ie., not including the padding and padding headers)
-	retN := n - 2 - int(padLen)
+	retN := n - 2 - int(padLen) - (len(ct) - len(b))
 	if retN <= 0 {
 		retN = 0
 	}
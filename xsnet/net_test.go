@@ -0,0 +1,444 @@
+package xsnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// _newMockConn returns a Conn over c with session keys set up from a
+// fixed secret (without performing a KEx), as for Dial() or Accept().
+func _newMockConn(t *testing.T, c net.Conn, server bool, copts uint32) *Conn {
+	hc, err := _new(KEX_HERRADURA256, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.server = server
+	hc.cipheropts = copts | KeySchedV1<<16
+	hc.kexT = newKexTranscript(c)
+	if err = hc.setupStreams(bytes.Repeat([]byte{0x5a}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	hc.kexT = nil
+	return hc
+}
+
+// _tamperRelay copies frames (with headers of hdrLen bytes) from src
+// to dst, flipping a bit of the byte at offset off within frame number
+// frame.
+func _tamperRelay(dst, src net.Conn, hdrLen, frame, off int) {
+	defer dst.Close() // nolint: errcheck
+	for i := 0; ; i++ {
+		hdr := make([]byte, hdrLen)
+		if _, err := io.ReadFull(src, hdr); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[hdrLen-4:]))
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return
+		}
+		f := append(hdr, payload...)
+		if i == frame {
+			f[off] ^= 0x10
+		}
+		if _, err := dst.Write(f); err != nil {
+			return
+		}
+	}
+}
+
+func TestReadTamperedFrameFails(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgBlowfish64 | HmacSHA512<<8,
+		CAlgChaCha20_12 | HmacSHA256<<8,
+		CAlgAES256GCM,
+		CAlgChaCha20Poly1305,
+	} {
+		hdrLen := 1 + HMAC_CHK_SZ + 4
+		if copts == CAlgAES256GCM || copts == CAlgChaCha20Poly1305 {
+			hdrLen = 1 + 4
+		}
+		msg := []byte("the quick brown fox jumps over the lazy dog")
+		// Flip a bit near the start or end of the first frame's
+		// payload, or in the second frame's payload
+		testTamperedFrame(t, copts, msg, hdrLen, 0, hdrLen+3)
+		testTamperedFrame(t, copts, msg, hdrLen, 0, hdrLen+len(msg))
+		testTamperedFrame(t, copts, msg, hdrLen, 1, hdrLen+3)
+	}
+}
+
+func testTamperedFrame(t *testing.T, copts uint32, msg []byte, hdrLen, frame, off int) {
+	before := AuthFailures()
+
+	cliEnd, cliRelay := net.Pipe()
+	srvRelay, srvEnd := net.Pipe()
+	cc := _newMockConn(t, cliEnd, false, copts)
+	sc := _newMockConn(t, srvEnd, true, copts)
+
+	go _tamperRelay(srvRelay, cliRelay, hdrLen, frame, off)
+	go func() {
+		_, _ = io.Copy(cliRelay, srvRelay)
+		_ = cliRelay.Close()
+	}()
+
+	got := make(chan []byte, 1)
+	gotErr := make(chan error, 1)
+	go func() {
+		var rcvd []byte
+		buf := make([]byte, 1024)
+		for {
+			n, err := sc.Read(buf)
+			rcvd = append(rcvd, buf[:n]...)
+			if err != nil {
+				got <- rcvd
+				gotErr <- err
+				return
+			}
+		}
+	}()
+
+	// (the server's notice is read as it is sent)
+	cliErr := make(chan error, 1)
+	go func() {
+		_, err := cc.Read(make([]byte, 1024))
+		cliErr <- err
+	}()
+
+	for i := 0; i <= frame; i++ {
+		_, _ = cc.WritePacket(msg, CSONone)
+	}
+
+	rcvd := <-got
+	err := <-gotErr
+	if ae, ok := err.(*AuthError); !ok || ae.Remote {
+		t.Fatalf("copts %x off %d: server Read() returned %v, want local *AuthError", copts, off, err)
+	}
+	if !bytes.Equal(rcvd, bytes.Repeat(msg, frame)) {
+		t.Fatalf("copts %x off %d: tampered data reached server: %q", copts, off, rcvd)
+	}
+	if _, err = sc.Write(msg); err != *sc.authErr {
+		t.Fatalf("copts %x off %d: server Write() after auth failure returned %v", copts, off, err)
+	}
+
+	// Client is told of the failure
+	err = <-cliErr
+	if ae, ok := err.(*AuthError); !ok || !ae.Remote {
+		t.Fatalf("copts %x off %d: client Read() returned %v, want remote *AuthError", copts, off, err)
+	}
+	if AuthFailures() != before+2 {
+		t.Fatalf("copts %x off %d: AuthFailures() = %d, want %d", copts, off, AuthFailures(), before+2)
+	}
+}
+
+// A bare CSOHmacInvalid byte, as anyone on path might inject ahead of
+// a frame, is not taken as the peer reporting an auth failure.
+func TestReadBareHmacInvalid(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgAES256GCM,
+	} {
+		cliEnd, cliRelay := net.Pipe()
+		srvRelay, srvEnd := net.Pipe()
+		cc := _newMockConn(t, cliEnd, false, copts)
+		sc := _newMockConn(t, srvEnd, true, copts)
+
+		go func() {
+			_, _ = srvRelay.Write([]byte{CSOHmacInvalid})
+			_, _ = io.Copy(srvRelay, cliRelay)
+		}()
+		go func() { _, _ = io.Copy(ioutil.Discard, srvRelay) }()
+		go func() { _, _ = cc.Write([]byte("the quick brown fox")) }()
+
+		_ = srvEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := sc.Read(make([]byte, 1024))
+		if ae, ok := err.(*AuthError); err == nil || ok && ae.Remote {
+			t.Fatalf("copts %x: server Read() returned %v", copts, err)
+		}
+		_ = cliEnd.Close()
+		_ = srvEnd.Close()
+	}
+}
+
+// _reorderRelay copies frames from src to dst as _tamperRelay does,
+// but with frame number frame replayed (sent twice), dropped, or
+// swapped with the next frame, according to how.
+func _reorderRelay(dst, src net.Conn, hdrLen, frame int, how string) {
+	defer dst.Close() // nolint: errcheck
+	var held []byte
+	for i := 0; ; i++ {
+		hdr := make([]byte, hdrLen)
+		if _, err := io.ReadFull(src, hdr); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr[hdrLen-4:]))
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return
+		}
+		fs := [][]byte{append(hdr, payload...)}
+		switch {
+		case i == frame && how == "replay":
+			fs = append(fs, fs[0])
+		case i == frame && how == "drop":
+			fs = nil
+		case i == frame && how == "swap":
+			held, fs = fs[0], nil
+		case i == frame+1 && how == "swap":
+			fs = append(fs, held)
+		}
+		for _, f := range fs {
+			if _, err := dst.Write(f); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestReadReorderedFrameFails(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgChaCha20_12 | HmacSHA256<<8,
+		CAlgAES256GCM,
+		CAlgChaCha20Poly1305,
+	} {
+		hdrLen := 1 + HMAC_CHK_SZ + 4
+		if copts == CAlgAES256GCM || copts == CAlgChaCha20Poly1305 {
+			hdrLen = 1 + 4
+		}
+		// Frame 1 is replayed (after itself), dropped or swapped with
+		// frame 2; frames up to the first out of place are read
+		testReorderedFrame(t, copts, hdrLen, "replay", "01")
+		testReorderedFrame(t, copts, hdrLen, "drop", "0")
+		testReorderedFrame(t, copts, hdrLen, "swap", "0")
+	}
+}
+
+// testReorderedFrame checks that the server of a session in which
+// frame 1 (of 3) is replayed, dropped or swapped with frame 2 reads
+// only want, then fails authentication.
+func testReorderedFrame(t *testing.T, copts uint32, hdrLen int, how, want string) {
+	cliEnd, cliRelay := net.Pipe()
+	srvRelay, srvEnd := net.Pipe()
+	cc := _newMockConn(t, cliEnd, false, copts)
+	sc := _newMockConn(t, srvEnd, true, copts)
+	defer cliEnd.Close() // nolint: errcheck
+
+	go _reorderRelay(srvRelay, cliRelay, hdrLen, 1, how)
+	go func() {
+		_, _ = io.Copy(cliRelay, srvRelay)
+		_ = cliRelay.Close()
+	}()
+	go func() { _, _ = io.Copy(ioutil.Discard, cliEnd) }()
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := cc.WritePacket([]byte{'0' + byte(i)}, CSONone); err != nil {
+				return
+			}
+		}
+	}()
+
+	var rcvd []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := sc.Read(buf)
+		rcvd = append(rcvd, buf[:n]...)
+		if err != nil {
+			if ae, ok := err.(*AuthError); !ok || ae.Remote {
+				t.Fatalf("copts %x %s: server Read() returned %v, want local *AuthError", copts, how, err)
+			}
+			break
+		}
+	}
+	if string(rcvd) != want {
+		t.Fatalf("copts %x %s: server read %q, want %q", copts, how, rcvd, want)
+	}
+}
+
+// _countConn counts the bytes read from it.
+type _countConn struct {
+	net.Conn
+	n int
+}
+
+func (c *_countConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.n += n
+	return
+}
+
+// A frame header giving an oversized payload length fails Read(),
+// which neither reads nor allocates room for the payload.
+func TestReadFrameTooLarge(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgAES256GCM,
+	} {
+		hdrLen := 1 + HMAC_CHK_SZ + 4
+		if copts == CAlgAES256GCM {
+			hdrLen = 1 + 4
+		}
+		for _, payloadLen := range []uint32{MAX_PAYLOAD_LEN + 1, 0xffffffff} {
+			cliEnd, srvEnd := net.Pipe()
+			cc := &_countConn{Conn: srvEnd}
+			sc := _newMockConn(t, cc, true, copts)
+			hdr := make([]byte, hdrLen)
+			binary.BigEndian.PutUint32(hdr[hdrLen-4:], payloadLen)
+			go func() { _, _ = cliEnd.Write(append(hdr, make([]byte, 1024)...)) }()
+			go func() { _, _ = io.Copy(ioutil.Discard, cliEnd) }()
+
+			var ms0, ms1 runtime.MemStats
+			runtime.ReadMemStats(&ms0)
+			n, err := sc.Read(make([]byte, 1024))
+			runtime.ReadMemStats(&ms1)
+			if n != 0 || err != ErrFrameTooLarge {
+				t.Fatalf("copts %x len %d: Read() returned %d, %v", copts, payloadLen, n, err)
+			}
+			if cc.n != hdrLen {
+				t.Fatalf("copts %x len %d: read %d bytes, want the %d byte header", copts, payloadLen, cc.n, hdrLen)
+			}
+			if a := ms1.TotalAlloc - ms0.TotalAlloc; a >= MAX_PAYLOAD_LEN {
+				t.Fatalf("copts %x len %d: Read() allocated %d bytes", copts, payloadLen, a)
+			}
+			_ = cliEnd.Close()
+		}
+	}
+}
+
+// _writeRawFrame writes plaintext p to c as hc would a frame of type
+// op, but without padding (so p must hold its own, if any).
+func _writeRawFrame(hc *Conn, c net.Conn, op byte, p []byte) error {
+	seq := hc.w.nextSeq()
+	var f []byte
+	if hc.w.a != nil {
+		payloadLen := uint32(len(p) + hc.w.a.aead.Overhead())
+		ct := hc.w.a.aead.Seal(nil, hc.w.a.nonce(seq), p, frameHdr(seq, op, payloadLen))
+		f = append(frameHdr(seq, op, payloadLen)[8:], ct...)
+	} else {
+		ct := make([]byte, len(p))
+		hc.w.s.XORKeyStream(ct, p)
+		hdr := frameHdr(seq, op, uint32(len(p)))
+		hc.w.m.Write(hdr)
+		hc.w.m.Write(ct)
+		f = append([]byte{op}, hc.w.m.Sum(nil)[0:HMAC_CHK_SZ]...)
+		f = append(append(f, hdr[9:]...), ct...)
+	}
+	_, err := c.Write(f)
+	return err
+}
+
+// An authenticated frame too short for its padding header fails Read()
+// rather than panicking.
+func TestReadShortFrame(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgAES256GCM,
+	} {
+		for _, p := range [][]byte{{}, {0}, {0, 5, 'x'}, {1, 200, 'x', 'y'}} {
+			cliEnd, srvEnd := net.Pipe()
+			cc := _newMockConn(t, cliEnd, false, copts)
+			sc := _newMockConn(t, srvEnd, true, copts)
+			go func() {
+				_ = _writeRawFrame(cc, cliEnd, CSONone, p)
+				_, _ = io.Copy(ioutil.Discard, cliEnd)
+			}()
+			if _, err := sc.Read(make([]byte, 1024)); err == nil || err.Error() != "malformed frame padding" {
+				t.Fatalf("copts %x frame %v: Read() returned %v", copts, p, err)
+			}
+			_ = cliEnd.Close()
+		}
+	}
+}
+
+// Writes longer than MAX_FRAG_LEN are split into several frames, and
+// arrive intact and in order.
+func TestWriteFragmented(t *testing.T) {
+	for _, copts := range []uint32{
+		CAlgAES256 | HmacSHA256<<8,
+		CAlgAES256GCM,
+	} {
+		cliEnd, srvEnd := net.Pipe()
+		cc := _newMockConn(t, cliEnd, false, copts)
+		sc := _newMockConn(t, srvEnd, true, copts)
+
+		// (each fragment's bytes differ, so any out of order show)
+		msg := make([]byte, 3*MAX_FRAG_LEN+123)
+		for i := range msg {
+			msg[i] = byte(i/MAX_FRAG_LEN*37) ^ byte(i)
+		}
+		wrote := make(chan error, 1)
+		go func() {
+			n, err := cc.Write(msg)
+			if err == nil && n != len(msg) {
+				err = io.ErrShortWrite
+			}
+			wrote <- err
+		}()
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(sc, got); err != nil {
+			t.Fatalf("copts %x: %v", copts, err)
+		}
+		if err := <-wrote; err != nil {
+			t.Fatalf("copts %x: %v", copts, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("copts %x: fragmented write garbled", copts)
+		}
+		_ = cliEnd.Close()
+		_ = srvEnd.Close()
+	}
+}
+
+// A client's truncated or malformed KEx messages fail the server side
+// of the KEx with an error, rather than a panic.
+func TestAcceptSetupMalformed(t *testing.T) {
+	for _, kex := range []KEXAlg{
+		KEX_HERRADURA256, KEX_KYBER768, KEX_NEWHOPE, KEX_NEWHOPE_SIMPLE,
+		KEX_FRODOKEM_976AES, KEX_X25519_KYBER768, KEX_X25519_FRODOKEM_976AES,
+	} {
+		msgs := []string{"", "junk\n"}
+		if kex != KEX_HERRADURA256 {
+			// (a short public key or cipher text; to Herradura,
+			// whose KEx is just this one value, a valid one)
+			msgs = append(msgs, "0x01\n")
+		}
+		k, _ := lookupKEX(kex)
+		for _, msg := range msgs {
+			c := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(msg), ioutil.Discard}
+			if _, err := k.AcceptSetup(c, &Conn{kex: kex}); err == nil {
+				t.Fatalf("%s: message %q accepted", k.Name(), msg)
+			}
+		}
+	}
+}
+
+// Likewise a server's malformed KEx messages fail the client side.
+func TestDialSetupMalformed(t *testing.T) {
+	for _, kex := range []KEXAlg{
+		KEX_HERRADURA256, KEX_KYBER768, KEX_NEWHOPE, KEX_NEWHOPE_SIMPLE,
+		KEX_FRODOKEM_976AES, KEX_X25519_KYBER768, KEX_X25519_FRODOKEM_976AES,
+	} {
+		msgs := []string{"", "junk\n"}
+		if kex != KEX_HERRADURA256 {
+			msgs = append(msgs, "0x01\n")
+		}
+		k, _ := lookupKEX(kex)
+		for _, msg := range msgs {
+			c := struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(msg), ioutil.Discard}
+			if _, err := k.DialSetup(c, &Conn{kex: kex}); err == nil {
+				t.Fatalf("%s: message %q accepted", k.Name(), msg)
+			}
+		}
+	}
+}
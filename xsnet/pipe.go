@@ -0,0 +1,146 @@
+// pipe.go - in-memory transport
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// The "pipe" transport connects a Dial() to a Listen() in the same
+// process without using the network. Addresses are arbitrary names.
+// It is intended for tests.
+//
+// Unlike a bare net.Pipe(), writes are buffered as they would be by a
+// network stack, since some KEx algs send several messages before
+// reading the peer's.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type pipeListener struct {
+	addr   pipeAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("pipe %s: listener closed", l.addr)
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		pipeMu.Lock()
+		delete(pipeListeners, l.addr)
+		pipeMu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return l.addr }
+
+var (
+	pipeMu        sync.Mutex
+	pipeListeners = make(map[pipeAddr]*pipeListener)
+)
+
+// pipeChunks is the most writes (of up to 32KiB each) buffered in
+// each direction of a pipe before a writer blocks.
+const pipeChunks = 1024
+
+// bufferedPipe returns the ends of a buffered, full-duplex pipe.
+func bufferedPipe() (a, b net.Conn) {
+	a, ra := net.Pipe()
+	rb, b := net.Pipe()
+	go pipePump(rb, ra)
+	go pipePump(ra, rb)
+	return
+}
+
+// pipePump copies from src to dst, buffering, until either fails.
+func pipePump(dst, src net.Conn) {
+	q := make(chan []byte, pipeChunks)
+	go func() {
+		for b := range q {
+			if _, err := dst.Write(b); err != nil {
+				break
+			}
+		}
+		_ = dst.Close()
+		_ = src.Close()
+		for range q {
+		}
+	}()
+	for {
+		b := make([]byte, 32*1024)
+		n, err := src.Read(b)
+		if n > 0 {
+			q <- b[:n]
+		}
+		if err != nil {
+			close(q)
+			return
+		}
+	}
+}
+
+type pipeTransport struct{}
+
+func (pipeTransport) Name() string { return "pipe" }
+
+func (pipeTransport) Dial(ctx context.Context, addr string, cfg *Config) (c net.Conn, err error) {
+	pipeMu.Lock()
+	l, ok := pipeListeners[pipeAddr(addr)]
+	pipeMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("pipe %s: connection refused", addr)
+	}
+	c, s := bufferedPipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.closed:
+		err = fmt.Errorf("pipe %s: connection refused", addr)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = c.Close()
+	_ = s.Close()
+	return nil, err
+}
+
+func (pipeTransport) Listen(addr string, cfg *Config) (net.Listener, error) {
+	pipeMu.Lock()
+	defer pipeMu.Unlock()
+	if _, ok := pipeListeners[pipeAddr(addr)]; ok {
+		return nil, fmt.Errorf("pipe %s: address in use", addr)
+	}
+	l := &pipeListener{addr: pipeAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{})}
+	pipeListeners[l.addr] = l
+	return l, nil
+}
+
+func init() {
+	if err := RegisterTransport(pipeTransport{}); err != nil {
+		panic(err)
+	}
+}
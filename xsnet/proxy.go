@@ -0,0 +1,341 @@
+// proxy.go - dialing through HTTP CONNECT and SOCKS5 proxies
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Clients of the TCP and WebSocket transports may reach the server
+// through a proxy, given by URL in Config.Proxy or else by the
+// environment:
+//
+//   http://[user:password@]host[:port]    HTTP CONNECT (default port 80)
+//   socks5://[user:password@]host[:port]  SOCKS5 (default port 1080)
+//
+// ("socks5h" is accepted as a synonym of "socks5": names are always
+// resolved by the proxy.) A proxy URL without a scheme is taken as
+// HTTP, and Config.Proxy "direct" disables any proxy from the
+// environment.
+//
+// From the environment $HTTPS_PROXY is used for tcp and wss, and
+// $HTTP_PROXY for ws, falling back to $ALL_PROXY (or the lower case
+// names of each) unless the server matches $NO_PROXY, a comma-separated
+// list of host names, domain suffixes (".example.com" or
+// "example.com") and IP addresses or CIDR ranges; "*" matches all.
+//
+// The proxy just relays the stream: the KEx and session run end to
+// end over it as they would over a direct connection.
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getenvAny returns the value of the first of the given environment
+// variables, or their lower case names, which is set.
+func getenvAny(names ...string) string {
+	for _, n := range names {
+		for _, k := range []string{n, strings.ToLower(n)} {
+			if v := os.Getenv(k); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// proxied reports whether the transport named t may dial through a
+// proxy (so whether Config.Proxy applies to it).
+func proxied(t string) bool {
+	switch t {
+	case "tcp", "tcp4", "tcp6", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// noProxy reports whether $NO_PROXY says to connect to host directly.
+func noProxy(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, p := range strings.Split(getenvAny("NO_PROXY"), ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(p); err == nil {
+			p = h
+		}
+		if ip != nil {
+			if _, n, err := net.ParseCIDR(p); err == nil && n.Contains(ip) {
+				return true
+			}
+			if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		p = strings.TrimPrefix(p, ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyURL returns the proxy, if any, through which cfg says to dial
+// addr (host:port); env are the environment variables to consult, in
+// order, if cfg doesn't give one.
+func (cfg *Config) proxyURL(addr string, env ...string) (*url.URL, error) {
+	s := cfg.Proxy
+	if s == "direct" {
+		return nil, nil
+	}
+	if s == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if s = getenvAny(env...); s == "" || noProxy(host) {
+			return nil, nil
+		}
+	}
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("bad proxy URL %q: no host", s)
+	}
+	return u, nil
+}
+
+// dialProxy connects to addr (host:port) through the proxy u.
+func dialProxy(ctx context.Context, u *url.URL, addr string) (c net.Conn, err error) {
+	paddr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "http" {
+			paddr = net.JoinHostPort(u.Hostname(), "80")
+		} else {
+			paddr = net.JoinHostPort(u.Hostname(), "1080")
+		}
+	}
+	var d net.Dialer
+	if c, err = d.DialContext(ctx, "tcp", paddr); err != nil {
+		return nil, err
+	}
+	// The handshake is bounded by ctx as the dial was
+	if dl, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(dl)
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Unix(1, 0)) // abort handshake I/O
+		case <-done:
+		}
+	}()
+	if u.Scheme == "http" {
+		c, err = httpConnect(c, u, addr)
+	} else {
+		err = socks5Connect(c, u, addr)
+	}
+	close(done)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	_ = c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// bufConn is a net.Conn whose first reads come from a bufio.Reader
+// which may have read ahead.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// httpConnect asks HTTP proxy u on c to connect to addr.
+func httpConnect(c net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header)}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p)))
+	}
+	if err := req.Write(c); err != nil {
+		return c, err
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return c, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufConn{c, r}, nil
+	}
+	return c, nil
+}
+
+// SOCKS5 (RFC 1928, RFC 1929) protocol values
+const (
+	socks5Version    = 5
+	socks5AuthNone   = 0
+	socks5AuthPasswd = 2
+	socks5CmdConnect = 1
+	socks5IPv4       = 1
+	socks5Domain     = 3
+	socks5IPv6       = 4
+)
+
+var socks5Errors = []string{"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported"}
+
+// socks5Connect asks SOCKS5 proxy u on c to connect to addr.
+func socks5Connect(c net.Conn, u *url.URL, addr string) error {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %q", sport)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if u.User != nil {
+		methods = append(methods, socks5AuthPasswd)
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err = c.Write(b); err != nil {
+		return err
+	}
+	b = make([]byte, 2)
+	if _, err = io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch b[1] {
+	case socks5AuthNone:
+	case socks5AuthPasswd:
+		if u.User == nil {
+			return errors.New("SOCKS5 proxy wants a password")
+		}
+		user := u.User.Username()
+		passwd, _ := u.User.Password()
+		if len(user) > 255 || len(passwd) > 255 {
+			return errors.New("SOCKS5 user name or password too long")
+		}
+		b = append([]byte{1, byte(len(user))}, user...)
+		b = append(append(b, byte(len(passwd))), passwd...)
+		if _, err = c.Write(b); err != nil {
+			return err
+		}
+		b = make([]byte, 2)
+		if _, err = io.ReadFull(c, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	default:
+		return errors.New("no acceptable SOCKS5 authentication method")
+	}
+
+	b = []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		b = append(append(b, socks5Domain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5IPv4), ip4...)
+	} else {
+		b = append(append(b, socks5IPv6), ip...)
+	}
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(port))
+	if _, err = c.Write(b); err != nil {
+		return err
+	}
+
+	// Reply: ver rep rsv atyp bnd.addr bnd.port
+	b = make([]byte, 4)
+	if _, err = io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[1] != 0 {
+		if int(b[1]) < len(socks5Errors) {
+			return fmt.Errorf("SOCKS5 connect %s: %s", addr, socks5Errors[b[1]])
+		}
+		return fmt.Errorf("SOCKS5 connect %s: error %d", addr, b[1])
+	}
+	var n int
+	switch b[3] {
+	case socks5IPv4:
+		n = net.IPv4len
+	case socks5IPv6:
+		n = net.IPv6len
+	case socks5Domain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(c, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("SOCKS5 reply: bad address type %d", b[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
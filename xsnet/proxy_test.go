@@ -0,0 +1,279 @@
+package xsnet
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testProxy is a minimal HTTP CONNECT or SOCKS5 proxy, requiring the
+// given user and password if user is set.
+type testProxy struct {
+	l            net.Listener
+	socks        bool
+	user, passwd string
+	used         chan string // targets connected to
+}
+
+func newTestProxy(t *testing.T, socks bool, user, passwd string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProxy{l: l, socks: socks, user: user, passwd: passwd,
+		used: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(c)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) serve(c net.Conn) {
+	defer c.Close() // nolint: errcheck
+	r := bufio.NewReader(c)
+	var target string
+	if p.socks {
+		target = p.socks5(r, c)
+	} else {
+		target = p.connect(r, c)
+	}
+	if target == "" {
+		return
+	}
+	s, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer s.Close() // nolint: errcheck
+	p.used <- target
+	if p.socks {
+		_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	} else {
+		_, _ = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+	go func() { _, _ = io.Copy(s, r) }()
+	_, _ = io.Copy(c, s)
+}
+
+func (p *testProxy) connect(r *bufio.Reader, c net.Conn) string {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return ""
+	}
+	if p.user != "" && req.Header.Get("Proxy-Authorization") != "Basic "+
+		base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.passwd)) {
+		_, _ = c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return ""
+	}
+	return req.Host
+}
+
+func (p *testProxy) socks5(r *bufio.Reader, c net.Conn) string {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil || b[0] != 5 {
+		return ""
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return ""
+	}
+	if p.user == "" {
+		_, _ = c.Write([]byte{5, 0})
+	} else {
+		_, _ = c.Write([]byte{5, 2})
+		// ver ulen user plen passwd
+		if _, err := io.ReadFull(r, b); err != nil {
+			return ""
+		}
+		user := make([]byte, b[1])
+		_, _ = io.ReadFull(r, user)
+		plen, _ := r.ReadByte()
+		passwd := make([]byte, plen)
+		_, _ = io.ReadFull(r, passwd)
+		if string(user) != p.user || string(passwd) != p.passwd {
+			_, _ = c.Write([]byte{1, 1})
+			return ""
+		}
+		_, _ = c.Write([]byte{1, 0})
+	}
+	hdr := make([]byte, 4) // ver cmd rsv atyp
+	if _, err := io.ReadFull(r, hdr); err != nil || hdr[1] != 1 {
+		return ""
+	}
+	var host string
+	switch hdr[3] {
+	case 1:
+		a := make([]byte, 4)
+		_, _ = io.ReadFull(r, a)
+		host = net.IP(a).String()
+	case 3:
+		n, _ := r.ReadByte()
+		a := make([]byte, n)
+		_, _ = io.ReadFull(r, a)
+		host = string(a)
+	default:
+		_, _ = c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return ""
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+func (p *testProxy) url() string {
+	u := "http://"
+	if p.socks {
+		u = "socks5://"
+	}
+	if p.user != "" {
+		u += p.user + ":" + p.passwd + "@"
+	}
+	return u + p.l.Addr().String()
+}
+
+// setenv sets environment variables, returning a func to restore them.
+func setenv(kv ...string) func() {
+	var undo []func()
+	for i := 0; i < len(kv); i += 2 {
+		k := kv[i]
+		if v, ok := os.LookupEnv(k); ok {
+			undo = append(undo, func() { _ = os.Setenv(k, v) })
+		} else {
+			undo = append(undo, func() { _ = os.Unsetenv(k) })
+		}
+		_ = os.Setenv(k, kv[i+1])
+	}
+	return func() {
+		for _, f := range undo {
+			f()
+		}
+	}
+}
+
+// An xsnet connection (KEx and all) runs over each kind of proxy.
+func TestDialProxy(t *testing.T) {
+	defer setenv("HTTPS_PROXY", "", "ALL_PROXY", "", "NO_PROXY", "")()
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(c, c) }()
+		}
+	}()
+
+	for _, p := range []*testProxy{
+		newTestProxy(t, false, "", ""),
+		newTestProxy(t, false, "joe", "s3cret"),
+		newTestProxy(t, true, "", ""),
+		newTestProxy(t, true, "joe", "s3cret"),
+	} {
+		cfg := &Config{Proxy: p.url(), KEX: []KEXAlg{KEX_HERRADURA256}}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c, err := DialContext(ctx, l.Addr().String(), cfg)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", p.url(), err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		go func() { _, _ = c.Write([]byte("hello world")) }()
+		b := make([]byte, 11)
+		if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello world" {
+			t.Fatalf("%s: got %q, %v", p.url(), b, err)
+		}
+		_ = c.Close()
+		select {
+		case <-p.used:
+		default:
+			t.Fatalf("%s: proxy not used", p.url())
+		}
+
+		if p.user != "" {
+			bad := *p
+			bad.passwd = "wrong"
+			cfg.Proxy = bad.url()
+			if _, err = DialContext(context.Background(), l.Addr().String(), cfg); err == nil {
+				t.Fatalf("%s: bad password accepted", cfg.Proxy)
+			}
+		}
+		_ = p.l.Close()
+	}
+}
+
+// Without Config.Proxy, $ALL_PROXY and $NO_PROXY are honoured.
+func TestProxyFromEnv(t *testing.T) {
+	p := newTestProxy(t, true, "", "")
+	defer p.l.Close() // nolint: errcheck
+	defer setenv("HTTPS_PROXY", "", "ALL_PROXY", p.url(), "NO_PROXY", "")()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	dial := func(cfg *Config) (proxied bool) {
+		c, err := netTransport("tcp").Dial(context.Background(), l.Addr().String(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+		select {
+		case <-p.used:
+			return true
+		default:
+			return false
+		}
+	}
+	if !dial(&Config{}) {
+		t.Fatal("$ALL_PROXY not used")
+	}
+	if dial(&Config{Proxy: "direct"}) {
+		t.Fatal("proxy used despite Config.Proxy \"direct\"")
+	}
+	_ = os.Setenv("NO_PROXY", "example.com,127.0.0.0/8")
+	if dial(&Config{}) {
+		t.Fatal("proxy used despite $NO_PROXY")
+	}
+}
+
+// Proxy settings are only checked for transports which use them.
+func TestProxyValidate(t *testing.T) {
+	for _, tr := range []string{"tcp", "tcp4", "ws", "wss", "unix", "kcp", "pipe"} {
+		cfg := &Config{Transport: tr, KCPAlg: KCP_AES, Proxy: "ftp://proxy.example.com"}
+		if err := cfg.validate(); (err == nil) == proxied(tr) {
+			t.Fatalf("%s: bad proxy URL gave %v", tr, err)
+		}
+	}
+}
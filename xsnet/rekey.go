@@ -0,0 +1,261 @@
+// rekey.go - periodic session rekeying
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Once a session has transferred a configured number of bytes, or has
+// been open for a configured time, the client starts a rekey: the
+// negotiated KEx is performed again, its messages carried in CSORekey
+// packets inside the existing encrypted channel, using a shadow copy
+// of the Conn to derive new keys. Meanwhile other traffic (shells,
+// tunnels, file copies) continues under the old keys.
+//
+// Once each side has its new keys it sends a CSORekeyDone packet,
+// which is the last packet it sends under the old keys; on receipt of
+// the peer's CSORekeyDone the read keys are likewise switched. Both
+// switches happen at a packet boundary, so no data is lost.
+//
+// Rekeying is only checked for as packets are sent or received, so an
+// idle session (which is not using its keys) is not rekeyed until it
+// becomes active again.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"blitter.com/go/xs/logger"
+)
+
+const (
+	// RekeyBytesDefault is the default number of bytes (sent and
+	// received) after which a session is rekeyed.
+	RekeyBytesDefault = 1 << 30
+	// RekeyIntervalDefault is the default time after which a session
+	// is rekeyed.
+	RekeyIntervalDefault = time.Hour
+
+	// 64-bit block ciphers are always rekeyed after this many bytes
+	rekeyBytes64 = 1 << 26
+
+	// a rekey which stalls for this long is abandoned
+	rekeyTimeout = 30 * time.Second
+)
+
+// rekeyState is shared by all copies of a Conn.
+type rekeyState struct {
+	sync.Mutex
+	maxBytes uint64        // rekey after this many bytes (0: never)
+	maxAge   time.Duration // rekey after this long (0: never)
+	bytes    uint64        // bytes since last (re)key
+	start    time.Time     // time of last (re)key
+
+	active   bool
+	in       chan []byte   // CSORekey payloads from peer
+	ready    chan struct{} // closed once r, w (or err) are set
+	r, w     *dirKeys      // new keys, pending switch
+	err      error
+	sentDone bool
+	gotDone  bool
+}
+
+func newRekeyState() *rekeyState {
+	return &rekeyState{maxBytes: RekeyBytesDefault,
+		maxAge: RekeyIntervalDefault,
+		start:  time.Now()}
+}
+
+// SetupRekey sets the number of bytes (sent and received) and the time
+// after which the session is rekeyed. Zero disables either trigger.
+// Rekeying is initiated by the client side; see also RekeyBytesDefault
+// and RekeyIntervalDefault.
+func (hc *Conn) SetupRekey(bytes uint64, interval time.Duration) {
+	hc.rk.Lock()
+	hc.rk.maxBytes = bytes
+	hc.rk.maxAge = interval
+	hc.rk.Unlock()
+}
+
+// begin marks a rekey as in progress, returning false if one already is.
+func (rk *rekeyState) begin() bool {
+	rk.Lock()
+	defer rk.Unlock()
+	if rk.active {
+		return false
+	}
+	rk.active = true
+	rk.in = make(chan []byte, 16)
+	rk.ready = make(chan struct{})
+	rk.r, rk.w, rk.err = nil, nil, nil
+	rk.sentDone, rk.gotDone = false, false
+	return true
+}
+
+// keysReady records the new keys (or the failure to get them).
+func (rk *rekeyState) keysReady(r, w *dirKeys, err error) {
+	rk.Lock()
+	rk.r, rk.w, rk.err = r, w, err
+	rk.Unlock()
+	close(rk.ready)
+}
+
+// done records the switch of write (sent) or read keys; once both have
+// switched the rekey is complete.
+func (rk *rekeyState) done(sent bool) {
+	rk.Lock()
+	defer rk.Unlock()
+	if sent {
+		rk.sentDone = true
+	} else {
+		rk.gotDone = true
+	}
+	if rk.sentDone && rk.gotDone {
+		rk.active = false
+		rk.in = nil
+		rk.bytes = 0
+		rk.start = time.Now()
+		log.Println("[Rekey complete]")
+	}
+}
+
+// rekeyCheck counts n bytes sent or received and, on the client, starts
+// a rekey if one is due.
+func (hc *Conn) rekeyCheck(n int) {
+	c, _ := lookupCipher(hc.CAlg())
+	sc, _ := c.(StreamCipher)
+
+	rk := hc.rk
+	rk.Lock()
+	rk.bytes += uint64(n)
+	limit := rk.maxBytes
+	if sc != nil && sc.BlockSize() > 0 && sc.BlockSize() <= 8 && (limit == 0 || limit > rekeyBytes64) {
+		limit = rekeyBytes64
+	}
+	due := !rk.active && ((limit > 0 && rk.bytes >= limit) ||
+		(rk.maxAge > 0 && time.Since(rk.start) >= rk.maxAge))
+	rk.Unlock()
+
+	if due && !hc.server && hc.features&FeatRekey != 0 && rk.begin() {
+		go hc.rekey()
+	}
+}
+
+// rekey performs (client side) a new KEx inside the session, then
+// switches to the new write keys.
+func (hc *Conn) rekey() {
+	log.Println("[Rekey started]")
+	shadow := hc.rekeyShadow()
+	err := shadow.dialSetup(shadow.kexT)
+	hc.rk.keysReady(shadow.r, shadow.w, err)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("[Rekey failed: %s]", err)) // nolint: gosec,errcheck
+		_ = hc.Close()
+		return
+	}
+	_, _ = hc.WritePacket(nil, CSORekeyDone)
+}
+
+// acceptRekey performs (server side) a new KEx inside the session, then
+// switches to the new write keys.
+func (hc *Conn) acceptRekey() {
+	log.Println("[Rekey started by client]")
+	shadow := hc.rekeyShadow()
+	var c net.Conn = shadow.kexT
+	err := shadow.acceptSetup(&c)
+	hc.rk.keysReady(shadow.r, shadow.w, err)
+	if err != nil {
+		logger.LogErr(fmt.Sprintf("[Rekey failed: %s]", err)) // nolint: gosec,errcheck
+		_ = hc.Close()
+		return
+	}
+	_, _ = hc.WritePacket(nil, CSORekeyDone)
+}
+
+// rekeyShadow returns a Conn sharing hc's KEx parameters on which to
+// perform the rekey KEx, so that the new keys can be derived without
+// disturbing hc.
+func (hc *Conn) rekeyShadow() *Conn {
+	hc.rk.Lock()
+	in := hc.rk.in
+	hc.rk.Unlock()
+	return &Conn{kex: hc.kex,
+		c:          hc.c,
+		cipheropts: hc.cipheropts,
+		opts:       hc.opts,
+		server:     hc.server,
+		kexT:       newKexTranscript(&rekeyConn{Conn: *hc.c, hc: hc, in: in})}
+}
+
+// gotRekeyData handles (in Read()) a CSORekey packet from the peer.
+func (hc *Conn) gotRekeyData(payload []byte) {
+	if hc.server && hc.rk.begin() {
+		go hc.acceptRekey()
+	}
+	hc.rk.Lock()
+	in := hc.rk.in
+	hc.rk.Unlock()
+	if in == nil {
+		logger.LogDebug("[Unexpected CSORekey packet, discarded]") // nolint: gosec,errcheck
+		return
+	}
+	in <- payload
+}
+
+// gotRekeyDone handles (in Read()) a CSORekeyDone packet from the peer,
+// switching to the new read keys once they are ready.
+func (hc *Conn) gotRekeyDone() (err error) {
+	hc.rk.Lock()
+	active, ready := hc.rk.active, hc.rk.ready
+	hc.rk.Unlock()
+	if !active {
+		return errors.New("unexpected CSORekeyDone")
+	}
+	<-ready
+	if hc.rk.err != nil {
+		return hc.rk.err
+	}
+	*hc.r = *hc.rk.r
+	hc.rk.done(false)
+	return nil
+}
+
+// sentRekeyDone switches to the new write keys, just after the
+// CSORekeyDone packet has been written (with hc locked).
+func (hc *Conn) sentRekeyDone() {
+	*hc.w = *hc.rk.w
+	hc.rk.done(true)
+}
+
+// rekeyConn carries KEx messages during a rekey, as CSORekey packets
+// within the session. It otherwise acts as the underlying net.Conn.
+type rekeyConn struct {
+	net.Conn
+	hc  *Conn
+	in  chan []byte
+	buf []byte
+}
+
+func (rc *rekeyConn) Read(b []byte) (n int, err error) {
+	if len(rc.buf) == 0 {
+		select {
+		case rc.buf = <-rc.in:
+		case <-time.After(rekeyTimeout):
+			return 0, errors.New("rekey timed out")
+		}
+	}
+	n = copy(b, rc.buf)
+	rc.buf = rc.buf[n:]
+	return n, nil
+}
+
+func (rc *rekeyConn) Write(b []byte) (n int, err error) {
+	return rc.hc.WritePacket(b, CSORekey)
+}
@@ -0,0 +1,144 @@
+package xsnet
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// _sessionPair returns the client and server ends of a pipe session,
+// the client dialled with extensions exts.
+func _sessionPair(t *testing.T, name string, exts ...string) (cc, sc *Conn) {
+	l, err := Listen("pipe", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := make(chan *Conn, 1)
+	go func() {
+		s, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			acc <- nil
+			return
+		}
+		acc <- s.(*Conn)
+	}()
+	if cc, err = Dial("pipe", name, exts...); err != nil {
+		t.Fatal(err)
+	}
+	if sc = <-acc; sc == nil {
+		t.Fatal("accept failed")
+	}
+	return
+}
+
+// _keysOf returns copies of hc's read and write keys.
+func _keysOf(hc *Conn) (r, w dirKeys) {
+	hc.Lock()
+	defer hc.Unlock()
+	return *hc.r, *hc.w
+}
+
+// _sameKeys reports whether a and b are the same keys.
+func _sameKeys(a, b dirKeys) bool {
+	return a.s == b.s && a.a == b.a
+}
+
+// Sessions rekeyed by bytes or by time carry data both ways across the
+// rekey, after which frames under the old keys fail authentication.
+func TestRekey(t *testing.T) {
+	for _, ciph := range []string{"C_AES_256", "C_AES_256_GCM"} {
+		testRekey(t, "rekeybytes", ciph, 16*1024, 0)
+		testRekey(t, "rekeytime", ciph, 0, 50*time.Millisecond)
+	}
+}
+
+func testRekey(t *testing.T, name, ciph string, maxBytes uint64, interval time.Duration) {
+	cc, sc := _sessionPair(t, name, ciph)
+	defer cc.Close() // nolint: errcheck
+	cr0, cw0 := _keysOf(cc)
+	sr0, sw0 := _keysOf(sc)
+
+	// Server echoes all it reads, until Read() fails
+	srvErr := make(chan error, 1)
+	go func() {
+		defer sc.Close() // nolint: errcheck
+		b := make([]byte, 4096)
+		for {
+			n, err := sc.Read(b)
+			if err != nil {
+				srvErr <- err
+				return
+			}
+			if _, err = sc.Write(b[:n]); err != nil {
+				srvErr <- err
+				return
+			}
+		}
+	}()
+
+	cc.SetupRekey(maxBytes, interval)
+	msg := make([]byte, 1000)
+	got := make([]byte, len(msg))
+	for i := 0; i < 100; i++ {
+		for j := range msg {
+			msg[j] = byte(i + j)
+		}
+		if _, err := cc.Write(msg); err != nil {
+			t.Fatalf("%s %s: write %d: %v", name, ciph, i, err)
+		}
+		if _, err := io.ReadFull(cc, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("%s %s: echo %d: %v", name, ciph, i, err)
+		}
+		if interval > 0 {
+			time.Sleep(interval / 10)
+		}
+	}
+
+	// Let any rekey in progress finish, then start no more
+	cc.SetupRekey(0, 0)
+	for try := 0; ; try++ {
+		cc.rk.Lock()
+		active := cc.rk.active
+		cc.rk.Unlock()
+		if !active {
+			break
+		}
+		if try == 100 {
+			t.Fatalf("%s %s: rekey did not finish", name, ciph)
+		}
+		if _, err := cc.Write(msg[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(cc, got[:1]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cr, cw := _keysOf(cc)
+	if _sameKeys(cr, cr0) || _sameKeys(cw, cw0) {
+		t.Fatalf("%s %s: client not rekeyed", name, ciph)
+	}
+
+	// A frame under the client's old write keys
+	cc.Lock()
+	*cc.w = cw0
+	cc.Unlock()
+	_, _ = cc.WritePacket(msg, CSONone)
+	cc.Lock()
+	*cc.w = cw
+	cc.Unlock()
+	select {
+	case err := <-srvErr:
+		if ae, ok := err.(*AuthError); !ok || ae.Remote {
+			t.Fatalf("%s %s: server Read() returned %v, want local *AuthError", name, ciph, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s %s: frame under old keys accepted", name, ciph)
+	}
+	sr, sw := _keysOf(sc)
+	if _sameKeys(sr, sr0) || _sameKeys(sw, sw0) {
+		t.Fatalf("%s %s: server not rekeyed", name, ciph)
+	}
+}
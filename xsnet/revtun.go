@@ -0,0 +1,197 @@
+// revtun.go - Reverse (remote-to-local) tunnels
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Reverse tunnels
+// --
+// 1. client is given (rport, lhost, lport) by local user
+// 2. client sends [CSOTunRevSetup:lport:rport:0] to server
+// client=> [CSOTunRevSetup:lport:rport:0] =>remhost
+//
+// remhost listens on rport (loopback only, as ssh -R does by default)
+//   ... or if it can't, replies [CSOTunRefused:lport:rport:0]
+//
+// each conn accepted on rport is a stream with its own id (see
+// tunstream.go), of which remhost tells the client
+// client<= [CSOTunRevAccept:lport:rport:id] <=remhost
+// and the client dials lhost:lport, as it asked for rport, replying
+// client=> [CSOTunSetupAck:lport:rport:id] =>remhost
+//   ... or if it can't (or the server names another lport),
+// client=> [CSOTunRefused:lport:rport:id] =>remhost
+//
+// Data then flows as for forward tunnels ([CSOTunData:lport:rport:id]),
+// the client sending [CSOTunHangup] if lhost:lport closes and the
+// server [CSOTunDisconn] if the rport conn does. The rport listener is
+// closed with the Conn.
+// --
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"blitter.com/go/xs/logger"
+)
+
+// revTun is where the client dials for a reverse tunnel.
+type revTun struct {
+	lhost string
+	lport uint16
+}
+
+// RequestRevTunnel asks the server to listen on rport, each connection
+// accepted there being carried back over hc to lhost:lport.
+func (hc *Conn) RequestRevTunnel(rport uint16, lhost string, lport uint16) error {
+	if hc.features&FeatRevTun == 0 {
+		return errors.New("server does not support reverse tunnels")
+	}
+	if hc.features&FeatTunStream == 0 {
+		return errors.New("server tunnels are not compatible (too old?)")
+	}
+	hc.Lock()
+	if _, ok := (*hc.revTuns)[rport]; ok {
+		hc.Unlock()
+		return fmt.Errorf("reverse tunnel on rport %d already requested", rport)
+	}
+	(*hc.revTuns)[rport] = revTun{lhost: lhost, lport: lport}
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[Client sending CSOTunRevSetup [%d:%s:%d]]", rport, lhost, lport))
+	_, err := hc.WritePacket(tunHdr(lport, rport, 0), CSOTunRevSetup)
+	return err
+}
+
+// forgetRevTunnel drops the client's reverse tunnel on rport, if any,
+// reporting whether there was one.
+func (hc *Conn) forgetRevTunnel(rport uint16) (ok bool) {
+	hc.Lock()
+	defer hc.Unlock()
+	if _, ok = (*hc.revTuns)[rport]; ok {
+		delete(*hc.revTuns, rport)
+	}
+	return
+}
+
+// StartClientRevTunnel dials the client side of reverse tunnel
+// connection id, just accepted by the server on rport. It is refused
+// unless the client asked for a reverse tunnel from rport to lport.
+func (hc *Conn) StartClientRevTunnel(lport, rport, id uint16) {
+	hc.Lock()
+	rt, ok := (*hc.revTuns)[rport]
+	hc.Unlock()
+	refuse := func(e error) {
+		logger.LogDebug(fmt.Sprintf("[ClientRevTun] Refusing stream %d of rport %d: %s", id, rport, e))
+		hc.WritePacket(tunHdr(lport, rport, id), CSOTunRefused) // nolint: errcheck
+	}
+	if !ok {
+		refuse(errors.New("no reverse tunnel requested"))
+		return
+	}
+	if lport != rt.lport {
+		refuse(fmt.Errorf("reverse tunnel is to lport %d, not %d", rt.lport, lport))
+		return
+	}
+	lhost := rt.lhost
+	addr := net.JoinHostPort(lhost, strconv.Itoa(int(rt.lport)))
+	// Register the stream now, so data which arrives while dialling
+	// is kept (the server sends none before the ack)
+	s := &tunStream{id: id, addr: addr, dataOp: CSOTunData, closeOp: CSOTunHangup}
+	if e := hc.addStream(s, func(id uint16) []byte { return tunHdr(lport, rport, id) }); e != nil {
+		refuse(e)
+		return
+	}
+
+	go func() {
+		c, e := net.DialTimeout("tcp", addr, 10*time.Second)
+		if e != nil {
+			s.closeLocal()
+			refuse(e)
+			return
+		}
+		logger.LogDebug(fmt.Sprintf("[ClientRevTun] Stream %d opened - [%d:%s:%d]", id, rport, lhost, lport))
+		if _, e = hc.WritePacket(s.hdr(), CSOTunSetupAck); e != nil {
+			s.closeLocal()
+			_ = c.Close()
+			return
+		}
+		s.relay(c)
+		logger.LogDebug(fmt.Sprintf("[ClientRevTun] Stream %d closed - [%d:%s:%d]", id, rport, lhost, lport))
+	}()
+}
+
+// StartServerRevTunnel listens on rport for the client's reverse
+// tunnel to its lport, if the client has logged in (see
+// EnableTunnels).
+func (hc *Conn) StartServerRevTunnel(lport, rport uint16) {
+	hc.Lock()
+	_, busy := (*hc.revListeners)[rport]
+	hc.Unlock()
+	var l net.Listener
+	e := fmt.Errorf("rport %d already tunnelled", rport)
+	if !hc.tunnelsEnabled() {
+		e = errors.New("client not logged in")
+	} else if !busy {
+		l, e = net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", rport))
+	}
+	if e != nil {
+		logger.LogDebug(fmt.Sprintf("[ServerRevTun] Could not listen on rport %d! (%s)", rport, e))
+		hc.WritePacket(tunHdr(lport, rport, 0), CSOTunRefused) // nolint: errcheck
+		return
+	}
+	hc.Lock()
+	(*hc.revListeners)[rport] = l
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[ServerRevTun] Listening on rport %d for reverse tunnel", rport))
+
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				logger.LogDebug(fmt.Sprintf("[ServerRevTun] Accept() on rport %d: %s, closing", rport, e))
+				return
+			}
+			logger.LogDebug(fmt.Sprintf("[ServerRevTun] Accepted tunnel client %v", c.RemoteAddr()))
+			go hc.serverRevTunConn(lport, rport, c)
+		}
+	}()
+}
+
+// serverRevTunConn carries c, accepted on rport, to the client.
+func (hc *Conn) serverRevTunConn(lport, rport uint16, c net.Conn) {
+	s := &tunStream{addr: c.RemoteAddr().String(), dataOp: CSOTunData, closeOp: CSOTunDisconn}
+	if e := hc.addStream(s, func(id uint16) []byte { return tunHdr(lport, rport, id) }); e != nil {
+		logger.LogDebug(fmt.Sprintf("[ServerRevTun] rport %d: %s, hanging up", rport, e))
+		_ = c.Close()
+		return
+	}
+	if _, e := hc.WritePacket(s.hdr(), CSOTunRevAccept); e != nil {
+		s.closeLocal()
+		_ = c.Close()
+		return
+	}
+	if e := s.waitAck(30 * time.Second); e != nil {
+		logger.LogDebug(fmt.Sprintf("[ServerRevTun] Client could not dial lport %d for rport %d: %s", lport, rport, e))
+		_ = c.Close()
+		return
+	}
+	logger.LogDebug(fmt.Sprintf("[ServerRevTun] Stream %d opened - [%d:%d]", s.id, rport, lport))
+	s.relay(c)
+	logger.LogDebug(fmt.Sprintf("[ServerRevTun] Stream %d closed - [%d:%d]", s.id, rport, lport))
+}
+
+// closeRevListeners stops the server listening for reverse tunnels.
+func (hc *Conn) closeRevListeners() {
+	hc.Lock()
+	defer hc.Unlock()
+	for rport, l := range *hc.revListeners {
+		_ = l.Close()
+		delete(*hc.revListeners, rport)
+	}
+}
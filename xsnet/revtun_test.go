@@ -0,0 +1,125 @@
+package xsnet
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// _readLoop reads (and discards) from hc, so that its control packets
+// are handled, until it is closed.
+func _readLoop(hc *Conn) {
+	b := make([]byte, 1024)
+	for {
+		if _, err := hc.Read(b); err != nil {
+			return
+		}
+	}
+}
+
+// Connections to the server's rport reach the client's lhost:lport,
+// several at once.
+func TestRevTunnel(t *testing.T) {
+	l, err := Listen("pipe", "revtun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close() // nolint: errcheck
+		s.(*Conn).EnableTunnels()
+		_readLoop(s.(*Conn))
+	}()
+	hc, err := Dial("pipe", "revtun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hc.Close() // nolint: errcheck
+	go _readLoop(hc)
+
+	// The client's service: echo
+	el, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close() // nolint: errcheck
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	lport := uint16(el.Addr().(*net.TCPAddr).Port)
+
+	// A free port for the server to listen on
+	rl, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rport := uint16(rl.Addr().(*net.TCPAddr).Port)
+	_ = rl.Close()
+
+	if err = hc.RequestRevTunnel(rport, "127.0.0.1", lport); err != nil {
+		t.Fatal(err)
+	}
+	if err = hc.RequestRevTunnel(rport, "127.0.0.1", lport); err == nil {
+		t.Fatal("reverse tunnel on the same rport requested twice")
+	}
+
+	// All open before any is used
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		var c net.Conn
+		for try := 0; try < 50; try++ { // until the server listens
+			if c, err = net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(int(rport))); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() // nolint: errcheck
+		conns = append(conns, c)
+	}
+	for i := len(conns) - 1; i >= 0; i-- {
+		msg := []byte("hello, reverse tunnel " + strconv.Itoa(i))
+		_, _ = conns[i].Write(msg)
+		_ = conns[i].SetReadDeadline(time.Now().Add(10 * time.Second))
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(conns[i], got); err != nil || string(got) != string(msg) {
+			t.Fatalf("conn %d: got %q, %v", i, got, err)
+		}
+	}
+}
+
+// Reverse tunnel connections are only dialled to the lport the client
+// asked for, whatever lport the server names.
+func TestRevTunnelLport(t *testing.T) {
+	hc := _tunSession(t, "revlport", true)
+	defer hc.Close() // nolint: errcheck
+	el := _echoServer(t, "127.0.0.1:0")
+	defer el.Close() // nolint: errcheck
+	lport, rport := uint16(el.Addr().(*net.TCPAddr).Port), _freePort(t)
+
+	if err := hc.RequestRevTunnel(rport, "127.0.0.1", lport+1); err != nil {
+		t.Fatal(err)
+	}
+	// As if the server accepted a connection for lport
+	hc.StartClientRevTunnel(lport, rport, 0x8001)
+	if hc.stream(0x8001) != nil {
+		t.Fatal("dialled lport not asked for")
+	}
+}
@@ -0,0 +1,103 @@
+// transport.go - registry of underlying network transports
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// An xsnet Conn runs over a raw net.Conn provided by a Transport,
+// chosen by name (the protocol arg of Dial() and Listen(), or
+// Config.Transport). The stream transports of package net ("tcp",
+// "tcp4", "tcp6" and "unix") are registered here, KCP in kcp.go,
+// WebSockets in ws.go and an in-memory transport for tests in pipe.go;
+// other packages may add their own with RegisterTransport().
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Transport is a network over which xsnet connections are made.
+type Transport interface {
+	// Name is the transport's name, eg. "tcp"
+	Name() string
+	// Dial connects to addr, using any transport-specific
+	// settings in cfg. It should give up if ctx is done first.
+	Dial(ctx context.Context, addr string, cfg *Config) (net.Conn, error)
+	// Listen listens on addr, using any transport-specific
+	// settings in cfg.
+	Listen(addr string, cfg *Config) (net.Listener, error)
+}
+
+var (
+	transportMu       sync.RWMutex
+	transportRegistry = make(map[string]Transport)
+)
+
+// RegisterTransport adds t to the transports xsnet may use. It is an
+// error if t's Name is already registered.
+func RegisterTransport(t Transport) error {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if _, ok := transportRegistry[t.Name()]; ok {
+		return fmt.Errorf("transport %s already registered", t.Name())
+	}
+	transportRegistry[t.Name()] = t
+	return nil
+}
+
+// lookupTransport returns the registered Transport with the given name.
+func lookupTransport(name string) (t Transport, ok bool) {
+	transportMu.RLock()
+	t, ok = transportRegistry[name]
+	transportMu.RUnlock()
+	return
+}
+
+// Transports returns the names of all registered transports, sorted.
+func Transports() (names []string) {
+	transportMu.RLock()
+	for n := range transportRegistry {
+		names = append(names, n)
+	}
+	transportMu.RUnlock()
+	sort.Strings(names)
+	return
+}
+
+// netTransport is one of the stream networks of package net.
+type netTransport string
+
+func (t netTransport) Name() string { return string(t) }
+
+func (t netTransport) Dial(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	if proxied(string(t)) {
+		u, err := cfg.proxyURL(addr, "HTTPS_PROXY", "ALL_PROXY")
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			return dialProxy(ctx, u, addr)
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, string(t), addr)
+}
+
+func (t netTransport) Listen(addr string, cfg *Config) (net.Listener, error) {
+	return net.Listen(string(t), addr)
+}
+
+func init() {
+	for _, n := range []string{"tcp", "tcp4", "tcp6", "unix"} {
+		if err := RegisterTransport(netTransport(n)); err != nil {
+			panic(err)
+		}
+	}
+}
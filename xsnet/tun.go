@@ -9,13 +9,11 @@
 package xsnet
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 
 	"blitter.com/go/xs/logger"
@@ -24,211 +22,196 @@ import (
 type (
 	// Tunnels
 	// --
-	// 1. client is given (lport, remhost, rport) by local user
-	// 2. client sends [CSOTunReq:rport] to server
-	// client=> [CSOTunReq:rport] =>remhost
+	// 1. client is given (lport, [host,] rport) by local user
+	// 2. client sends [CSOTunReq:lport:rport:0[:host]] to server
+	// client=> [CSOTunReq:lport:rport:0[:host]] =>remhost
 	//
-	// remhost starts worker to receive/send data using rport
-	// remhost replies to client with rport to acknowledge tun is ready
-	// client<= [CSOTunAck:rport] <=remhost
-	//   ... or if rhost rport refuses connection, sends
-	//   [CSOTunRefused:rport]
+	// remhost records the tunnel (to host:rport, or its own rport if
+	// no host was given) and replies to acknowledge tun is ready
+	// client<= [CSOTunAck:lport:rport:0[:host]] <=remhost
+	//   ... or, given a host but not allowing tunnels to other hosts
+	//   (AllowDynTunnels), refuses it
+	// client<= [CSOTunRefused:lport:rport:0] <=remhost
 	//
-	// client starts worker to receive/send data using lport
-	// ... client disconnects: sends remhost [CSOTunClose:rport]
-	// ... or server disconnects: sends client [CSOTunClose:lport]
-	//     server at any time sends [CSOTunRefused:rport] if daemon died
+	// client listens on lport. Each connection accepted there is a
+	// stream with its own id (see tunstream.go), for which remhost is
+	// asked to dial host:rport
+	// client=> [CSOTunReq:lport:rport:id] =>remhost
+	// client<= [CSOTunAck:lport:rport:id] <=remhost
+	//   ... or if host:rport refuses connection, sends
+	//   [CSOTunRefused:lport:rport:id]
+	//
+	// data then flows either way as [CSOTunData:lport:rport:id:data],
+	// for any number of connections at once, until
+	// ... client conn disconnects: sends remhost [CSOTunHangup:lport:rport:id]
+	// ... or server conn disconnects: sends client [CSOTunDisconn:lport:rport:id]
+	//
+	// Tunnels are known by lport at both ends. If the client's
+	// keepalives stop, remhost shuts the tunnel down.
 	// --
 
-	// TunEndpoint [securePort:peer:dataPort]
+	// TunEndpoint [securePort:host:dataPort]
 	TunEndpoint struct {
-		Rport     uint16    // Names are from client's perspective
-		Lport     uint16    // ... ie., RPort is on server, LPort is on client
-		Peer      string    //net.Addr
-		Died      bool      // set by client upon receipt of a CSOTunDisconn
-		KeepAlive uint32    // must be reset by client to keep server dial() alive
-		Ctl       chan rune //See TunCtl_* consts
-		Data      chan []byte
+		Rport     uint16 // Names are from client's perspective
+		Lport     uint16 // ... ie., RPort is on server, LPort is on client
+		Host      string // host dialled by server for rport ("" for itself)
+		Died      bool   // set when the tunnel is shut down
+		KeepAlive uint32 // must be reset by client to keep server tunnel alive
+
+		l net.Listener // client: listener on lport
 	}
 )
 
+// tunHdr returns the [lport:rport:id] header of tunnel packets.
+func tunHdr(lport, rport, id uint16) []byte {
+	b := make([]byte, 6)
+	binary.BigEndian.PutUint16(b[0:2], lport)
+	binary.BigEndian.PutUint16(b[2:4], rport)
+	binary.BigEndian.PutUint16(b[4:6], id)
+	return b
+}
+
+// CollapseAllTunnels shuts down all of hc's tunnels and their
+// connections, telling the peer.
 func (hc *Conn) CollapseAllTunnels(client bool) {
-	for k, t := range *hc.tuns {
-		var tunDst bytes.Buffer
-		binary.Write(&tunDst, binary.BigEndian, t.Lport)
-		binary.Write(&tunDst, binary.BigEndian, t.Rport)
-		if client {
-			hc.WritePacket(tunDst.Bytes(), CSOTunHangup)
-		} else {
-			hc.WritePacket(tunDst.Bytes(), CSOTunDisconn)
-		}
-		delete(*hc.tuns, k)
+	hc.Lock()
+	var lports []uint16
+	for k := range *hc.tuns {
+		lports = append(lports, k)
+	}
+	hc.Unlock()
+	for _, k := range lports {
+		hc.ShutdownTun(k)
 	}
 }
 
-func (hc *Conn) InitTunEndpoint(lp uint16, p string /* net.Addr */, rp uint16) {
+// InitTunEndpoint records the tunnel on lp to host:rp, returning it (or
+// the one already on lp).
+func (hc *Conn) InitTunEndpoint(lp uint16, host string, rp uint16) (t *TunEndpoint, isNew bool) {
 	hc.Lock()
 	defer hc.Unlock()
 	if (*hc.tuns) == nil {
 		(*hc.tuns) = make(map[uint16]*TunEndpoint)
 	}
-	if (*hc.tuns)[rp] == nil {
-		var addrs []net.Addr
-		if p == "" {
-			addrs, _ = net.InterfaceAddrs()
-			p = addrs[0].String()
-		}
-		(*hc.tuns)[rp] = &TunEndpoint{ /*Status: CSOTunSetup,*/ Peer: p,
-			Lport: lp, Rport: rp, Data: make(chan []byte, 1),
-			Ctl: make(chan rune, 1)}
-		logger.LogDebug(fmt.Sprintf("InitTunEndpoint [%d:%s:%d]", lp, p, rp))
+	if t = (*hc.tuns)[lp]; t == nil {
+		t = &TunEndpoint{Lport: lp, Host: host, Rport: rp}
+		(*hc.tuns)[lp] = t
+		isNew = true
+		logger.LogDebug(fmt.Sprintf("InitTunEndpoint %v", t))
 	} else {
-		logger.LogDebug(fmt.Sprintf("InitTunEndpoint [reusing] %v", (*hc.tuns)[rp]))
-		if (*hc.tuns)[rp].Data == nil {
-			// When re-using a tunnel it will have its
-			// data channel removed on closure. Re-create it
-			(*hc.tuns)[rp].Data = make(chan []byte, 1)
-		}
-		(*hc.tuns)[rp].KeepAlive = 0
-		(*hc.tuns)[rp].Died = false
+		logger.LogDebug(fmt.Sprintf("InitTunEndpoint [reusing] %v", t))
+		t.KeepAlive = 0
 	}
 	return
 }
 
-func (hc *Conn) StartClientTunnel(lport, rport uint16) {
-	hc.InitTunEndpoint(lport, "", rport)
-
-	go func() {
-		var wg sync.WaitGroup
-
-		for cmd := range (*hc.tuns)[rport].Ctl {
-			if cmd == 'a' {
-				l, e := net.Listen("tcp4", fmt.Sprintf(":%d", lport))
-				if e != nil {
-					logger.LogDebug(fmt.Sprintf("[ClientTun] Could not get lport %d! (%s)", lport, e))
-				} else {
-					logger.LogDebug(fmt.Sprintf("[ClientTun] Listening for client tunnel port %d", lport))
-
-					for {
-						c, e := l.Accept() // blocks until new conn
-						// If tunnel is being re-used, re-init it
-						if (*hc.tuns)[rport] == nil {
-							hc.InitTunEndpoint(lport, "", rport)
-						}
-						// ask server to dial() its side, rport
-						var tunDst bytes.Buffer
-						binary.Write(&tunDst, binary.BigEndian, lport)
-						binary.Write(&tunDst, binary.BigEndian, rport)
-						hc.WritePacket(tunDst.Bytes(), CSOTunSetup)
-
-						if e != nil {
-							logger.LogDebug(fmt.Sprintf("[ClientTun] Accept() got error(%v), hanging up.", e))
-						} else {
-							logger.LogDebug(fmt.Sprintf("[ClientTun] Accepted tunnel client %v", (*hc.tuns)[rport]))
-
-							// outside client -> tunnel lport
-							wg.Add(1)
-							go func() {
-								defer func() {
-									if c.Close() != nil {
-										logger.LogDebug("[ClientTun] worker A: conn c already closed")
-									} else {
-										logger.LogDebug("[ClientTun] worker A: closed conn c")
-									}
-									wg.Done()
-								}()
-
-								logger.LogDebug("[ClientTun] worker A: starting")
-
-								var tunDst bytes.Buffer
-								binary.Write(&tunDst, binary.BigEndian, lport)
-								binary.Write(&tunDst, binary.BigEndian, rport)
-								for {
-									rBuf := make([]byte, 1024)
-									//Read data from c, encrypt/write via hc to client(lport)
-									c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
-									n, e := c.Read(rBuf)
-									if e != nil {
-										if e == io.EOF {
-											logger.LogDebug(fmt.Sprintf("[ClientTun] worker A: lport Disconnected: shutting down tunnel %v", (*hc.tuns)[rport]))
-											// if Died was already set, server-side already is gone.
-											if hc.TunIsAlive(rport) {
-												hc.WritePacket(tunDst.Bytes(), CSOTunHangup)
-											}
-											hc.ShutdownTun(rport) // FIXME: race-C
-											break
-										} else if strings.Contains(e.Error(), "i/o timeout") {
-											if !hc.TunIsAlive(rport) {
-												logger.LogDebug(fmt.Sprintf("[ClientTun] worker A: timeout: Server side died, hanging up %v", (*hc.tuns)[rport]))
-												hc.ShutdownTun(rport)
-												break
-											}
-										} else {
-											logger.LogDebug(fmt.Sprintf("[ClientTun] worker A: Read error from lport of tun %v\n%s", (*hc.tuns)[rport], e))
-											if hc.TunIsAlive(rport) {
-												hc.WritePacket(tunDst.Bytes(), CSOTunHangup)
-											}
-											hc.ShutdownTun(rport)
-											break
-										}
-									}
-									if n > 0 {
-										rBuf = append(tunDst.Bytes(), rBuf[:n]...)
-										_, de := hc.WritePacket(rBuf[:n+4], CSOTunData)
-										if de != nil {
-											logger.LogDebug(fmt.Sprintf("[ClientTun] worker A: Error writing to tunnel %v, %s]\n", (*hc.tuns)[rport], de))
-											break
-										}
-									}
-								}
-								logger.LogDebug("[ClientTun] worker A: exiting")
-							}()
+// EnableTunnels lets the client of server connection hc set up
+// tunnels of all kinds. Until it is called, as it should be once the
+// client has logged in, all its tunnel requests are refused.
+func (hc *Conn) EnableTunnels() {
+	hc.Lock()
+	defer hc.Unlock()
+	hc.tunsEnabled = true
+}
 
-							// tunnel lport -> outside client (c)
-							wg.Add(1)
-							go func() {
-								defer func() {
-									if c.Close() != nil {
-										logger.LogDebug("[ClientTun] worker B: conn c already closed")
-									} else {
-										logger.LogDebug("[ClientTun] worker B: closed conn c")
-									}
-									wg.Done()
-								}()
+// tunnelsEnabled reports whether hc may act on its peer's tunnel
+// requests (clients always may, servers once EnableTunnels is called).
+func (hc *Conn) tunnelsEnabled() bool {
+	hc.Lock()
+	defer hc.Unlock()
+	return !hc.server || hc.tunsEnabled
+}
 
-								logger.LogDebug("[ClientTun] worker B: starting")
+// tunnel returns hc's tunnel on lport, or nil.
+func (hc *Conn) tunnel(lport uint16) *TunEndpoint {
+	hc.Lock()
+	defer hc.Unlock()
+	return (*hc.tuns)[lport]
+}
 
-								for {
-									bytes, ok := <-(*hc.tuns)[rport].Data // FIXME: race-C w/ShutdownTun calls
-									if ok {
-										c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
-										_, e := c.Write(bytes)
-										if e != nil {
-											logger.LogDebug(fmt.Sprintf("[ClientTun] worker B: lport conn closed"))
-											break
-										}
-									} else {
-										logger.LogDebug(fmt.Sprintf("[ClientTun] worker B: Channel was closed?"))
-										break
-									}
-								}
-								logger.LogDebug("[ClientTun] worker B: exiting")
-							}()
+// RequestTunnel asks the server to set up a tunnel from lport to rport
+// on host (as dialled by the server; "" for the server itself). The
+// client listens on lport once the server acknowledges it.
+func (hc *Conn) RequestTunnel(lport uint16, host string, rport uint16) error {
+	if hc.features&FeatTunStream == 0 {
+		return errors.New("server tunnels are not compatible (too old?)")
+	}
+	if host != "" && hc.features&FeatTunHost == 0 {
+		return errors.New("server does not support tunnels to other hosts")
+	}
+	if lport == 0 || rport == 0 {
+		return errors.New("tunnel ports may not be 0")
+	}
+	if hc.tunnel(lport) != nil {
+		return fmt.Errorf("lport %d already tunnelled", lport)
+	}
+	logger.LogDebug(fmt.Sprintf("[Client sending CSOTunSetup [%d:%s:%d]]", lport, host, rport))
+	_, err := hc.WritePacket(append(tunHdr(lport, rport, 0), host...), CSOTunSetup)
+	return err
+}
 
-						} // end Accept() worker block
-						wg.Wait()
+// StartClientTunnel listens on lport for connections to tunnel to
+// rport on host (as dialled by the server; "" for the server itself).
+func (hc *Conn) StartClientTunnel(lport uint16, host string, rport uint16) {
+	t, isNew := hc.InitTunEndpoint(lport, host, rport)
+	if !isNew {
+		return
+	}
+	l, e := net.Listen("tcp4", fmt.Sprintf(":%d", lport))
+	if e != nil {
+		logger.LogDebug(fmt.Sprintf("[ClientTun] Could not get lport %d! (%s)", lport, e))
+		hc.ShutdownTun(lport)
+		return
+	}
+	hc.Lock()
+	if t.Died {
+		hc.Unlock()
+		_ = l.Close()
+		return
+	}
+	t.l = l
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[ClientTun] Listening for client tunnel port %d", lport))
 
-						// When both workers have exited due to a disconnect or other
-						// condition, it's safe to remove the tunnel descriptor.
-						logger.LogDebug("[ClientTun] workers exited")
-						hc.ShutdownTun(rport)
-					} // end for-accept
-				} // end Listen() block
+	go func() {
+		for {
+			c, e := l.Accept() // blocks until new conn
+			if e != nil {
+				logger.LogDebug(fmt.Sprintf("[ClientTun] Accept() got error(%v), closing tunnel %v", e, t))
+				hc.ShutdownTun(lport)
+				return
 			}
-		} // end t.Ctl for
+			logger.LogDebug(fmt.Sprintf("[ClientTun] Accepted tunnel client %v for %v", c.RemoteAddr(), t))
+			go hc.clientTunConn(t, c)
+		}
 	}()
 }
 
+// clientTunConn carries c, accepted on t's lport, to the server.
+func (hc *Conn) clientTunConn(t *TunEndpoint, c net.Conn) {
+	s := &tunStream{addr: net.JoinHostPort(t.Host, strconv.Itoa(int(t.Rport))),
+		lport: t.Lport, dataOp: CSOTunData, closeOp: CSOTunHangup}
+	if e := hc.addStream(s, func(id uint16) []byte { return tunHdr(t.Lport, t.Rport, id) }); e != nil {
+		logger.LogDebug(fmt.Sprintf("[ClientTun] %v: %s, hanging up", t, e))
+		_ = c.Close()
+		return
+	}
+	// ask server to dial() its side, [host:]rport
+	if _, e := hc.WritePacket(s.hdr(), CSOTunSetup); e != nil {
+		s.closeLocal()
+		_ = c.Close()
+		return
+	}
+	if e := s.waitAck(30 * time.Second); e != nil {
+		logger.LogDebug(fmt.Sprintf("[ClientTun] Server could not dial %s for %v: %s", s.addr, t, e))
+		_ = c.Close()
+		return
+	}
+	logger.LogDebug(fmt.Sprintf("[ClientTun] Stream %d opened - %v", s.id, t))
+	s.relay(c)
+	logger.LogDebug(fmt.Sprintf("[ClientTun] Stream %d closed - %v", s.id, t))
+}
+
 func (hc *Conn) AgeTunnel(endp uint16) uint32 {
 	hc.Lock()
 	defer hc.Unlock()
@@ -239,7 +222,9 @@ func (hc *Conn) AgeTunnel(endp uint16) uint32 {
 func (hc *Conn) ResetTunnelAge(endp uint16) {
 	hc.Lock()
 	defer hc.Unlock()
-	(*hc.tuns)[endp].KeepAlive = 0
+	if t := (*hc.tuns)[endp]; t != nil {
+		t.KeepAlive = 0
+	}
 }
 
 func (hc *Conn) TunIsNil(endp uint16) bool {
@@ -251,168 +236,219 @@ func (hc *Conn) TunIsNil(endp uint16) bool {
 func (hc *Conn) TunIsAlive(endp uint16) bool {
 	hc.Lock()
 	defer hc.Unlock()
-	return !(*hc.tuns)[endp].Died
+	t := (*hc.tuns)[endp]
+	return t != nil && !t.Died
 }
 
 func (hc *Conn) MarkTunDead(endp uint16) {
 	hc.Lock()
 	defer hc.Unlock()
-	(*hc.tuns)[endp].Died = true
+	if t := (*hc.tuns)[endp]; t != nil {
+		t.Died = true
+	}
 }
 
+// ShutdownTun removes the tunnel on lport endp, closing its listener
+// (client) and its connections.
 func (hc *Conn) ShutdownTun(endp uint16) {
 	hc.Lock()
-	defer hc.Unlock()
-	if (*hc.tuns)[endp] != nil {
-		(*hc.tuns)[endp].Died = true
-		if (*hc.tuns)[endp].Data != nil {
-			close((*hc.tuns)[endp].Data)
-			(*hc.tuns)[endp].Data = nil
+	t := (*hc.tuns)[endp]
+	delete((*hc.tuns), endp)
+	if t != nil {
+		t.Died = true
+		if t.l != nil {
+			_ = t.l.Close()
 		}
 	}
-	delete((*hc.tuns), endp)
+	hc.Unlock()
+	for _, s := range hc.tunStreamsOf(endp) {
+		_ = s.Close()
+	}
 }
 
-func (hc *Conn) StartServerTunnel(lport, rport uint16) {
-	hc.InitTunEndpoint(lport, "", rport)
-	var err error
-
-	go func() {
-		var wg sync.WaitGroup
-
+// StartServerTunnel sets up the server side of the client's tunnel
+// from lport to rport on host ("" for the server itself).
+func (hc *Conn) StartServerTunnel(lport uint16, host string, rport uint16) {
+	if host != "" && !dynTunsAllowed {
+		logger.LogDebug(fmt.Sprintf("[ServerTun] Refusing tunnel [%d:%s:%d]: tunnels to other hosts disabled", lport, host, rport))
+		hc.WritePacket(tunHdr(lport, rport, 0), CSOTunRefused) // nolint: errcheck
+		return
+	}
+	if _, isNew := hc.InitTunEndpoint(lport, host, rport); isNew {
 		//
 		// worker to age server tunnel and kill it if keepalives
 		// stop from client
 		//
-		wg.Add(1)
 		go func() {
-			defer wg.Done()
 			for {
 				time.Sleep(100 * time.Millisecond)
-				if hc.TunIsNil(rport) {
-					logger.LogDebug("[ServerTun] worker A: Client endpoint removed.")
+				if hc.TunIsNil(lport) {
+					logger.LogDebug("[ServerTun] Client endpoint removed.")
 					break
 				}
-				age := hc.AgeTunnel(rport)
+				age := hc.AgeTunnel(lport)
 				if age > 25 {
-					hc.MarkTunDead(rport)
-					logger.LogDebug("[ServerTun] worker A: Client died, hanging up.")
+					logger.LogDebug("[ServerTun] Client died, hanging up.")
+					hc.ShutdownTun(lport)
 					break
 				}
 			}
 		}()
+	}
+	logger.LogDebug(fmt.Sprintf("[ServerTun] Writing CSOTunSetupAck [%d:%s:%d]", lport, host, rport))
+	hc.WritePacket(append(tunHdr(lport, rport, 0), host...), CSOTunSetupAck) // nolint: errcheck
+}
 
-		for cmd := range (*hc.tuns)[rport].Ctl {
-			var c net.Conn
-			logger.LogDebug(fmt.Sprintf("[ServerTun] got Ctl '%c'.", cmd))
-			if cmd == 'd' {
-				// if re-using tunnel, re-init it
-				if hc.TunIsNil(rport) {
-					hc.InitTunEndpoint(lport, "", rport)
-				}
-				logger.LogDebug("[ServerTun] dialling...")
-				c, err = net.Dial("tcp4", fmt.Sprintf(":%d", rport))
-				if err != nil {
-					logger.LogDebug(fmt.Sprintf("[ServerTun] Dial() error for tun %v: %s", (*hc.tuns)[rport], err))
-					var resp bytes.Buffer
-					binary.Write(&resp, binary.BigEndian /*lport*/, uint16(0))
-					binary.Write(&resp, binary.BigEndian, rport)
-					hc.WritePacket(resp.Bytes(), CSOTunRefused)
-				} else {
-					logger.LogDebug(fmt.Sprintf("[ServerTun] Tunnel Opened - %v", (*hc.tuns)[rport]))
-					var resp bytes.Buffer
-					binary.Write(&resp, binary.BigEndian, lport)
-					binary.Write(&resp, binary.BigEndian, rport)
-					logger.LogDebug(fmt.Sprintf("[ServerTun] Writing CSOTunSetupAck %v", (*hc.tuns)[rport]))
-					hc.WritePacket(resp.Bytes(), CSOTunSetupAck)
+// serverTunConn dials, for the client's connection id on the tunnel
+// on lport, the tunnel's host:rport, and relays between them.
+func (hc *Conn) serverTunConn(lport, rport, id uint16) {
+	t := hc.tunnel(lport)
+	refuse := func(e error) {
+		logger.LogDebug(fmt.Sprintf("[ServerTun] Refusing stream %d of tun [%d:%d]: %s", id, lport, rport, e))
+		hc.WritePacket(tunHdr(lport, rport, id), CSOTunRefused) // nolint: errcheck
+	}
+	if t == nil || t.Rport != rport {
+		refuse(errors.New("no such tunnel"))
+		return
+	}
+	if t.Host != "" && !dynTunsAllowed {
+		refuse(errors.New("tunnels to other hosts disabled"))
+		return
+	}
+	network, addr := "tcp4", fmt.Sprintf(":%d", rport)
+	if t.Host != "" {
+		network, addr = "tcp", net.JoinHostPort(t.Host, strconv.Itoa(int(rport)))
+	}
+	// Register the stream now, so data which arrives while dialling
+	// is kept (the client sends none before the ack)
+	s := &tunStream{id: id, addr: addr, lport: lport, dataOp: CSOTunData, closeOp: CSOTunDisconn}
+	if e := hc.addStream(s, func(id uint16) []byte { return tunHdr(lport, rport, id) }); e != nil {
+		refuse(e)
+		return
+	}
 
-					//
-					// worker to read data from the rport (to encrypt & send to client)
-					//
-					wg.Add(1)
-					go func() {
-						defer func() {
-							logger.LogDebug("[ServerTun] worker A: deferred hangup")
-							if c.Close() != nil {
-								logger.LogDebug("[ServerTun] workerA: conn c already closed")
-							}
-							wg.Done()
-						}()
+	go func() {
+		logger.LogDebug("[ServerTun] dialling...")
+		c, e := net.DialTimeout(network, addr, 10*time.Second)
+		if e != nil {
+			s.closeLocal()
+			refuse(e)
+			return
+		}
+		logger.LogDebug(fmt.Sprintf("[ServerTun] Stream %d opened - %v", id, t))
+		if _, e = hc.WritePacket(s.hdr(), CSOTunSetupAck); e != nil {
+			s.closeLocal()
+			_ = c.Close()
+			return
+		}
+		s.relay(c)
+		logger.LogDebug(fmt.Sprintf("[ServerTun] Stream %d closed - %v", id, t))
+	}()
+}
 
-						logger.LogDebug("[ServerTun] worker A: starting")
+// gotTun handles fixed (and reverse) tunnel packet p of type op.
+func (hc *Conn) gotTun(op byte, p []byte) {
+	if len(p) < 6 {
+		logger.LogDebug(fmt.Sprintf("[Truncated tunnel packet (type %d)]", op))
+		return
+	}
+	lport := binary.BigEndian.Uint16(p[0:2])
+	rport := binary.BigEndian.Uint16(p[2:4])
+	id := binary.BigEndian.Uint16(p[4:6])
+	var s *tunStream
+	if id != 0 {
+		s = hc.stream(id)
+	}
+	// Tunnels (as opposed to their connections) are set up only by
+	// the client, on the server
+	if id == 0 && hc.server != (op == CSOTunSetup || op == CSOTunRevSetup) {
+		logger.LogDebug(fmt.Sprintf("[Unexpected tunnel packet (type %d) for [%d:%d]]", op, lport, rport))
+		return
+	}
+	if op == CSOTunSetup && !hc.tunnelsEnabled() {
+		logger.LogDebug(fmt.Sprintf("[Server] Refusing tunnel request (type %d) for [%d:%d:%d] before login", op, lport, rport, id))
+		hc.WritePacket(tunHdr(lport, rport, id), CSOTunRefused) // nolint: errcheck
+		return
+	}
 
-						var tunDst bytes.Buffer
-						binary.Write(&tunDst, binary.BigEndian, (*hc.tuns)[rport].Lport)
-						binary.Write(&tunDst, binary.BigEndian, (*hc.tuns)[rport].Rport)
-						for {
-							rBuf := make([]byte, 1024)
-							// Read data from c, encrypt/write via hc to client(lport)
-							c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
-							n, e := c.Read(rBuf)
-							if e != nil {
-								if e == io.EOF {
-									logger.LogDebug(fmt.Sprintf("[ServerTun] worker A: rport Disconnected: shutting down tunnel %v", (*hc.tuns)[rport]))
-									if hc.TunIsAlive(rport) {
-										hc.WritePacket(tunDst.Bytes(), CSOTunDisconn)
-									}
-									hc.ShutdownTun(rport) // FIXME: race-A
-									break
-								} else if strings.Contains(e.Error(), "i/o timeout") {
-									if !hc.TunIsAlive(rport) {
-										logger.LogDebug(fmt.Sprintf("[ServerTun] worker A: timeout: Server side died, hanging up %v", (*hc.tuns)[rport]))
-										hc.ShutdownTun(rport) // FIXME: race-B
-										break
-									}
-								} else {
-									logger.LogDebug(fmt.Sprintf("[ServerTun] worker A: Read error from rport of tun %v: %s", (*hc.tuns)[rport], e))
-									if hc.TunIsAlive(rport) {
-										hc.WritePacket(tunDst.Bytes(), CSOTunDisconn)
-									}
-									hc.ShutdownTun(rport) // FIXME: race-C
-									break
-								}
-							}
-							if n > 0 {
-								rBuf = append(tunDst.Bytes(), rBuf[:n]...)
-								hc.WritePacket(rBuf[:n+4], CSOTunData)
-							}
-						}
-						logger.LogDebug("[ServerTun] worker A: exiting")
-					}()
+	switch op {
+	case CSOTunSetup:
+		// server side tunnel setup in response to client
+		if id == 0 {
+			host := string(p[6:]) // "" for this host
+			logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunSetup [%d:%s:%d]", lport, host, rport))
+			hc.StartServerTunnel(lport, host, rport)
+		} else if s != nil {
+			logger.LogDebug(fmt.Sprintf("[Server] CSOTunSetup for open stream %d", id))
+		} else {
+			hc.serverTunConn(lport, rport, id)
+		}
+	case CSOTunSetupAck:
+		if id == 0 {
+			// client: server is ready, Listen() for lport connections
+			host := string(p[6:])
+			logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunSetupAck [%d:%s:%d]", lport, host, rport))
+			hc.StartClientTunnel(lport, host, rport)
+		} else if s != nil {
+			s.acked(nil)
+		} else {
+			// abandoned while the peer dialled
+			hc.WritePacket(p[0:6], hc.tunCloseOp()) // nolint: errcheck
+		}
+	case CSOTunRefused:
+		if id != 0 {
+			if s != nil {
+				s.acked(errors.New("connection refused"))
+			}
+		} else if hc.forgetRevTunnel(rport) {
+			logger.LogErr(fmt.Sprintf("[Client] Server could not listen on rport %d for reverse tunnel]", rport)) // nolint: gosec,errcheck
+		} else {
+			logger.LogErr(fmt.Sprintf("[Client] Server refused tunnel [%d:%d]", lport, rport)) // nolint: gosec,errcheck
+		}
+	case CSOTunData:
+		if s == nil {
+			logger.LogDebug(fmt.Sprintf("[Attempt to write data to closed tun [%d:%d:%d]", lport, rport, id))
+			return
+		}
+		if hc.logTunActivity {
+			logger.LogDebug(fmt.Sprintf("[Writing data to tun [%d:%d:%d]", lport, rport, id))
+		}
+		s.got(p[6:])
+		if s.lport != 0 {
+			hc.ResetTunnelAge(lport)
+		}
+	case CSOTunDisconn, CSOTunHangup:
+		// peer's side of the connection has disconnected
+		if s != nil && s.closedByPeer() {
+			logger.LogDebug(fmt.Sprintf("[Tun [%d:%d] stream %d closed by peer]", lport, rport, id))
+		}
+	case CSOTunRevSetup:
+		// server side reverse tunnel setup: listen on rport
+		logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunRevSetup [%d:%d]", lport, rport))
+		hc.StartServerRevTunnel(lport, rport)
+	case CSOTunRevAccept:
+		// client side: server accepted a conn on rport, dial lport
+		logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunRevAccept [%d:%d:%d]", lport, rport, id))
+		hc.StartClientRevTunnel(lport, rport, id)
+	}
+}
 
-					// worker to read data from client (already decrypted) & fwd to rport
-					wg.Add(1)
-					go func() {
-						defer func() {
-							logger.LogDebug("[ServerTun] worker B: deferred hangup")
-							if c.Close() != nil {
-								logger.LogDebug("[ServerTun] worker B: conn c already closed")
-							}
-							wg.Done()
-						}()
+// closeTunListeners stops the client listening on its tunnels' lports.
+func (hc *Conn) closeTunListeners() {
+	hc.Lock()
+	defer hc.Unlock()
+	for _, t := range *hc.tuns {
+		if t.l != nil {
+			_ = t.l.Close()
+		}
+	}
+}
 
-						logger.LogDebug("[ServerTun] worker B: starting")
-						for {
-							rData, ok := <-(*hc.tuns)[rport].Data // FIXME: race-A, race-B, race-C (w/ShutdownTun() calls)
-							if ok {
-								c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
-								_, e := c.Write(rData)
-								if e != nil {
-									logger.LogDebug(fmt.Sprintf("[ServerTun] worker B: ERROR writing to rport conn"))
-									break
-								}
-							} else {
-								logger.LogDebug(fmt.Sprintf("[ServerTun] worker B: Channel was closed?"))
-								break
-							}
-						}
-						logger.LogDebug("[ServerTun] worker B: exiting")
-					}()
-					wg.Wait()
-				} // end if Dialled successfully
-				delete((*hc.tuns), rport)
-			}
-		} // t.Ctl read loop
-		logger.LogDebug("[ServerTun] Tunnel exiting t.Ctl read loop - channel closed??")
-	}()
+// tunCloseOp returns the packet type with which our side closes a
+// tunnel connection.
+func (hc *Conn) tunCloseOp() byte {
+	if hc.server {
+		return CSOTunDisconn
+	}
+	return CSOTunHangup
 }
@@ -0,0 +1,287 @@
+package xsnet
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// _tunSession returns the client end of a pipe session, both ends of
+// which are read (see _readLoop) until it is closed. Tunnels are
+// enabled (as by a login) if auth is set.
+func _tunSession(t *testing.T, name string, auth bool) *Conn {
+	l, err := Listen("pipe", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := l.Accept()
+		_ = l.Close()
+		if err != nil {
+			return
+		}
+		defer s.Close() // nolint: errcheck
+		if auth {
+			s.(*Conn).EnableTunnels()
+		}
+		_readLoop(s.(*Conn))
+	}()
+	hc, err := Dial("pipe", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go _readLoop(hc)
+	return hc
+}
+
+// _echoServer returns a listener on addr echoing all it reads.
+func _echoServer(t *testing.T, addr string) net.Listener {
+	el, err := net.Listen("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	return el
+}
+
+// _freePort returns a (just) unused local port.
+func _freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// _dialRetry dials 127.0.0.1:port until something listens there.
+func _dialRetry(t *testing.T, port uint16) net.Conn {
+	var c net.Conn
+	var err error
+	for try := 0; try < 50; try++ {
+		if c, err = net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(int(port))); err == nil {
+			return c
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+// _echoes checks that msg written to c comes back.
+func _echoes(c net.Conn, msg string) bool {
+	go func() { _, _ = c.Write([]byte(msg)) }()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(msg))
+	_, err := io.ReadFull(c, got)
+	return err == nil && string(got) == msg
+}
+
+// _tunConnect asks the server for a connection over tunnel lport, as
+// the client's listener does, and returns its answer.
+func _tunConnect(t *testing.T, hc *Conn, lport, rport uint16) error {
+	s := &tunStream{lport: lport, dataOp: CSOTunData, closeOp: CSOTunHangup}
+	if err := hc.addStream(s, func(id uint16) []byte { return tunHdr(lport, rport, id) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hc.WritePacket(s.hdr(), CSOTunSetup); err != nil {
+		t.Fatal(err)
+	}
+	return s.waitAck(10 * time.Second)
+}
+
+// A tunnel given a host reaches rport on that host, not the server's,
+// once the server allows it.
+func TestTunnelToHost(t *testing.T) {
+	// The service: echo, on a loopback address the server won't dial
+	// by default
+	if l, err := net.Listen("tcp4", "127.0.0.2:0"); err != nil {
+		t.Skip("no 127.0.0.2:", err)
+	} else {
+		_ = l.Close()
+	}
+	el := _echoServer(t, "127.0.0.2:0")
+	defer el.Close() // nolint: errcheck
+	rport := uint16(el.Addr().(*net.TCPAddr).Port)
+
+	hc := _tunSession(t, "tunhost", true)
+	defer hc.Close() // nolint: errcheck
+	lport := _freePort(t)
+	if err := hc.RequestTunnel(lport, "127.0.0.2", rport); err != nil {
+		t.Fatal(err)
+	}
+	if err := _tunConnect(t, hc, lport, rport); err == nil || err.Error() != "connection refused" {
+		t.Fatal("tunnel to host not refused by default:", err)
+	}
+	if !hc.TunIsNil(lport) {
+		t.Fatal("tunnel to host set up by default")
+	}
+
+	AllowDynTunnels(true)
+	defer AllowDynTunnels(false)
+	lport = _freePort(t)
+	if err := hc.RequestTunnel(lport, "127.0.0.2", rport); err != nil {
+		t.Fatal(err)
+	}
+	c := _dialRetry(t, lport)
+	defer c.Close() // nolint: errcheck
+	if !_echoes(c, "hello, tunnel to 127.0.0.2") {
+		t.Fatal("no echo")
+	}
+}
+
+// Tunnels carry many connections at once, and may share an rport.
+func TestTunnelConcurrent(t *testing.T) {
+	el := _echoServer(t, "127.0.0.1:0")
+	defer el.Close() // nolint: errcheck
+	rport := uint16(el.Addr().(*net.TCPAddr).Port)
+
+	hc := _tunSession(t, "tunconc", true)
+	defer hc.Close() // nolint: errcheck
+	lports := []uint16{_freePort(t), _freePort(t)}
+	for _, lport := range lports {
+		if err := hc.RequestTunnel(lport, "", rport); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All open before any is used
+	var conns []net.Conn
+	for i := 0; i < 8; i++ {
+		c := _dialRetry(t, lports[i%2])
+		defer c.Close() // nolint: errcheck
+		conns = append(conns, c)
+	}
+	done := make(chan bool)
+	for i := range conns {
+		go func(i int) {
+			done <- _echoes(conns[i], "hello, tunnel conn "+strconv.Itoa(i))
+		}(len(conns) - 1 - i)
+	}
+	for range conns {
+		if !<-done {
+			t.Fatal("no echo")
+		}
+	}
+}
+
+// Tunnel requests made before login (EnableTunnels) are refused.
+func TestTunnelBeforeAuth(t *testing.T) {
+	el := _echoServer(t, "127.0.0.1:0")
+	defer el.Close() // nolint: errcheck
+	rport := uint16(el.Addr().(*net.TCPAddr).Port)
+
+	hc := _tunSession(t, "tunauth", false)
+	defer hc.Close() // nolint: errcheck
+	lport, revport := _freePort(t), _freePort(t)
+	if err := hc.RequestTunnel(lport, "", rport); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.RequestRevTunnel(revport, "127.0.0.1", rport); err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.RequestUDPTunnel(lport, "", rport); err != nil {
+		t.Fatal(err)
+	}
+
+	// A connection over the (unacknowledged) tunnel, as a client might
+	// ask for one anyway; refused after the requests above are
+	if err := _tunConnect(t, hc, lport, rport); err == nil || err.Error() != "connection refused" {
+		t.Fatal("tunnel connection before auth not refused:", err)
+	}
+	if !hc.TunIsNil(lport) {
+		t.Fatal("tunnel set up before auth")
+	}
+	if hc.forgetRevTunnel(revport) {
+		t.Fatal("reverse tunnel not refused before auth")
+	}
+	if hc.udpTunnel(lport) != nil {
+		t.Fatal("UDP tunnel not refused before auth")
+	}
+	if c, err := net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(int(revport))); err == nil {
+		_ = c.Close()
+		t.Fatal("server listening for reverse tunnel before auth")
+	}
+
+	AllowDynTunnels(true)
+	defer AllowDynTunnels(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if c, err := hc.DialTunnel(ctx, el.Addr().String()); err == nil {
+		_ = c.Close()
+		t.Fatal("dynamic tunnel dialled before auth")
+	}
+}
+
+// A tunnel connection whose reader stalls holds up neither the session
+// nor its other connections.
+func TestTunnelStalled(t *testing.T) {
+	// The stalled connection's service sends without end
+	sl, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close() // nolint: errcheck
+	go func() {
+		for {
+			c, err := sl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, tunChunk)
+				for {
+					if _, err := c.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	el := _echoServer(t, "127.0.0.1:0")
+	defer el.Close() // nolint: errcheck
+
+	hc := _tunSession(t, "tunstall", true)
+	defer hc.Close() // nolint: errcheck
+	AllowDynTunnels(true)
+	defer AllowDynTunnels(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// (never read)
+	s, err := hc.DialTunnel(ctx, sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close() // nolint: errcheck
+	time.Sleep(200 * time.Millisecond)
+
+	c, err := hc.DialTunnel(ctx, el.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() // nolint: errcheck
+	msg := make([]byte, 4*tunWindow*tunChunk)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() { _, _ = c.Write(msg) }()
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil || string(got) != string(msg) {
+		t.Fatal("no echo past a stalled stream:", err)
+	}
+}
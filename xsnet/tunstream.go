@@ -0,0 +1,334 @@
+// tunstream.go - Tunnel streams: connections multiplexed over a Conn
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// Tunnel streams
+// --
+// Each connection carried by a tunnel (fixed, reverse or dynamic) is a
+// stream with its own id, which heads all of its packets. Ids are
+// chosen by the side which opens the stream: the client's from 1 up,
+// the server's from 0x8000 up, so either may open streams at any time.
+// Id 0 is never used for a stream (tunnel packets with id 0 concern
+// the tunnel as a whole).
+//
+// Data sent on a stream is cut into chunks of at most tunChunk bytes,
+// each one packet. Each side may send at most tunWindow data packets
+// beyond those the other has read; as its reader drains them, the
+// receiver returns credit (CSOTunCredit packets) for more. So a stream
+// whose reader stalls stops its sender, not the Conn's reader (which
+// resets a stream sent beyond its credit).
+// --
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"blitter.com/go/xs/logger"
+)
+
+// tunChunk is the most data sent in each stream data packet (which
+// must fit, with its header, in a single frame).
+const tunChunk = 8 * 1024
+
+// tunWindow is the number of data packets either side of a stream may
+// send before the other returns credit for them.
+const tunWindow = 16
+
+// tunStreams holds a Conn's tunnel streams, by id.
+type tunStreams struct {
+	sync.Mutex
+	streams map[uint16]*tunStream
+	next    uint16 // last id we chose
+}
+
+func newTunStreams() *tunStreams {
+	return &tunStreams{streams: make(map[uint16]*tunStream)}
+}
+
+// tunStream is a net.Conn carried over a tunnel.
+type tunStream struct {
+	hc    *Conn
+	id    uint16
+	addr  string // host:port it connects to (for messages)
+	lport uint16 // fixed tunnels: the tunnel's lport (0 for dynamic)
+
+	pfx     []byte // heads each packet of the stream
+	dataOp  byte   // packet type of its data
+	closeOp byte   // packet type to close it
+
+	data   chan []byte   // from the peer; closed when it closes
+	buf    []byte        // unread rest of the last data
+	read   int           // data packets read since we last gave credit
+	credit chan struct{} // one per data packet we may send
+	done   chan struct{} // closed by Close()
+	once   sync.Once
+	peer   bool       // closed by the peer (guarded by tunStreams lock)
+	ack    chan error // opener: result of the peer's dial
+}
+
+// addStream sets up stream s (its addr, lport and ops given) over hc,
+// registered with id s.id or, if it is 0, a new id of ours. pfx(id)
+// gives its packet header.
+func (hc *Conn) addStream(s *tunStream, pfx func(id uint16) []byte) error {
+	d := hc.streams
+	d.Lock()
+	defer d.Unlock()
+	if s.id == 0 {
+		base := uint16(0)
+		if hc.server {
+			base = 0x8000
+		}
+		for n := 0; ; n++ {
+			if n >= 0x7fff {
+				return errors.New("too many tunnel streams")
+			}
+			d.next = (d.next+1)&0x7fff | base
+			if _, ok := d.streams[d.next]; !ok && d.next != 0 {
+				break
+			}
+		}
+		s.id = d.next
+	} else if _, ok := d.streams[s.id]; ok {
+		return errors.New("tunnel stream id in use")
+	}
+	s.hc = hc
+	s.pfx = pfx(s.id)
+	s.data = make(chan []byte, tunWindow)
+	s.credit = make(chan struct{}, tunWindow)
+	for i := 0; i < tunWindow; i++ {
+		s.credit <- struct{}{}
+	}
+	s.done = make(chan struct{})
+	s.ack = make(chan error, 1)
+	d.streams[s.id] = s
+	return nil
+}
+
+// stream returns hc's stream with the given id, or nil.
+func (hc *Conn) stream(id uint16) *tunStream {
+	hc.streams.Lock()
+	defer hc.streams.Unlock()
+	return hc.streams.streams[id]
+}
+
+// hdr returns a copy of s's packet header, with room for a chunk.
+func (s *tunStream) hdr() []byte {
+	return append(make([]byte, 0, len(s.pfx)+tunChunk), s.pfx...)
+}
+
+func (s *tunStream) Read(b []byte) (n int, err error) {
+	if len(s.buf) == 0 {
+		select {
+		case d, ok := <-s.data:
+			if !ok {
+				return 0, io.EOF
+			}
+			s.buf = d
+			s.giveCredit()
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n = copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *tunStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		select {
+		case <-s.done:
+			return n, io.ErrClosedPipe
+		default:
+		}
+		select {
+		case <-s.credit:
+		case <-s.done:
+			return n, io.ErrClosedPipe
+		}
+		c := len(b)
+		if c > tunChunk {
+			c = tunChunk
+		}
+		if _, err = s.hc.WritePacket(append(s.hdr(), b[:c]...), s.dataOp); err != nil {
+			return n, err
+		}
+		n += c
+		b = b[c:]
+	}
+	return n, nil
+}
+
+// Close closes the stream at both ends.
+func (s *tunStream) Close() error {
+	if s.closeLocal() {
+		d := s.hc.streams
+		d.Lock()
+		tell := !s.peer
+		d.Unlock()
+		if tell {
+			s.hc.WritePacket(s.hdr(), s.closeOp) // nolint: errcheck
+		}
+	}
+	return nil
+}
+
+// closeLocal closes s without telling the peer, reporting whether s
+// was open.
+func (s *tunStream) closeLocal() (wasOpen bool) {
+	s.once.Do(func() {
+		wasOpen = true
+		close(s.done)
+		d := s.hc.streams
+		d.Lock()
+		if d.streams[s.id] == s {
+			delete(d.streams, s.id)
+		}
+		d.Unlock()
+	})
+	return
+}
+
+// closedByPeer handles the peer's close of s: data already received
+// may still be read, then Read() returns io.EOF. (Only the reader of
+// the Conn sends on s.data, so may close it.)
+func (s *tunStream) closedByPeer() (wasOpen bool) {
+	d := s.hc.streams
+	d.Lock()
+	if d.streams[s.id] == s {
+		delete(d.streams, s.id)
+		wasOpen = true
+		s.peer = true
+		close(s.data)
+	}
+	d.Unlock()
+	return
+}
+
+// got queues data p from the peer for reading. It never blocks: a
+// peer which sends beyond its credit has its stream reset.
+func (s *tunStream) got(p []byte) {
+	select {
+	case s.data <- p:
+	case <-s.done:
+	default:
+		logger.LogDebug(fmt.Sprintf("[Tunnel stream %d sent beyond its credit, closing]", s.id))
+		_ = s.Close()
+	}
+}
+
+// giveCredit counts a data packet read from s, returning credit for
+// packets read to the peer once half a window's worth are.
+func (s *tunStream) giveCredit() {
+	s.read++
+	if s.read < tunWindow/2 {
+		return
+	}
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint16(p[0:2], s.id)
+	binary.BigEndian.PutUint16(p[2:4], uint16(s.read))
+	s.read = 0
+	s.hc.WritePacket(p, CSOTunCredit) // nolint: errcheck
+}
+
+// gotTunCredit handles credit packet p [id:n] from the peer, allowing
+// stream id to send n more data packets.
+func (hc *Conn) gotTunCredit(p []byte) {
+	if len(p) < 4 {
+		logger.LogDebug("[Truncated tunnel credit packet]")
+		return
+	}
+	s := hc.stream(binary.BigEndian.Uint16(p[0:2]))
+	if s == nil {
+		return
+	}
+	for n := binary.BigEndian.Uint16(p[2:4]); n > 0; n-- {
+		select {
+		case s.credit <- struct{}{}:
+		default:
+			// (more than a window; ignored)
+			return
+		}
+	}
+}
+
+// acked reports the result of the peer's dial for s (nil if it
+// connected) to its opener.
+func (s *tunStream) acked(err error) {
+	select {
+	case s.ack <- err:
+	default:
+	}
+}
+
+// waitAck waits for the peer to dial for s, up to timeout, closing s
+// if it could not.
+func (s *tunStream) waitAck(timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-s.ack:
+		if err != nil {
+			s.closeLocal()
+		}
+		return err
+	case <-s.done:
+		return errors.New("connection closed")
+	case <-t.C:
+		_ = s.Close()
+		return errors.New("timed out waiting for tunnel peer")
+	}
+}
+
+// relay carries data both ways between c and s until either closes,
+// then closes both.
+func (s *tunStream) relay(c net.Conn) {
+	go func() {
+		_, _ = io.Copy(c, s)
+		_ = c.Close()
+	}()
+	_, _ = io.Copy(s, c)
+	_ = c.Close()
+	_ = s.Close()
+}
+
+func (s *tunStream) LocalAddr() net.Addr  { return s.hc.LocalAddr() }
+func (s *tunStream) RemoteAddr() net.Addr { return s.hc.RemoteAddr() }
+
+// Deadlines are not supported on tunnel streams (the calls succeed,
+// but have no effect).
+func (s *tunStream) SetDeadline(t time.Time) error      { return nil }
+func (s *tunStream) SetReadDeadline(t time.Time) error  { return nil }
+func (s *tunStream) SetWriteDeadline(t time.Time) error { return nil }
+
+// tunStreamsOf returns the streams of hc's fixed tunnel on lport, or
+// all of its streams if lport is 0.
+func (hc *Conn) tunStreamsOf(lport uint16) (streams []*tunStream) {
+	d := hc.streams
+	d.Lock()
+	defer d.Unlock()
+	for _, s := range d.streams {
+		if lport == 0 || s.lport == lport {
+			streams = append(streams, s)
+		}
+	}
+	return
+}
+
+// closeStreams closes all of hc's tunnel streams, locally.
+func (hc *Conn) closeStreams() {
+	for _, s := range hc.tunStreamsOf(0) {
+		s.closeLocal()
+	}
+}
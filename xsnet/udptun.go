@@ -0,0 +1,427 @@
+// udptun.go - UDP tunnels: datagrams forwarded by the server
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// UDP tunnels
+// --
+// 1. client is given (lport, [host,] rport) by local user
+// 2. client sends [CSOTunUDPSetup:lport:rport[:host]] to server
+// client=> [CSOTunUDPSetup:lport:rport[:host]] =>remhost
+//
+// remhost records the tunnel (to host:rport, or its own rport if no
+// host was given) and replies
+// client<= [CSOTunUDPSetupAck:lport:rport[:host]] <=remhost
+//   ... or if the client has not logged in (or gave a host, and the
+//   server does not allow tunnels to other hosts),
+// client<= [CSOTunUDPRefused:lport:rport[:host]] <=remhost
+//
+// client listens on UDP lport (of localhost) once acknowledged, if it
+// asked for the tunnel. Each datagram received there is sent with its
+// source address
+// client=> [CSOTunUDPData:lport:rport:srclen:src:data] =>remhost
+//
+// remhost sends it on to host:rport from a UDP socket of its own for
+// each src, and each datagram received back on that socket returns
+// to the client as
+// client<= [CSOTunUDPData:lport:rport:srclen:src:data] <=remhost
+// for the client to send to src from lport. A src's socket on remhost
+// is closed once unused for udpIdle. Tunnels and sockets are closed
+// with the Conn.
+//
+// Datagrams too big to fit in a single frame are dropped, as are those
+// from new sources once a tunnel has udpMaxFlows sockets.
+// --
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"blitter.com/go/xs/logger"
+)
+
+// udpIdle is how long the server keeps a source's socket after its
+// last datagram either way.
+const udpIdle = 2 * time.Minute
+
+// udpMaxData is the most data of a datagram which may be carried.
+const udpMaxData = MAX_FRAG_LEN - 64
+
+// udpMaxFlows is the most client sources (so server sockets) of each
+// UDP tunnel at once.
+const udpMaxFlows = 64
+
+// udpMaxPending is the most datagrams kept for a source while the
+// server opens its socket.
+const udpMaxPending = 8
+
+type (
+	// udpTun is a UDP tunnel, known by lport at both ends.
+	udpTun struct {
+		lport, rport uint16
+		host         string // host dialled by server for rport ("" for itself)
+
+		pc    net.PacketConn      // client: listener on lport (nil until acknowledged)
+		flows map[string]*udpFlow // server: sockets, by client source address
+	}
+
+	// udpFlow is the server's socket for one client source address.
+	// Its fields are guarded by the Conn lock.
+	udpFlow struct {
+		c       *net.UDPConn // nil while being opened
+		pending [][]byte     // datagrams to send once c is open
+		last    time.Time    // of the last datagram either way
+	}
+)
+
+// udpHdr returns the [lport:rport:srclen:src] header of UDP tunnel
+// data packets.
+func udpHdr(lport, rport uint16, src string) []byte {
+	b := make([]byte, 5, 5+len(src))
+	binary.BigEndian.PutUint16(b[0:2], lport)
+	binary.BigEndian.PutUint16(b[2:4], rport)
+	b[4] = byte(len(src))
+	return append(b, src...)
+}
+
+// udpTunnel returns hc's UDP tunnel on lport, or nil.
+func (hc *Conn) udpTunnel(lport uint16) *udpTun {
+	hc.Lock()
+	defer hc.Unlock()
+	return (*hc.udpTuns)[lport]
+}
+
+// RequestUDPTunnel asks the server to set up a tunnel for datagrams
+// from UDP lport to rport on host (as dialled by the server; "" for
+// the server itself). The client listens on lport of localhost once
+// the server acknowledges it.
+func (hc *Conn) RequestUDPTunnel(lport uint16, host string, rport uint16) error {
+	if hc.features&FeatTunUDP == 0 {
+		return errors.New("server does not support UDP tunnels")
+	}
+	if host != "" && hc.features&FeatTunHost == 0 {
+		return errors.New("server does not support tunnels to other hosts")
+	}
+	if lport == 0 || rport == 0 {
+		return errors.New("tunnel ports may not be 0")
+	}
+	// Recorded now, unacknowledged, so only acks of our requests
+	// are acted on
+	t := &udpTun{lport: lport, rport: rport, host: host}
+	hc.Lock()
+	if (*hc.udpTuns)[lport] != nil {
+		hc.Unlock()
+		return fmt.Errorf("UDP lport %d already tunnelled", lport)
+	}
+	(*hc.udpTuns)[lport] = t
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[Client sending CSOTunUDPSetup [%d:%s:%d]]", lport, host, rport))
+	_, err := hc.WritePacket(append(tunHdr(lport, rport, 0)[0:4], host...), CSOTunUDPSetup)
+	if err != nil {
+		hc.forgetUDPTunnel(t)
+	}
+	return err
+}
+
+// requestedUDPTunnel returns the client's UDP tunnel from lport to
+// host:rport if it has been requested but not yet acknowledged, or nil.
+func (hc *Conn) requestedUDPTunnel(lport uint16, host string, rport uint16) *udpTun {
+	hc.Lock()
+	defer hc.Unlock()
+	t := (*hc.udpTuns)[lport]
+	if t == nil || t.pc != nil || t.rport != rport || t.host != host {
+		return nil
+	}
+	return t
+}
+
+// forgetUDPTunnel drops the client's unacknowledged UDP tunnel t.
+func (hc *Conn) forgetUDPTunnel(t *udpTun) {
+	hc.Lock()
+	defer hc.Unlock()
+	if t.pc == nil && (*hc.udpTuns)[t.lport] == t {
+		delete(*hc.udpTuns, t.lport)
+	}
+}
+
+// StartClientUDPTunnel listens on UDP lport of localhost, sending each
+// datagram received there over the tunnel, if the client asked for
+// the tunnel (and is not already listening).
+func (hc *Conn) StartClientUDPTunnel(lport uint16, host string, rport uint16) {
+	t := hc.requestedUDPTunnel(lport, host, rport)
+	if t == nil {
+		logger.LogDebug(fmt.Sprintf("[ClientUDPTun] Ignoring ack of UDP tunnel [%d:%s:%d] not asked for", lport, host, rport))
+		return
+	}
+	pc, e := net.ListenPacket("udp4", fmt.Sprintf("127.0.0.1:%d", lport))
+	if e != nil {
+		logger.LogDebug(fmt.Sprintf("[ClientUDPTun] Could not get UDP lport %d! (%s)", lport, e))
+		hc.forgetUDPTunnel(t)
+		return
+	}
+	hc.Lock()
+	if (*hc.udpTuns)[lport] != t || t.pc != nil {
+		hc.Unlock()
+		_ = pc.Close()
+		return
+	}
+	t.pc = pc
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[ClientUDPTun] Listening for client tunnel UDP port %d", lport))
+
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, src, e := pc.ReadFrom(b)
+			if e != nil {
+				logger.LogDebug(fmt.Sprintf("[ClientUDPTun] ReadFrom() got error(%v), closing UDP tunnel %d", e, lport))
+				return
+			}
+			if n > udpMaxData {
+				logger.LogDebug(fmt.Sprintf("[ClientUDPTun] Dropping %d-byte datagram from %v", n, src))
+				continue
+			}
+			if _, e = hc.WritePacket(append(udpHdr(lport, rport, src.String()), b[:n]...), CSOTunUDPData); e != nil {
+				logger.LogDebug(fmt.Sprintf("[ClientUDPTun] Error writing to UDP tunnel %d: %s", lport, e))
+				return
+			}
+		}
+	}()
+}
+
+// StartServerUDPTunnel records the client's UDP tunnel from lport to
+// rport on host ("" for the server itself).
+func (hc *Conn) StartServerUDPTunnel(lport uint16, host string, rport uint16) {
+	if host != "" && !dynTunsAllowed {
+		logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Refusing UDP tunnel [%d:%s:%d]: tunnels to other hosts disabled", lport, host, rport))
+		hc.WritePacket(append(tunHdr(lport, rport, 0)[0:4], host...), CSOTunUDPRefused) // nolint: errcheck
+		return
+	}
+	hc.Lock()
+	if t := (*hc.udpTuns)[lport]; t == nil || t.rport != rport || t.host != host {
+		if t != nil {
+			closeUDPFlows(t)
+		}
+		(*hc.udpTuns)[lport] = &udpTun{lport: lport, rport: rport, host: host,
+			flows: make(map[string]*udpFlow)}
+	}
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Writing CSOTunUDPSetupAck [%d:%s:%d]", lport, host, rport))
+	hc.WritePacket(append(tunHdr(lport, rport, 0)[0:4], host...), CSOTunUDPSetupAck) // nolint: errcheck
+}
+
+// serverUDPData sends datagram data from the client's src on, over
+// src's socket for t. If src has none one is opened, in the
+// background, holding data until it is.
+func (hc *Conn) serverUDPData(t *udpTun, src string, data []byte) {
+	hc.Lock()
+	f := t.flows[src]
+	switch {
+	case f == nil && len(t.flows) >= udpMaxFlows:
+		hc.Unlock()
+		logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Dropping datagram from %s: too many sources for UDP tun [%d:%d]", src, t.lport, t.rport))
+		return
+	case f == nil:
+		f = &udpFlow{pending: [][]byte{data}, last: time.Now()}
+		t.flows[src] = f
+		hc.Unlock()
+		go hc.openUDPFlow(t, src, f)
+		return
+	case f.c == nil:
+		if len(f.pending) < udpMaxPending {
+			f.pending = append(f.pending, data)
+		}
+		hc.Unlock()
+		return
+	}
+	f.last = time.Now()
+	c := f.c
+	hc.Unlock()
+	if _, e := c.Write(data); e != nil {
+		logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Write to %v for %s: %s", c.RemoteAddr(), src, e))
+	}
+}
+
+// openUDPFlow opens f, src's socket for t, sending on the datagrams
+// held for it, then serves it (see serverUDPFlow).
+func (hc *Conn) openUDPFlow(t *udpTun, src string, f *udpFlow) {
+	addr := fmt.Sprintf(":%d", t.rport)
+	if t.host != "" {
+		addr = net.JoinHostPort(t.host, strconv.Itoa(int(t.rport)))
+	}
+	var ra *net.UDPAddr
+	var e error
+	if t.host != "" && !dynTunsAllowed {
+		e = errors.New("tunnels to other hosts disabled")
+	} else {
+		ra, e = net.ResolveUDPAddr("udp4", addr)
+	}
+	var c *net.UDPConn
+	if e == nil {
+		c, e = net.DialUDP("udp4", nil, ra)
+	}
+	hc.Lock()
+	if e != nil || (*hc.udpTuns)[t.lport] != t || t.flows[src] != f {
+		if t.flows[src] == f {
+			delete(t.flows, src)
+		}
+		hc.Unlock()
+		if e != nil {
+			logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Could not open socket to %s for %s: %s", addr, src, e))
+		} else {
+			_ = c.Close()
+		}
+		return
+	}
+	f.c = c
+	pending := f.pending
+	f.pending = nil
+	hc.Unlock()
+	logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Opened socket %v to %s for %s", c.LocalAddr(), addr, src))
+	for _, data := range pending {
+		if _, e = c.Write(data); e != nil {
+			logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Write to %v for %s: %s", c.RemoteAddr(), src, e))
+		}
+	}
+	hc.serverUDPFlow(t, src, f)
+}
+
+// serverUDPFlow returns datagrams received on f, src's socket, to the
+// client, until f is unused for udpIdle.
+func (hc *Conn) serverUDPFlow(t *udpTun, src string, f *udpFlow) {
+	defer f.c.Close() // nolint: errcheck
+	hdr := udpHdr(t.lport, t.rport, src)
+	b := make([]byte, 64*1024)
+	for {
+		hc.Lock()
+		idle := time.Until(f.last.Add(udpIdle))
+		if idle <= 0 {
+			if t.flows[src] == f {
+				delete(t.flows, src)
+			}
+			hc.Unlock()
+			logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Closing idle socket for %s", src))
+			return
+		}
+		hc.Unlock()
+		_ = f.c.SetReadDeadline(time.Now().Add(idle))
+		n, e := f.c.Read(b)
+		if e != nil {
+			if ne, ok := e.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			hc.Lock()
+			if t.flows[src] == f {
+				delete(t.flows, src)
+			}
+			hc.Unlock()
+			return
+		}
+		if n > udpMaxData {
+			logger.LogDebug(fmt.Sprintf("[ServerUDPTun] Dropping %d-byte datagram for %s", n, src))
+			continue
+		}
+		hc.Lock()
+		f.last = time.Now()
+		hc.Unlock()
+		if _, e = hc.WritePacket(append(hdr[:len(hdr):len(hdr)], b[:n]...), CSOTunUDPData); e != nil {
+			return
+		}
+	}
+}
+
+// gotUDPTun handles UDP tunnel packet p of type op.
+func (hc *Conn) gotUDPTun(op byte, p []byte) {
+	if len(p) < 4 {
+		logger.LogDebug(fmt.Sprintf("[Truncated UDP tunnel packet (type %d)]", op))
+		return
+	}
+	lport := binary.BigEndian.Uint16(p[0:2])
+	rport := binary.BigEndian.Uint16(p[2:4])
+
+	switch op {
+	case CSOTunUDPSetup:
+		if !hc.server {
+			return
+		}
+		logger.LogDebug(fmt.Sprintf("[Server] Got CSOTunUDPSetup [%d:%s:%d]", lport, p[4:], rport))
+		if !hc.tunnelsEnabled() {
+			logger.LogDebug(fmt.Sprintf("[Server] Refusing UDP tunnel [%d:%s:%d] before login", lport, p[4:], rport))
+			hc.WritePacket(p, CSOTunUDPRefused) // nolint: errcheck
+			return
+		}
+		hc.StartServerUDPTunnel(lport, string(p[4:]), rport)
+	case CSOTunUDPSetupAck:
+		if hc.server {
+			return
+		}
+		logger.LogDebug(fmt.Sprintf("[Client] Got CSOTunUDPSetupAck [%d:%s:%d]", lport, p[4:], rport))
+		hc.StartClientUDPTunnel(lport, string(p[4:]), rport)
+	case CSOTunUDPRefused:
+		if hc.server {
+			return
+		}
+		if t := hc.requestedUDPTunnel(lport, string(p[4:]), rport); t != nil {
+			hc.forgetUDPTunnel(t)
+			logger.LogErr(fmt.Sprintf("[Client] Server refused UDP tunnel [%d:%d]", lport, rport)) // nolint: gosec,errcheck
+		}
+	case CSOTunUDPData:
+		if len(p) < 5 || len(p) < 5+int(p[4]) {
+			logger.LogDebug("[Truncated CSOTunUDPData packet]")
+			return
+		}
+		src, data := string(p[5:5+int(p[4])]), p[5+int(p[4]):]
+		t := hc.udpTunnel(lport)
+		if t == nil || (!hc.server && t.pc == nil) {
+			logger.LogDebug(fmt.Sprintf("[Datagram for closed UDP tun [%d:%d]]", lport, rport))
+			return
+		}
+		if hc.logTunActivity {
+			logger.LogDebug(fmt.Sprintf("[Got %d-byte datagram for UDP tun [%d:%d] (%s)]", len(data), lport, rport, src))
+		}
+		if hc.server {
+			hc.serverUDPData(t, src, data)
+			return
+		}
+		a, e := net.ResolveUDPAddr("udp", src)
+		if e == nil {
+			_, e = t.pc.WriteTo(data, a)
+		}
+		if e != nil {
+			logger.LogDebug(fmt.Sprintf("[ClientUDPTun] WriteTo(%s): %s", src, e))
+		}
+	}
+}
+
+// closeUDPFlows closes the server's sockets for t (with the Conn lock
+// held).
+func closeUDPFlows(t *udpTun) {
+	for src, f := range t.flows {
+		if f.c != nil {
+			_ = f.c.Close()
+		}
+		delete(t.flows, src)
+	}
+}
+
+// closeUDPTuns closes all of hc's UDP tunnels.
+func (hc *Conn) closeUDPTuns() {
+	hc.Lock()
+	defer hc.Unlock()
+	for lport, t := range *hc.udpTuns {
+		if t.pc != nil {
+			_ = t.pc.Close()
+		}
+		closeUDPFlows(t)
+		delete(*hc.udpTuns, lport)
+	}
+}
@@ -0,0 +1,157 @@
+package xsnet
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Datagrams from each client source reach the server's rport, and
+// the replies return to that source.
+func TestUDPTunnel(t *testing.T) {
+	// The service: UDP echo
+	es, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close() // nolint: errcheck
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, a, err := es.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = es.WriteTo(b[:n], a)
+		}
+	}()
+	rport := uint16(es.LocalAddr().(*net.UDPAddr).Port)
+
+	// A free UDP port for the client to listen on
+	lp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lport := uint16(lp.LocalAddr().(*net.UDPAddr).Port)
+	_ = lp.Close()
+
+	hc := _tunSession(t, "udptun", true)
+	defer hc.Close() // nolint: errcheck
+	if err = hc.RequestUDPTunnel(lport, "", rport); err != nil {
+		t.Fatal(err)
+	}
+
+	laddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(lport)}
+	for i := 0; i < 3; i++ {
+		c, err := net.DialUDP("udp4", nil, laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() // nolint: errcheck
+		msg := "hello, UDP tunnel " + strconv.Itoa(i)
+		b := make([]byte, 1024)
+		var n int
+		for try := 0; try < 50; try++ { // until the client listens
+			_, _ = c.Write([]byte(msg))
+			_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, err = c.Read(b); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil || string(b[:n]) != msg {
+			t.Fatalf("source %d: got %q, %v", i, b[:n], err)
+		}
+	}
+}
+
+// UDP tunnels given a host are refused unless the server allows them.
+func TestUDPTunnelToHost(t *testing.T) {
+	hc := _tunSession(t, "udptunhost", true)
+	defer hc.Close() // nolint: errcheck
+	lport, rport := _freePort(t), _freePort(t)
+	if err := hc.RequestUDPTunnel(lport, "127.0.0.1", rport); err != nil {
+		t.Fatal(err)
+	}
+	// Any round trip: the server's answer to the request precedes it
+	_ = _tunConnect(t, hc, _freePort(t), rport)
+	if hc.udpTunnel(lport) != nil {
+		t.Fatal("UDP tunnel to host not refused by default")
+	}
+
+	AllowDynTunnels(true)
+	defer AllowDynTunnels(false)
+	if err := hc.RequestUDPTunnel(lport, "127.0.0.1", rport); err != nil {
+		t.Fatal(err)
+	}
+	_ = _tunConnect(t, hc, _freePort(t), rport)
+	if hc.udpTunnel(lport) == nil {
+		t.Fatal("UDP tunnel to host refused when allowed")
+	}
+}
+
+// Acks of UDP tunnels not asked for are ignored, and each tunnel
+// serves at most udpMaxFlows sources at once.
+func TestUDPTunnelLimits(t *testing.T) {
+	es, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close() // nolint: errcheck
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			n, a, err := es.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, _ = es.WriteTo(b[:n], a)
+		}
+	}()
+	rport := uint16(es.LocalAddr().(*net.UDPAddr).Port)
+
+	lp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lport := uint16(lp.LocalAddr().(*net.UDPAddr).Port)
+	_ = lp.Close()
+
+	hc := _tunSession(t, "udplimits", true)
+	defer hc.Close() // nolint: errcheck
+	hc.StartClientUDPTunnel(lport, "", rport)
+	if hc.udpTunnel(lport) != nil {
+		t.Fatal("listening for UDP tunnel not asked for")
+	}
+	if err = hc.RequestUDPTunnel(lport, "", rport); err != nil {
+		t.Fatal(err)
+	}
+
+	laddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(lport)}
+	echoes := func(c *net.UDPConn, tries int) bool {
+		b := make([]byte, 1024)
+		for try := 0; try < tries; try++ {
+			_, _ = c.Write([]byte("hello"))
+			_ = c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, err := c.Read(b); err == nil && string(b[:n]) == "hello" {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+	for i := 0; i <= udpMaxFlows; i++ {
+		c, err := net.DialUDP("udp4", nil, laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close() // nolint: errcheck
+		if i < udpMaxFlows && !echoes(c, 50) {
+			t.Fatalf("source %d: no echo", i)
+		}
+		if i == udpMaxFlows && echoes(c, 3) {
+			t.Fatalf("source %d echoed, over the limit", i)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// ws.go - WebSocket transport
+
+// Copyright (c) 2017-2020 Russell Magee
+// Licensed under the terms of the MIT license (see LICENSE.mit in this
+// distribution)
+//
+// golang implementation by Russ Magee (rmagee_at_gmail.com)
+
+package xsnet
+
+// The "ws" and "wss" transports carry an xsnet connection (KEx and
+// framing unchanged) in the binary messages of a WebSocket, for
+// networks which only let HTTP(S) out, perhaps through a proxy.
+//
+// Addresses are ws:// or wss:// URLs, or host:port[/path] (the path
+// defaulting to WSPathDefault). The server listens on the given
+// host:port and accepts WebSocket upgrades on the path only, so it may
+// also sit behind an HTTP reverse proxy; "wss" servers need a
+// certificate, set with SetWSTLSConfig().
+//
+// Clients may connect through an HTTP CONNECT or SOCKS5 proxy, as for
+// TCP (see proxy.go), though from the environment ws uses $HTTP_PROXY
+// rather than $HTTPS_PROXY.
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSPathDefault is the HTTP path of the WebSocket transports if an
+// address doesn't give one.
+const WSPathDefault = "/xs"
+
+var wsTLSConfig *tls.Config
+
+// SetWSTLSConfig sets the TLS settings of the "wss" transport: the
+// server certificate(s) for Listen() and, for clients whose Config
+// doesn't give any, the roots used to verify servers (nil for the
+// system roots).
+func SetWSTLSConfig(c *tls.Config) {
+	wsTLSConfig = c
+}
+
+// wsURL returns addr as a URL of the given scheme ("ws" or "wss").
+func wsURL(scheme, addr string) (u *url.URL, err error) {
+	if !strings.Contains(addr, "://") {
+		addr = scheme + "://" + addr
+	}
+	u, err = url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != scheme {
+		return nil, fmt.Errorf("%s: bad URL scheme %q", scheme, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: no host in %q", scheme, addr)
+	}
+	if u.Path == "" {
+		u.Path = WSPathDefault
+	}
+	return u, nil
+}
+
+// wsConn is a net.Conn over the binary messages of a WebSocket.
+type wsConn struct {
+	*websocket.Conn
+	r  io.Reader  // current message
+	wm sync.Mutex // websocket.Conn allows only one writer
+}
+
+func (c *wsConn) Read(b []byte) (n int, err error) {
+	for {
+		if c.r == nil {
+			var t int
+			t, c.r, err = c.NextReader()
+			if err != nil {
+				c.r = nil
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					err = io.EOF
+				}
+				return 0, err
+			}
+			if t != websocket.BinaryMessage {
+				c.r = nil
+				continue
+			}
+		}
+		n, err = c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			err = nil
+			if n == 0 {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (n int, err error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	if err = c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Close tells the peer before closing (WriteControl is safe alongside
+// Write).
+func (c *wsConn) Close() error {
+	_ = c.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
+
+// wsListener accepts the WebSocket upgrades made to its HTTP server.
+type wsListener struct {
+	l      net.Listener
+	path   string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+	u := websocket.Upgrader{HandshakeTimeout: 30 * time.Second}
+	ws, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade() has replied
+	}
+	select {
+	case l.conns <- &wsConn{Conn: ws}:
+	case <-l.closed:
+		_ = ws.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("ws: listener closed")
+	}
+}
+
+func (l *wsListener) Close() (err error) {
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.l.Close()
+	})
+	return
+}
+
+func (l *wsListener) Addr() net.Addr { return l.l.Addr() }
+
+// wsTransport is "ws" or "wss" (WebSocket over TLS).
+type wsTransport string
+
+func (t wsTransport) Name() string { return string(t) }
+
+func (t wsTransport) Dial(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	u, err := wsURL(string(t), addr)
+	if err != nil {
+		return nil, err
+	}
+	env := []string{"HTTPS_PROXY", "ALL_PROXY"}
+	if t == "ws" {
+		env[0] = "HTTP_PROXY"
+	}
+	proxy, err := cfg.proxyURL(u.Host, env...)
+	if err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	d := websocket.Dialer{
+		NetDial: func(network, a string) (net.Conn, error) {
+			if proxy != nil {
+				return dialProxy(ctx, proxy, a)
+			}
+			return nd.DialContext(ctx, network, a)
+		},
+		TLSClientConfig: wsTLSConfig,
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		d.HandshakeTimeout = time.Until(dl)
+	}
+	ws, resp, err := d.Dial(u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%s: %s: %v (HTTP %s)", t, u, err, resp.Status)
+		}
+		return nil, err
+	}
+	return &wsConn{Conn: ws}, nil
+}
+
+func (t wsTransport) Listen(addr string, cfg *Config) (net.Listener, error) {
+	u, err := wsURL(string(t), addr)
+	if err != nil {
+		return nil, err
+	}
+	if t == "wss" && (wsTLSConfig == nil || len(wsTLSConfig.Certificates) == 0) {
+		return nil, errors.New("wss: no server certificate (see SetWSTLSConfig())")
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if t == "wss" {
+		l = tls.NewListener(l, wsTLSConfig)
+	}
+	wl := &wsListener{l: l, path: u.Path,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{})}
+	go func() {
+		srv := &http.Server{Handler: wl, ReadHeaderTimeout: 30 * time.Second}
+		_ = srv.Serve(l)
+	}()
+	return wl, nil
+}
+
+func init() {
+	for _, n := range []string{"ws", "wss"} {
+		if err := RegisterTransport(wsTransport(n)); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package xsnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+// Data of any size crosses the ws transport intact, however the
+// writes are split into messages.
+func TestWSTransport(t *testing.T) {
+	tr := wsTransport("ws")
+	l, err := tr.Listen("127.0.0.1:0/xs-test", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close() // nolint: errcheck
+
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()      // nolint: errcheck
+		_, _ = io.Copy(s, s) // echo
+	}()
+
+	if _, err = tr.Dial(context.Background(), l.Addr().String()+"/elsewhere", &Config{}); err == nil {
+		t.Fatal("dial to wrong path succeeded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := tr.Dial(ctx, "ws://"+l.Addr().String()+"/xs-test", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() // nolint: errcheck
+
+	msg := make([]byte, 100*1024)
+	_, _ = rand.Read(msg)
+	go func() {
+		for i := 0; i < len(msg); i += 1000 {
+			j := i + 1000
+			if j > len(msg) {
+				j = len(msg)
+			}
+			_, _ = c.Write(msg[i:j])
+		}
+	}()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data corrupted")
+	}
+}